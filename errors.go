@@ -32,6 +32,14 @@ var ErrNotWhereToWrite = errors.New("xlog: " +
 // to recorder which is not ready to receive signals.
 var ErrNotListening error = errors.New("xlog: recorder is not listening")
 
+// ErrQueueOverflow returns (in BatchResult) when the message has been
+// dropped by the recorder's overflow policy (or when it dropped others).
+var ErrQueueOverflow = errors.New("xlog: recorder queue is full, messages dropped")
+
+// ErrRootLogger returns when the method works with child loggers only
+// (e.g. ResetSeverityMask, the root logger has no mask override to drop).
+var ErrRootLogger = errors.New("xlog: not available for the root logger")
+
 /* DEPRECATED
 // The error transmits by recorder listener when it receives unknown signal.
 var ErrUnknownSignal = errors.New("unknown signal") */
@@ -55,6 +63,7 @@ var _ErrFalseInit error = errors.New("[OK] false initialisation")
 type BatchResult struct {
 	errors     map[RecorderID]error
 	successful []RecorderID
+	dropped    map[RecorderID]uint64
 	errMessage string
 }
 
@@ -128,6 +137,20 @@ func (br *BatchResult) OK(rec RecorderID) *BatchResult {
 	return br
 }
 
+// GetDropped returns the number of dropped messages for each recorder.
+func (br BatchResult) GetDropped() map[RecorderID]uint64 {
+	return br.dropped
+}
+
+// Drop adds the number of dropped messages for the recorder.
+func (br *BatchResult) Drop(rec RecorderID, n uint64) *BatchResult {
+	if br.dropped == nil {
+		br.dropped = make(map[RecorderID]uint64)
+	}
+	br.dropped[rec] += n
+	return br
+}
+
 func (br *BatchResult) SetMsg(msgFmt string, msgArgs ...interface{}) *BatchResult {
 	br.errMessage = fmt.Sprintf(msgFmt, msgArgs...)
 	return br
@@ -0,0 +1,286 @@
+package xlog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FieldKind describes which value type is stored in the Field.
+type FieldKind uint8
+
+const (
+	FieldAny FieldKind = iota
+	FieldString
+	FieldInt
+	FieldUint
+	FieldFloat
+	FieldBool
+	FieldDuration
+	FieldTime
+	FieldError
+)
+
+// Field represents a typed key/value pair attached to the log message.
+// Fields are stored in the message in the order they have been added.
+type Field struct {
+	Key  string
+	Kind FieldKind
+
+	ival int64
+	fval float64
+	sval string
+	aval interface{}
+}
+
+// Str constructs a field with a string value.
+func Str(key, value string) Field {
+	return Field{Key: key, Kind: FieldString, sval: value}
+}
+
+// Int constructs a field with an integer value.
+func Int(key string, value int64) Field {
+	return Field{Key: key, Kind: FieldInt, ival: value}
+}
+
+// Uint constructs a field with an unsigned integer value.
+func Uint(key string, value uint64) Field {
+	return Field{Key: key, Kind: FieldUint, ival: int64(value)}
+}
+
+// Float constructs a field with a floating-point value.
+func Float(key string, value float64) Field {
+	return Field{Key: key, Kind: FieldFloat, fval: value}
+}
+
+// Bool constructs a field with a boolean value.
+func Bool(key string, value bool) Field {
+	f := Field{Key: key, Kind: FieldBool}
+	if value {
+		f.ival = 1
+	}
+	return f
+}
+
+// Dur constructs a field with a time.Duration value.
+func Dur(key string, value time.Duration) Field {
+	return Field{Key: key, Kind: FieldDuration, ival: int64(value)}
+}
+
+// Time constructs a field with a time.Time value.
+func Time(key string, value time.Time) Field {
+	return Field{Key: key, Kind: FieldTime, aval: value}
+}
+
+// Err constructs a field with the "error" key. Nil error is stored as is.
+func Err(err error) Field {
+	return Field{Key: "error", Kind: FieldError, aval: err}
+}
+
+// Any constructs a field from a value of arbitrary type. Known basic
+// types are stored as typed fields, the others are stored as is.
+func Any(key string, value interface{}) Field {
+	switch v := value.(type) {
+	case string:
+		return Str(key, v)
+	case int:
+		return Int(key, int64(v))
+	case int8:
+		return Int(key, int64(v))
+	case int16:
+		return Int(key, int64(v))
+	case int32:
+		return Int(key, int64(v))
+	case int64:
+		return Int(key, v)
+	case uint:
+		return Uint(key, uint64(v))
+	case uint8:
+		return Uint(key, uint64(v))
+	case uint16:
+		return Uint(key, uint64(v))
+	case uint32:
+		return Uint(key, uint64(v))
+	case uint64:
+		return Uint(key, v)
+	case float32:
+		return Float(key, float64(v))
+	case float64:
+		return Float(key, v)
+	case bool:
+		return Bool(key, v)
+	case time.Duration:
+		return Dur(key, v)
+	case time.Time:
+		return Time(key, v)
+	case error:
+		return Field{Key: key, Kind: FieldError, aval: v}
+	default:
+		return Field{Key: key, Kind: FieldAny, aval: v}
+	}
+}
+
+// Value returns field's value as an interface (typed accordingly to Kind).
+func (f Field) Value() interface{} {
+	switch f.Kind {
+	case FieldString:
+		return f.sval
+	case FieldInt:
+		return f.ival
+	case FieldUint:
+		return uint64(f.ival)
+	case FieldFloat:
+		return f.fval
+	case FieldBool:
+		return f.ival != 0
+	case FieldDuration:
+		return time.Duration(f.ival)
+	default: // FieldTime, FieldError, FieldAny
+		return f.aval
+	}
+}
+
+// String returns field's value in text format (without the key).
+func (f Field) String() string {
+	switch f.Kind {
+	case FieldString:
+		return f.sval
+	case FieldInt:
+		return strconv.FormatInt(f.ival, 10)
+	case FieldUint:
+		return strconv.FormatUint(uint64(f.ival), 10)
+	case FieldFloat:
+		return strconv.FormatFloat(f.fval, 'g', -1, 64)
+	case FieldBool:
+		return strconv.FormatBool(f.ival != 0)
+	case FieldDuration:
+		return time.Duration(f.ival).String()
+	case FieldTime:
+		return f.aval.(time.Time).Format(time.RFC3339Nano)
+	case FieldError:
+		if f.aval == nil {
+			return "<nil>"
+		}
+		return f.aval.(error).Error()
+	default:
+		return fmt.Sprintf("%v", f.aval)
+	}
+}
+
+// FormatFields returns fields in the "key=value key=value" form. Values
+// which contain spaces, quotes, '=' or non-printable characters are quoted.
+func FormatFields(fields []Field) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for i, f := range fields {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(f.Key)
+		sb.WriteByte('=')
+		v := f.String()
+		if needsQuoting(v) {
+			sb.WriteString(strconv.Quote(v))
+		} else {
+			sb.WriteString(v)
+		}
+	}
+	return sb.String()
+}
+
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, c := range s {
+		if c <= ' ' || c == '=' || c == '"' || c == '\\' || !strconv.IsPrint(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// -----------------------------------------------------------------------------
+
+// With attaches a new field with the given key and value to the message.
+func (LM *LogMsg) With(key string, value interface{}) *LogMsg {
+	LM.fields = append(LM.fields, Any(key, value))
+	return LM
+}
+
+// WithFields attaches the given fields to the message.
+func (LM *LogMsg) WithFields(fields ...Field) *LogMsg {
+	LM.fields = append(LM.fields, fields...)
+	return LM
+}
+
+// Str attaches a new string field to the message.
+func (LM *LogMsg) Str(key, value string) *LogMsg {
+	LM.fields = append(LM.fields, Str(key, value))
+	return LM
+}
+
+// Int attaches a new integer field to the message.
+func (LM *LogMsg) Int(key string, value int) *LogMsg {
+	LM.fields = append(LM.fields, Int(key, int64(value)))
+	return LM
+}
+
+// Int64 attaches a new integer field to the message.
+func (LM *LogMsg) Int64(key string, value int64) *LogMsg {
+	LM.fields = append(LM.fields, Int(key, value))
+	return LM
+}
+
+// Uint attaches a new unsigned integer field to the message.
+func (LM *LogMsg) Uint(key string, value uint64) *LogMsg {
+	LM.fields = append(LM.fields, Uint(key, value))
+	return LM
+}
+
+// Float attaches a new floating-point field to the message.
+func (LM *LogMsg) Float(key string, value float64) *LogMsg {
+	LM.fields = append(LM.fields, Float(key, value))
+	return LM
+}
+
+// Bool attaches a new boolean field to the message.
+func (LM *LogMsg) Bool(key string, value bool) *LogMsg {
+	LM.fields = append(LM.fields, Bool(key, value))
+	return LM
+}
+
+// Dur attaches a new time.Duration field to the message.
+func (LM *LogMsg) Dur(key string, value time.Duration) *LogMsg {
+	LM.fields = append(LM.fields, Dur(key, value))
+	return LM
+}
+
+// Time attaches a new time.Time field to the message.
+func (LM *LogMsg) Time(key string, value time.Time) *LogMsg {
+	LM.fields = append(LM.fields, Time(key, value))
+	return LM
+}
+
+// Err attaches an error field (with the "error" key) to the message.
+func (LM *LogMsg) Err(err error) *LogMsg {
+	LM.fields = append(LM.fields, Err(err))
+	return LM
+}
+
+// GetFields returns message fields in the order they have been added.
+// The returned slice shouldn't be modified.
+func (LM *LogMsg) GetFields() []Field { return LM.fields }
+
+// LookupField returns the last field with the given key.
+func (LM *LogMsg) LookupField(key string) (Field, bool) {
+	for i := len(LM.fields) - 1; i >= 0; i-- {
+		if LM.fields[i].Key == key {
+			return LM.fields[i], true
+		}
+	}
+	return Field{}, false
+}
@@ -0,0 +1,97 @@
+package xlog
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bufWriter is a thread safe writer which accumulates the output.
+type bufWriter struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *bufWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *bufWriter) String() string {
+	w.Lock()
+	defer w.Unlock()
+	return w.buf.String()
+}
+
+func TestFields(t *testing.T) {
+	msg := NewLogMsg().Setf("message").
+		With("user", "root").
+		Int("attempt", 3).
+		Bool("ok", false).
+		Dur("took", time.Second).
+		Err(errors.New("some error"))
+
+	fields := msg.GetFields()
+	if len(fields) != 5 {
+		t.Fatalf("wrong number of fields (%d/5)", len(fields))
+	}
+	keys := []string{"user", "attempt", "ok", "took", "error"}
+	for i, k := range keys {
+		if fields[i].Key != k {
+			t.Errorf("wrong field order: [%d] %s (expected %s)", i, fields[i].Key, k)
+		}
+	}
+	if fields[0].Kind != FieldString {
+		t.Errorf("wrong kind of the 'user' field (%d)", fields[0].Kind)
+	}
+	if v, ok := fields[1].Value().(int64); !ok || v != 3 {
+		t.Errorf("wrong value of the 'attempt' field (%v)", fields[1].Value())
+	}
+	if f, ok := msg.LookupField("took"); !ok || f.String() != "1s" {
+		t.Errorf("LookupField() returns wrong field (%v, %v)", f, ok)
+	}
+	if _, ok := msg.LookupField("missing"); ok {
+		t.Errorf("LookupField() found a missing field")
+	}
+
+	const expected = `user=root attempt=3 ok=false took=1s error="some error"`
+	if str := FormatFields(fields); str != expected {
+		t.Errorf("wrong FormatFields() result\nreturn: %s\nshould be: %s", str, expected)
+	}
+}
+
+func TestFieldsWrite(t *testing.T) {
+	const SleepDelay = time.Millisecond * 50
+
+	w := &bufWriter{}
+	l := NewLogger()
+	r := SpawnIoDirectRecorder(w)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	if err := l.RegisterRecorder("rec", r.Intrf()); err != nil {
+		t.Fatalf("RegisterRecorder() return error\n%s", err.Error())
+	}
+	if err := l.Initialise(); err != nil {
+		t.Fatalf("Initialise() return error\n%s", err.Error())
+	}
+	defer l.Close()
+
+	msg := NewLogMsg().Setf("first").Str("k", "v1")
+	if err := l.WriteMsg(nil, msg); err != nil {
+		t.Fatalf("WriteMsg() return error\n%s", err.Error())
+	}
+	// the sent message shouldn't be affected
+	msg.Str("extra", "v2")
+	time.Sleep(SleepDelay)
+
+	outp := w.String()
+	if !strings.Contains(outp, "first k=v1") {
+		t.Errorf("fields are missing in the output\n%s", outp)
+	}
+	if strings.Contains(outp, "extra") {
+		t.Errorf("output contains field added after the write\n%s", outp)
+	}
+}
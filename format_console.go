@@ -0,0 +1,182 @@
+package xlog
+
+import (
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// ColorScheme maps severities to ANSI SGR parameters, e.g. "31" (red text)
+// or "30;41" (black text on red background). Severities without the entry
+// (or with an empty one) are not colored.
+type ColorScheme map[MsgFlagT]string
+
+// DefaultColorScheme returns a new copy of the default color scheme.
+func DefaultColorScheme() ColorScheme {
+	return ColorScheme{
+		Emerg:    "30;41",
+		Alert:    "30;41",
+		Critical: "30;41",
+		Error:    "31",
+		Warning:  "33",
+		Notice:   "1",
+		Debug:    "2",
+		CustomB1: "36",
+		CustomB2: "35",
+	}
+}
+
+// ConsoleFormatter renders messages for the terminal: the same line as the
+// IoDirectDefaultFormatter, but with the aligned and colored level column.
+//
+// Colors are disabled automatically if the writer is not a terminal, if
+// the NO_COLOR environment variable is set (and not empty) or TERM=dumb.
+type ConsoleFormatter struct {
+	colors       bool
+	colorContent bool
+	scheme       ColorScheme
+	names        map[MsgFlagT]string
+	width        int // level column width
+	timeLayout   string
+}
+
+// NewConsoleFormatter allocates and returns a new console formatter for the
+// given writer (it should be the same writer as the recorder's one).
+func NewConsoleFormatter(w io.Writer) *ConsoleFormatter {
+	F := new(ConsoleFormatter)
+	F.colors = colorsSupported(w)
+	F.scheme = DefaultColorScheme()
+	F.names = make(map[MsgFlagT]string)
+	F.timeLayout = defaultTemplateTimeLayout
+	F.updateWidth()
+	return F
+}
+
+// Colors enables or disables colors regardless of the terminal detection.
+func (F *ConsoleFormatter) Colors(enable bool) *ConsoleFormatter {
+	F.colors = enable
+	return F
+}
+
+// ColorContent enables coloring of the message content as well as the level.
+func (F *ConsoleFormatter) ColorContent(enable bool) *ConsoleFormatter {
+	F.colorContent = enable
+	return F
+}
+
+// Scheme replaces the color scheme.
+func (F *ConsoleFormatter) Scheme(scheme ColorScheme) *ConsoleFormatter {
+	F.scheme = scheme
+	return F
+}
+
+// Color sets the color for the severity (empty string disables it).
+func (F *ConsoleFormatter) Color(severity MsgFlagT, sgr string) *ConsoleFormatter {
+	if F.scheme == nil {
+		F.scheme = make(ColorScheme)
+	}
+	F.scheme[severity&^SeverityShadowMask] = sgr
+	return F
+}
+
+// LevelName sets the name of the severity in the level column. It's
+// useful for custom severities, which are printed as hex codes by default.
+func (F *ConsoleFormatter) LevelName(severity MsgFlagT, name string) *ConsoleFormatter {
+	F.names[severity&^SeverityShadowMask] = name
+	F.updateWidth()
+	return F
+}
+
+// TimeLayout sets the time layout ("2006/01/02 15:04:05" by default).
+func (F *ConsoleFormatter) TimeLayout(layout string) *ConsoleFormatter {
+	F.timeLayout = layout
+	return F
+}
+
+// Format renders the message, it implements FormatFunc.
+func (F *ConsoleFormatter) Format(msg *LogMsg) string {
+	sev := msg.GetFlags() &^ SeverityShadowMask
+	sgr := ""
+	if F.colors {
+		sgr = F.scheme[sev]
+	}
+
+	var sb strings.Builder
+	if F.timeLayout != "" {
+		sb.WriteString(msg.GetTime().Format(F.timeLayout))
+		sb.WriteByte(' ')
+	}
+	level := F.levelName(sev)
+	writeColored(&sb, sgr, level)
+	for pad := F.width - utf8.RuneCountInString(level); pad >= 0; pad-- {
+		sb.WriteByte(' ')
+	}
+
+	if name := msg.GetLoggerName(); name != "" {
+		sb.WriteString("[" + name + "] ")
+	}
+	if caller := msg.GetCaller(); caller.IsSet() {
+		sb.WriteString(caller.String() + ": ")
+	}
+	if F.colorContent {
+		writeColored(&sb, sgr, msg.text())
+	} else {
+		sb.WriteString(msg.text())
+	}
+	if fields := msg.GetFields(); len(fields) > 0 {
+		sb.WriteString(" " + FormatFields(fields))
+	}
+	return withStackTrace(sb.String(), msg)
+}
+
+func (F *ConsoleFormatter) levelName(sev MsgFlagT) string {
+	if name, exist := F.names[sev]; exist {
+		return name
+	}
+	return sev.String()
+}
+
+// updateWidth calculates the level column width by the longest name.
+func (F *ConsoleFormatter) updateWidth() {
+	F.width = 0
+	for _, sev := range []MsgFlagT{
+		Emerg, Alert, Critical, Error, Warning, Notice, Info, Debug, CustomB1, CustomB2,
+	} {
+		if n := utf8.RuneCountInString(F.levelName(sev)); n > F.width {
+			F.width = n
+		}
+	}
+}
+
+func writeColored(sb *strings.Builder, sgr, s string) {
+	if sgr == "" {
+		sb.WriteString(s)
+		return
+	}
+	sb.WriteString("\x1b[" + sgr + "m")
+	sb.WriteString(s)
+	sb.WriteString("\x1b[0m")
+}
+
+// colorsSupported says whether the writer is a terminal which supports
+// colors (NO_COLOR and TERM=dumb environment variables are respected).
+func colorsSupported(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	// f.Fd() would put the file into blocking mode
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var terminal bool
+	err = conn.Control(func(fd uintptr) {
+		terminal = isTerminal(fd) // e.g. /dev/null is a char device, not a terminal
+	})
+	return err == nil && terminal
+}
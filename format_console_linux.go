@@ -0,0 +1,17 @@
+//go:build linux
+// +build linux
+
+package xlog
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// isTerminal says whether the file descriptor refers to a terminal.
+func isTerminal(fd uintptr) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+		fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
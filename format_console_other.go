@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package xlog
+
+// isTerminal says whether the file descriptor refers to a terminal. There
+// is no reliable way to check it here, so colors are enabled explicitly.
+func isTerminal(fd uintptr) bool {
+	return false
+}
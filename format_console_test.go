@@ -0,0 +1,91 @@
+package xlog
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConsoleFormatter(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	newMsg := func(flags MsgFlagT) *LogMsg {
+		msg := NewLogMsg().SetFlags(flags).Setf("message")
+		msg.time = stamp
+		return msg.Str("k", "v")
+	}
+
+	t.Run("NoTerminal", func(t *testing.T) {
+		F := NewConsoleFormatter(&bufWriter{})
+		if outp := F.Format(newMsg(Error)); outp != "2020/01/02 03:04:05 ERROR   message k=v" {
+			t.Errorf("wrong output\n%q", outp)
+		}
+		f, err := ioutil.TempFile("", "xlog-test")
+		if err != nil {
+			t.Fatalf("TempFile() error\n%s", err.Error())
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if F := NewConsoleFormatter(f); F.colors {
+			t.Errorf("colors are enabled for the regular file")
+		}
+	})
+
+	t.Run("Colors", func(t *testing.T) {
+		F := NewConsoleFormatter(&bufWriter{}).Colors(true).TimeLayout("")
+		cases := map[MsgFlagT]string{
+			Critical:         "\x1b[30;41mCRIT\x1b[0m    message k=v",
+			Warning | Caller: "\x1b[33mWARNING\x1b[0m message k=v",
+			Info:             "INFO    message k=v",
+			CustomB1:         "\x1b[36m0x1000\x1b[0m  message k=v",
+		}
+		for flags, expected := range cases {
+			if outp := F.Format(newMsg(flags)); outp != expected {
+				t.Errorf("wrong output for %s\n%q", flags&^SeverityShadowMask, outp)
+			}
+		}
+
+		F.LevelName(CustomB2, "SECURITY").Color(CustomB2, "1;35").ColorContent(true)
+		expected := "\x1b[1;35mSECURITY\x1b[0m \x1b[1;35mmessage\x1b[0m k=v"
+		if outp := F.Format(newMsg(CustomB2)); outp != expected {
+			t.Errorf("wrong output for the custom severity\n%q", outp)
+		}
+		if outp := F.Format(newMsg(Info)); outp != "INFO     message k=v" {
+			t.Errorf("level column is not aligned\n%q", outp)
+		}
+	})
+
+	t.Run("Terminal", func(t *testing.T) {
+		null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			t.Skipf("%s is not available", os.DevNull)
+		}
+		defer null.Close()
+		if isTerminal(null.Fd()) {
+			t.Errorf("%s is detected as a terminal", os.DevNull)
+		}
+		ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+		if err != nil {
+			t.Skipf("pseudo terminals are not available")
+		}
+		defer ptmx.Close()
+		if !isTerminal(ptmx.Fd()) {
+			t.Errorf("pseudo terminal is not detected")
+		}
+	})
+
+	t.Run("NoColor", func(t *testing.T) {
+		prev, set := os.LookupEnv("NO_COLOR")
+		os.Setenv("NO_COLOR", "1")
+		defer func() {
+			if set {
+				os.Setenv("NO_COLOR", prev)
+			} else {
+				os.Unsetenv("NO_COLOR")
+			}
+		}()
+		if colorsSupported(os.Stdout) {
+			t.Errorf("NO_COLOR is not respected")
+		}
+	})
+}
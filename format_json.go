@@ -0,0 +1,243 @@
+package xlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// JSONKeys describes names of the JSON object keys. An empty key means the
+// default name, the "-" key omits the value from the output.
+type JSONKeys struct {
+	Time       string // "time"
+	Severity   string // "severity"
+	Attributes string // "attributes"
+	Logger     string // "logger"
+	Caller     string // "caller"
+	Content    string // "msg"
+	Fields     string // "fields"
+	StackTrace string // "stack"
+	Data       string // "data"
+}
+
+var defaultJSONKeys = JSONKeys{
+	Time:       "time",
+	Severity:   "severity",
+	Attributes: "attributes",
+	Logger:     "logger",
+	Caller:     "caller",
+	Content:    "msg",
+	Fields:     "fields",
+	StackTrace: "stack",
+	Data:       "data",
+}
+
+// JSONEncoder renders the message as a single-line JSON object. Use
+// its Format method as the recorder's FormatFunc.
+//
+// Output example:
+//
+//	{"time":"2006-01-02T15:04:05.999999999Z","severity":"ERROR","logger":"app.db",
+//	"msg":"query failed","fields":{"table":"users","error":"timeout"}}
+type JSONEncoder struct {
+	keys         JSONKeys
+	timeLayout   string
+	utc          bool
+	inlineFields bool
+}
+
+var defaultJSONEncoder = NewJSONEncoder()
+
+// JSONFormatter renders the message as a JSON line with default options.
+func JSONFormatter(msg *LogMsg) string {
+	return defaultJSONEncoder.Format(msg)
+}
+
+// NewJSONEncoder allocates and returns a new encoder with default options:
+// RFC3339Nano time in the message's location and nested fields object.
+func NewJSONEncoder() *JSONEncoder {
+	E := new(JSONEncoder)
+	E.keys = defaultJSONKeys
+	E.timeLayout = time.RFC3339Nano
+	return E
+}
+
+// Keys changes names of the JSON keys (empty names stay default).
+func (E *JSONEncoder) Keys(keys JSONKeys) *JSONEncoder {
+	set := func(dst *string, key string) {
+		if key != "" {
+			*dst = key
+		}
+	}
+	set(&E.keys.Time, keys.Time)
+	set(&E.keys.Severity, keys.Severity)
+	set(&E.keys.Attributes, keys.Attributes)
+	set(&E.keys.Logger, keys.Logger)
+	set(&E.keys.Caller, keys.Caller)
+	set(&E.keys.Content, keys.Content)
+	set(&E.keys.Fields, keys.Fields)
+	set(&E.keys.StackTrace, keys.StackTrace)
+	set(&E.keys.Data, keys.Data)
+	return E
+}
+
+// TimeLayout sets the time layout (time.RFC3339Nano by default).
+func (E *JSONEncoder) TimeLayout(layout string) *JSONEncoder {
+	E.timeLayout = layout
+	return E
+}
+
+// UTC enables conversion of the message time to UTC.
+func (E *JSONEncoder) UTC(enable bool) *JSONEncoder {
+	E.utc = enable
+	return E
+}
+
+// InlineFields puts message fields to the top-level object instead of the
+// nested one. Fields with the same keys as the message's keys are skipped.
+func (E *JSONEncoder) InlineFields(enable bool) *JSONEncoder {
+	E.inlineFields = enable
+	return E
+}
+
+// Format renders the message, it implements FormatFunc.
+func (E *JSONEncoder) Format(msg *LogMsg) string {
+	var buf bytes.Buffer
+	w := jsonObjectWriter{buf: &buf}
+	buf.WriteByte('{')
+
+	if key := E.keys.Time; key != "-" {
+		t := msg.GetTime()
+		if E.utc {
+			t = t.UTC()
+		}
+		w.value(key, t.Format(E.timeLayout))
+	}
+	if key := E.keys.Severity; key != "-" {
+		w.value(key, (msg.GetFlags() &^ SeverityShadowMask).String())
+	}
+	if attrs := attributeNames(msg.GetFlags()); len(attrs) > 0 && E.keys.Attributes != "-" {
+		w.value(E.keys.Attributes, attrs)
+	}
+	if name := msg.GetLoggerName(); name != "" && E.keys.Logger != "-" {
+		w.value(E.keys.Logger, name)
+	}
+	if caller := msg.GetCaller(); caller.IsSet() && E.keys.Caller != "-" {
+		w.value(E.keys.Caller, jsonCaller{caller.File, caller.Line, caller.Func})
+	}
+	if key := E.keys.Content; key != "-" {
+		w.value(key, msg.text())
+	}
+
+	if fields := msg.GetFields(); len(fields) > 0 && E.keys.Fields != "-" {
+		if E.inlineFields {
+			for _, f := range fields {
+				if !E.reserved(f.Key) {
+					w.value(f.Key, jsonFieldValue(f))
+				}
+			}
+		} else {
+			w.key(E.keys.Fields)
+			fw := jsonObjectWriter{buf: &buf}
+			buf.WriteByte('{')
+			for _, f := range fields {
+				fw.value(f.Key, jsonFieldValue(f))
+			}
+			buf.WriteByte('}')
+		}
+	}
+
+	if stack := msg.GetStackTrace(); stack != "" && E.keys.StackTrace != "-" {
+		w.value(E.keys.StackTrace, stack)
+	}
+	if msg.Data != nil && E.keys.Data != "-" {
+		w.value(E.keys.Data, msg.Data)
+	}
+
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// reserved says whether the key is used by the message's own values.
+func (E *JSONEncoder) reserved(key string) bool {
+	switch key {
+	case E.keys.Time, E.keys.Severity, E.keys.Attributes, E.keys.Logger,
+		E.keys.Caller, E.keys.Content, E.keys.StackTrace, E.keys.Data:
+		return true
+	}
+	return false
+}
+
+// -----------------------------------------------------------------------------
+
+type jsonCaller struct {
+	File string `json:"file"`
+	Line int    `json:"line"`
+	Func string `json:"func,omitempty"`
+}
+
+// jsonObjectWriter writes comma-separated key/value pairs of the object.
+type jsonObjectWriter struct {
+	buf   *bytes.Buffer
+	count int
+}
+
+func (w *jsonObjectWriter) key(key string) {
+	if w.count > 0 {
+		w.buf.WriteByte(',')
+	}
+	w.count++
+	writeJSON(w.buf, key)
+	w.buf.WriteByte(':')
+}
+
+func (w *jsonObjectWriter) value(key string, v interface{}) {
+	w.key(key)
+	writeJSON(w.buf, v)
+}
+
+// writeJSON writes the value (json.Marshaler is honored). If the value
+// can't be encoded, it's written as a string in the %v form.
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	var tmp bytes.Buffer
+	enc := json.NewEncoder(&tmp)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		tmp.Reset()
+		_ = enc.Encode(fmt.Sprintf("%v", v))
+	}
+	// Encode adds a newline
+	buf.Write(bytes.TrimSuffix(tmp.Bytes(), []byte{'\n'}))
+}
+
+// jsonFieldValue returns the value of the field ready for JSON encoding.
+func jsonFieldValue(f Field) interface{} {
+	switch f.Kind {
+	case FieldDuration, FieldTime, FieldError:
+		return f.String()
+	default: // NaN and Inf floats are written as strings by writeJSON
+		return f.Value()
+	}
+}
+
+// attributeNames returns names of the default attribute flags.
+func attributeNames(flags MsgFlagT) []string {
+	var names []string
+	if flags&StackTrace > 0 {
+		names = append(names, "STACKTRACE")
+	}
+	if flags&StackTraceShort > 0 {
+		names = append(names, "STACKTRACE_SHORT")
+	}
+	if flags&Caller > 0 {
+		names = append(names, "CALLER")
+	}
+	if flags&CustomB3 > 0 {
+		names = append(names, "CUSTOM_B3")
+	}
+	if flags&CustomB4 > 0 {
+		names = append(names, "CUSTOM_B4")
+	}
+	return names
+}
@@ -0,0 +1,124 @@
+package xlog
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type jsonTestData struct{ ID int }
+
+func (d jsonTestData) MarshalJSON() ([]byte, error) {
+	return []byte(`{"custom_id":` + string(rune('0'+d.ID)) + `}`), nil
+}
+
+func TestJSONFormatter(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 600, time.UTC)
+
+	msg := NewLogMsg().SetFlags(Error | StackTrace).Setf("line 1\n\"line\" 2")
+	msg.time = stamp
+	msg.logger = "app.db"
+	msg.stack = "goroutine 1 [running]:\n"
+	msg.Data = jsonTestData{7}
+	msg.Str("table", "users").Int("n", 3).Dur("took", time.Second).Err(errors.New("timeout"))
+
+	outp := JSONFormatter(msg)
+	if strings.Contains(outp, "\n") {
+		t.Fatalf("output is not a single line\n%s", outp)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(outp), &obj); err != nil {
+		t.Fatalf("invalid JSON: %s\n%s", err.Error(), outp)
+	}
+
+	expected := map[string]interface{}{
+		"time":     "2020-01-02T03:04:05.0000006Z",
+		"severity": "ERROR",
+		"logger":   "app.db",
+		"msg":      "line 1\n\"line\" 2",
+		"stack":    "goroutine 1 [running]:\n",
+	}
+	for key, value := range expected {
+		if obj[key] != value {
+			t.Errorf("wrong %q value: %v", key, obj[key])
+		}
+	}
+	if attrs, _ := obj["attributes"].([]interface{}); len(attrs) != 1 || attrs[0] != "STACKTRACE" {
+		t.Errorf("wrong attributes: %v", obj["attributes"])
+	}
+	if data, _ := obj["data"].(map[string]interface{}); data["custom_id"] != 7.0 {
+		t.Errorf("json.Marshaler is not honored: %v", obj["data"])
+	}
+	fields, _ := obj["fields"].(map[string]interface{})
+	if fields["table"] != "users" || fields["n"] != 3.0 ||
+		fields["took"] != "1s" || fields["error"] != "timeout" {
+		t.Errorf("wrong fields: %v", obj["fields"])
+	}
+	if strings.Index(outp, `"table"`) > strings.Index(outp, `"n"`) {
+		t.Errorf("fields order is not kept\n%s", outp)
+	}
+
+	t.Run("Encoder", func(t *testing.T) {
+		enc := NewJSONEncoder().UTC(true).TimeLayout(time.RFC3339).InlineFields(true).
+			Keys(JSONKeys{Content: "message", Severity: "level", StackTrace: "-"})
+		msg.time = stamp.In(time.FixedZone("X", 3600))
+		msg.Str("msg", "inlined")
+
+		var obj map[string]interface{}
+		outp := enc.Format(msg)
+		if err := json.Unmarshal([]byte(outp), &obj); err != nil {
+			t.Fatalf("invalid JSON: %s\n%s", err.Error(), outp)
+		}
+		if obj["time"] != "2020-01-02T03:04:05Z" || obj["level"] != "ERROR" ||
+			obj["message"] != "line 1\n\"line\" 2" || obj["table"] != "users" ||
+			obj["msg"] != "inlined" {
+			t.Errorf("wrong output\n%s", outp)
+		}
+		if _, exist := obj["stack"]; exist {
+			t.Errorf("omitted key is written\n%s", outp)
+		}
+	})
+
+	t.Run("Write", func(t *testing.T) {
+		w := &bufWriter{}
+		l := NewLogger()
+		r := SpawnIoDirectRecorder(w).FormatFunc(JSONFormatter)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		wc := &bufWriter{}
+		rc := SpawnIoDirectRecorder(wc).FormatFunc(func(msg *LogMsg) string { return msg.GetContent() })
+		defer func() { rc.Intrf().ChCtl <- SignalStop() }()
+		if e := l.RegisterRecorder("rec", r.Intrf()); e != nil {
+			t.Fatalf("RegisterRecorder() return error\n%s", e.Error())
+		}
+		if e := l.RegisterRecorder("custom", rc.Intrf()); e != nil {
+			t.Fatalf("RegisterRecorder() return error\n%s", e.Error())
+		}
+		if e := l.Initialise(); e != nil {
+			t.Fatalf("Initialise() return error\n%s", e.Error())
+		}
+		defer l.Close()
+
+		_ = l.Write(Warning|StackTraceShort, "with <html> & stack")
+		flushLogger(t, l)
+
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(w.String()), &obj); err != nil {
+			t.Fatalf("invalid JSON: %s\n%s", err.Error(), w.String())
+		}
+		if obj["msg"] != "with <html> & stack" {
+			t.Errorf("stack trace is glued into content: %v", obj["msg"])
+		}
+		if stack, _ := obj["stack"].(string); !strings.HasPrefix(stack, "goroutine") {
+			t.Errorf("stack trace is not captured: %v", obj["stack"])
+		}
+		// custom formatters still get the stack trace with the content
+		if !strings.Contains(wc.String(), "with <html> & stack\n---------- stack trace ----------   goroutine") {
+			t.Errorf("stack trace is not appended to content:\n%s", wc.String())
+		}
+		if strings.Contains(w.String(), `\u003c`) {
+			t.Errorf("HTML characters are escaped\n%s", w.String())
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package xlog
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogfmtFormatter renders the message as a logfmt line:
+//
+//	ts=2006-01-02T15:04:05.999999999Z level=ERROR logger=app.db msg="query failed" table=users
+//
+// Values with spaces, quotes, '=' or control characters are quoted, so
+// the multi-line content stays on a single line. Message fields follow
+// the content. If LogMsg.Data is a map or a struct, it's flattened to
+// key=value pairs (nested keys are joined by dots), other values are
+// written as data=value. The stack trace goes last as the stack value.
+func LogfmtFormatter(msg *LogMsg) string {
+	var sb strings.Builder
+	writeLogfmt(&sb, "ts", msg.GetTime().Format(time.RFC3339Nano))
+	writeLogfmt(&sb, "level", (msg.GetFlags() &^ SeverityShadowMask).String())
+	if name := msg.GetLoggerName(); name != "" {
+		writeLogfmt(&sb, "logger", name)
+	}
+	if caller := msg.GetCaller(); caller.IsSet() {
+		writeLogfmt(&sb, "caller", caller.String())
+	}
+	writeLogfmt(&sb, "msg", msg.text())
+	for _, f := range msg.GetFields() {
+		writeLogfmt(&sb, f.Key, f.String())
+	}
+	if msg.Data != nil {
+		flattenLogfmt(&sb, "", reflect.ValueOf(msg.Data), 0)
+	}
+	if stack := msg.GetStackTrace(); stack != "" {
+		writeLogfmt(&sb, "stack", stack)
+	}
+	return sb.String()
+}
+
+// writeLogfmt writes a single key=value pair (separated by a space from
+// the previous one).
+func writeLogfmt(sb *strings.Builder, key, value string) {
+	if sb.Len() > 0 {
+		sb.WriteByte(' ')
+	}
+	sb.WriteString(logfmtKey(key))
+	sb.WriteByte('=')
+	if needsQuoting(value) {
+		sb.WriteString(strconv.Quote(value))
+	} else {
+		sb.WriteString(value)
+	}
+}
+
+// logfmtKey replaces characters which are not allowed in keys.
+func logfmtKey(key string) string {
+	if key == "" {
+		return "_"
+	}
+	return strings.Map(func(c rune) rune {
+		if c <= ' ' || c == '=' || c == '"' || !strconv.IsPrint(c) {
+			return '_'
+		}
+		return c
+	}, key)
+}
+
+// nesting limit for flattening (protects from cyclic pointers)
+const logfmtMaxDepth = 8
+
+// flattenLogfmt writes maps and structs as prefixed key=value pairs and
+// other values as a single pair ("data" is used for the empty prefix).
+func flattenLogfmt(sb *strings.Builder, prefix string, v reflect.Value, depth int) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + "." + key
+	}
+	leaf := func(value string) {
+		if prefix == "" {
+			writeLogfmt(sb, "data", value)
+		} else {
+			writeLogfmt(sb, prefix, value)
+		}
+	}
+
+	isRef := func(v reflect.Value) bool {
+		return v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface
+	}
+	for isRef(v) && !v.IsNil() {
+		if _, ok := logfmtText(v); ok { // methods with pointer receivers
+			break
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() || (isRef(v) && v.IsNil()) {
+		leaf("<nil>")
+		return
+	}
+	if text, ok := logfmtText(v); ok {
+		leaf(text)
+		return
+	}
+	if depth >= logfmtMaxDepth {
+		leaf(fmt.Sprintf("%v", v.Interface()))
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		keys := v.MapKeys()
+		names := make(map[string]reflect.Value, len(keys))
+		sorted := make([]string, 0, len(keys))
+		for _, k := range keys {
+			name := fmt.Sprintf("%v", k.Interface())
+			names[name] = k
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			flattenLogfmt(sb, join(name), v.MapIndex(names[name]), depth+1)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			if sf.PkgPath != "" { // unexported
+				continue
+			}
+			name := sf.Name
+			if tag := strings.Split(sf.Tag.Get("json"), ",")[0]; tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			flattenLogfmt(sb, join(name), v.Field(i), depth+1)
+		}
+	default:
+		leaf(fmt.Sprintf("%v", v.Interface()))
+	}
+}
+
+// logfmtText returns the text form of the value if it implements error,
+// fmt.Stringer or encoding.TextMarshaler (e.g. time.Time).
+func logfmtText(v reflect.Value) (string, bool) {
+	if !v.CanInterface() {
+		return "", false
+	}
+	switch x := v.Interface().(type) {
+	case error:
+		return x.Error(), true
+	case fmt.Stringer:
+		return x.String(), true
+	case encoding.TextMarshaler:
+		if text, err := x.MarshalText(); err == nil {
+			return string(text), true
+		}
+	}
+	return "", false
+}
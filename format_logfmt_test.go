@@ -0,0 +1,69 @@
+package xlog
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogfmtFormatter(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	type inner struct {
+		Zone string `json:"zone"`
+	}
+	type payload struct {
+		Host    string
+		Port    int    `json:"port"`
+		Secret  string `json:"-"`
+		private int
+		Inner   inner
+		Nil     *inner
+		Err     error
+	}
+
+	cases := []struct {
+		name     string
+		data     interface{}
+		expected string
+	}{
+		{"NoData", nil, ""},
+		{"Map", map[string]interface{}{"b": 2, "a": "x y", "m": map[int]bool{1: true}},
+			` a="x y" b=2 m.1=true`},
+		{"Struct", &payload{Host: "db", Port: 5432, Secret: "s", Inner: inner{"eu"},
+			Err: errors.New("no route")},
+			` Host=db port=5432 Inner.zone=eu Nil=<nil> Err="no route"`},
+		{"Scalar", 42, ` data=42`},
+		{"Stringer", time.Second, ` data=1s`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := NewLogMsg().SetFlags(Error).Setf("line 1\n\"line\" 2")
+			msg.time = stamp
+			msg.Str("user name", "bob").Str("empty", "").Int("n", 3)
+			msg.Data = tc.data
+
+			expected := `ts=2020-01-02T03:04:05Z level=ERROR msg="line 1\n\"line\" 2"` +
+				` user_name=bob empty="" n=3` + tc.expected
+			if outp := LogfmtFormatter(msg); outp != expected {
+				t.Errorf("wrong output\n%s\nexpected:\n%s", outp, expected)
+			}
+		})
+	}
+
+	t.Run("StackTrace", func(t *testing.T) {
+		msg := NewLogMsg().SetFlags(Error).Setf("message")
+		msg.logger = "app"
+		msg.stack = "goroutine 1 [running]:\nmain.main()\n"
+		outp := LogfmtFormatter(msg)
+		if strings.Contains(outp, "\n") {
+			t.Errorf("output is not a single line\n%s", outp)
+		}
+		if !strings.Contains(outp, ` logger=app `) ||
+			!strings.HasSuffix(outp, ` stack="goroutine 1 [running]:\nmain.main()\n"`) {
+			t.Errorf("wrong output\n%s", outp)
+		}
+	})
+}
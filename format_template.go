@@ -0,0 +1,274 @@
+package xlog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TemplateFormatter renders messages by the layout string. The layout is
+// compiled once, the formatter executes a list of prepared steps and
+// doesn't use reflection (except for the %v form of custom Data values).
+//
+// Placeholders have the form {name} or {name:arg}. For the time the arg
+// is a time layout, for the others it's the column width: positive width
+// aligns the value to the right, negative one aligns it to the left.
+//
+//	{time[@zone][:layout]}  message time ("2006/01/02 15:04:05" by default);
+//	                        zone is "UTC", "Local" or IANA name, e.g. time@UTC
+//	{level}                 severity name (INFO, ERROR, ...)
+//	{attrs}                 attribute markers (STACKTRACE,CALLER, ...)
+//	{logger}                logger name
+//	{caller}                file.go:123 (for messages with Caller flag)
+//	{msg}                   message content
+//	{fields}                all fields in the key=value form
+//	{field.KEY}             value of the message field
+//	{data}                  LogMsg.Data in the %v form
+//	{data.KEY}              value from the Data (see DataGetter)
+//	{stack}                 stack trace
+//
+// Use {{ and }} to write the braces.
+//
+// Example:
+//
+//	"{time:2006-01-02T15:04:05.000Z07:00} [{level:-7}] {caller} {msg}"
+type TemplateFormatter struct {
+	steps []tmplStep
+}
+
+// DataGetter can be implemented by LogMsg.Data to provide values for the
+// {data.KEY} placeholders. Values of map[string]interface{} and
+// map[string]string are supported as well.
+type DataGetter interface {
+	GetDataField(key string) (interface{}, bool)
+}
+
+// tmplStep writes a part of the output.
+type tmplStep func(sb *strings.Builder, msg *LogMsg)
+
+const defaultTemplateTimeLayout = "2006/01/02 15:04:05"
+
+// NewTemplateFormatter compiles the layout. It returns an error for unknown
+// placeholders, wrong widths or time zones and unbalanced braces.
+func NewTemplateFormatter(layout string) (*TemplateFormatter, error) {
+	F := new(TemplateFormatter)
+	var text strings.Builder
+	flushText := func() {
+		if text.Len() > 0 {
+			s := text.String()
+			F.steps = append(F.steps, func(sb *strings.Builder, _ *LogMsg) {
+				sb.WriteString(s)
+			})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(layout); i++ {
+		c := layout[i]
+		switch {
+		case c == '{' && i+1 < len(layout) && layout[i+1] == '{':
+			text.WriteByte('{')
+			i++
+		case c == '}' && i+1 < len(layout) && layout[i+1] == '}':
+			text.WriteByte('}')
+			i++
+		case c == '}':
+			return nil, fmt.Errorf("xlog: template: unexpected '}' at %d", i)
+		case c == '{':
+			end := strings.IndexByte(layout[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("xlog: template: unclosed '{' at %d", i)
+			}
+			step, err := compilePlaceholder(layout[i+1 : i+end])
+			if err != nil {
+				return nil, err
+			}
+			flushText()
+			F.steps = append(F.steps, step)
+			i += end
+		default:
+			text.WriteByte(c)
+		}
+	}
+	flushText()
+	return F, nil
+}
+
+// MustTemplateFormatter is like NewTemplateFormatter but panics if the
+// layout can't be compiled. It simplifies initialisation of globals.
+func MustTemplateFormatter(layout string) *TemplateFormatter {
+	F, err := NewTemplateFormatter(layout)
+	if err != nil {
+		panic(err.Error())
+	}
+	return F
+}
+
+// Format renders the message, it implements FormatFunc.
+func (F *TemplateFormatter) Format(msg *LogMsg) string {
+	var sb strings.Builder
+	for _, step := range F.steps {
+		step(&sb, msg)
+	}
+	return sb.String()
+}
+
+// -----------------------------------------------------------------------------
+
+func compilePlaceholder(ph string) (tmplStep, error) {
+	name, arg := ph, ""
+	if n := strings.IndexByte(ph, ':'); n >= 0 {
+		name, arg = ph[:n], ph[n+1:]
+	}
+
+	if name == "time" || strings.HasPrefix(name, "time@") {
+		return compileTime(name, arg)
+	}
+
+	width := 0
+	if arg != "" {
+		w, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("xlog: template: wrong width in {%s}", ph)
+		}
+		width = w
+	}
+
+	var value func(msg *LogMsg) string
+	switch {
+	case name == "level":
+		value = func(msg *LogMsg) string {
+			return (msg.flags &^ SeverityShadowMask).String()
+		}
+	case name == "attrs":
+		value = func(msg *LogMsg) string {
+			return strings.Join(attributeNames(msg.flags), ",")
+		}
+	case name == "logger":
+		value = func(msg *LogMsg) string { return msg.logger }
+	case name == "caller":
+		value = func(msg *LogMsg) string {
+			if !msg.caller.IsSet() {
+				return ""
+			}
+			return msg.caller.String()
+		}
+	case name == "msg":
+		value = func(msg *LogMsg) string { return msg.text() }
+	case name == "fields":
+		value = func(msg *LogMsg) string { return FormatFields(msg.fields) }
+	case name == "stack":
+		value = func(msg *LogMsg) string { return msg.stack }
+	case name == "data":
+		value = func(msg *LogMsg) string {
+			if msg.Data == nil {
+				return ""
+			}
+			return tmplString(msg.Data)
+		}
+	case strings.HasPrefix(name, "field.") && len(name) > len("field."):
+		key := name[len("field."):]
+		value = func(msg *LogMsg) string {
+			if f, ok := msg.LookupField(key); ok {
+				return f.String()
+			}
+			return ""
+		}
+	case strings.HasPrefix(name, "data.") && len(name) > len("data."):
+		key := name[len("data."):]
+		value = func(msg *LogMsg) string { return tmplDataField(msg.Data, key) }
+	default:
+		return nil, fmt.Errorf("xlog: template: unknown placeholder {%s}", ph)
+	}
+
+	if width == 0 {
+		return func(sb *strings.Builder, msg *LogMsg) {
+			sb.WriteString(value(msg))
+		}, nil
+	}
+	return func(sb *strings.Builder, msg *LogMsg) {
+		writePadded(sb, value(msg), width)
+	}, nil
+}
+
+func compileTime(name, layout string) (tmplStep, error) {
+	if layout == "" {
+		layout = defaultTemplateTimeLayout
+	}
+	var loc *time.Location
+	if n := strings.IndexByte(name, '@'); n >= 0 {
+		var err error
+		if loc, err = time.LoadLocation(name[n+1:]); err != nil {
+			return nil, fmt.Errorf("xlog: template: wrong time zone in {%s}", name)
+		}
+	}
+	return func(sb *strings.Builder, msg *LogMsg) {
+		t := msg.time
+		if loc != nil {
+			t = t.In(loc)
+		}
+		sb.WriteString(t.Format(layout))
+	}, nil
+}
+
+// writePadded writes the value aligned to the column of the given width
+// (negative width aligns the value to the left).
+func writePadded(sb *strings.Builder, s string, width int) {
+	left := width < 0
+	if left {
+		width = -width
+	}
+	pad := width - utf8.RuneCountInString(s)
+	if !left {
+		for ; pad > 0; pad-- {
+			sb.WriteByte(' ')
+		}
+	}
+	sb.WriteString(s)
+	for ; pad > 0; pad-- {
+		sb.WriteByte(' ')
+	}
+}
+
+func tmplDataField(data interface{}, key string) string {
+	var v interface{}
+	var ok bool
+	switch d := data.(type) {
+	case DataGetter:
+		v, ok = d.GetDataField(key)
+	case map[string]interface{}:
+		v, ok = d[key]
+	case map[string]string:
+		v, ok = d[key]
+	}
+	if !ok || v == nil {
+		return ""
+	}
+	return tmplString(v)
+}
+
+// tmplString converts common types without fmt.
+func tmplString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case int:
+		return strconv.Itoa(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case uint64:
+		return strconv.FormatUint(x, 10)
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
@@ -0,0 +1,73 @@
+package xlog
+
+import (
+	"testing"
+	"time"
+)
+
+type templateTestData struct{ user string }
+
+func (d templateTestData) GetDataField(key string) (interface{}, bool) {
+	if key == "user" {
+		return d.user, true
+	}
+	return nil, false
+}
+
+func TestTemplateFormatter(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.FixedZone("X", 3600))
+
+	newMsg := func() *LogMsg {
+		msg := NewLogMsg().SetFlags(Warning | Caller).Setf("message")
+		msg.time = stamp
+		msg.logger = "app"
+		msg.caller = CallerInfo{File: "/src/main.go", Line: 42}
+		msg.Str("table", "users").Int("n", 3)
+		return msg
+	}
+
+	cases := []struct {
+		layout   string
+		data     interface{}
+		expected string
+	}{
+		{"{time:2006-01-02T15:04:05.000Z07:00} [{level:-7}] {caller} {msg}", nil,
+			"2020-01-02T03:04:05.006+01:00 [WARNING] main.go:42 message"},
+		{"{time@UTC:15:04:05} {time} |{level:7}|{level:-9}|", nil,
+			"02:04:05 2020/01/02 03:04:05 |WARNING|WARNING  |"},
+		{"{{{logger}}} {attrs} {msg} {fields}", nil,
+			"{app} CALLER message table=users n=3"},
+		{"{field.n} {field.missing}/{data.user} {data}", map[string]interface{}{"user": "bob"},
+			"3 /bob map[user:bob]"},
+		{"{data.user} {data.missing}|", templateTestData{"alice"}, "alice |"},
+		{"{data.user}", map[string]string{"user": "eve"}, "eve"},
+	}
+	for _, tc := range cases {
+		F, err := NewTemplateFormatter(tc.layout)
+		if err != nil {
+			t.Errorf("NewTemplateFormatter(%q) return error\n%s", tc.layout, err.Error())
+			continue
+		}
+		msg := newMsg()
+		msg.Data = tc.data
+		if outp := F.Format(msg); outp != tc.expected {
+			t.Errorf("wrong output for %q\n%q\nexpected:\n%q", tc.layout, outp, tc.expected)
+		}
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, layout := range []string{
+			"{msg", "msg}", "{unknown}", "{level:x}", "{time@Nowhere/Zone}", "{field.}",
+		} {
+			if _, err := NewTemplateFormatter(layout); err == nil {
+				t.Errorf("no error for %q", layout)
+			}
+		}
+		defer func() {
+			if recover() == nil {
+				t.Errorf("MustTemplateFormatter() doesn't panic")
+			}
+		}()
+		MustTemplateFormatter("{msg")
+	})
+}
@@ -0,0 +1,28 @@
+package xlog
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestLogger returns initialised logger with the given recorder.
+func newTestLogger(t *testing.T, intrf RecorderInterface) *Logger {
+	l := NewLogger()
+	if e := l.RegisterRecorder("rec", intrf); e != nil {
+		t.Fatalf("RegisterRecorder() return error\n%s", e.Error())
+	}
+	if e := l.Initialise(); e != nil {
+		t.Fatalf("Initialise() return error\n%s", e.Error())
+	}
+	return l
+}
+
+// flushLogger flushes the logger, the test fails if it takes more than 5s.
+func flushLogger(t *testing.T, l *Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if e := l.Flush(ctx); e != nil {
+		t.Fatalf("Flush() return error\n%s", e.Error())
+	}
+}
@@ -2,9 +2,14 @@ package xlog
 
 import (
 	"container/list"
+	"context"
+	"fmt"
 	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rs/xid"
 )
@@ -775,7 +780,7 @@ func TestWriteFunc(t *testing.T) {
 		if e := l.WriteMsg(nil, nil); e == nil {
 			t.Error("WriteMsg()" + emsgErrExpected)
 		} else if e != ErrWrongParameter {
-			t.Error(emsgUnexpectedError, e)
+			t.Errorf(emsgUnexpectedError, e)
 		}
 	})
 
@@ -829,3 +834,260 @@ func TestWriteFunc(t *testing.T) {
 		t.Error(emsgPanicExpected)
 	})
 }
+
+func TestLoggerChild(t *testing.T) {
+	const SleepDelay = time.Millisecond * 50
+
+	w := &bufWriter{}
+	l := NewLogger()
+	r := SpawnIoDirectRecorder(w)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	var recID RecorderID = "rec"
+	if e := l.RegisterRecorder(recID, r.Intrf()); e != nil {
+		t.Fatalf("RegisterRecorder() return error\n%s", e.Error())
+	}
+
+	child := l.Named("app").Child(Str("req", "r1")).Named("db")
+	if child.Name() != "app.db" {
+		t.Errorf("wrong child name (%s)", child.Name())
+	}
+	if n := child.NumberOfRecorders(); n != 1 {
+		t.Errorf("child doesn't share recorders (%d/1)", n)
+	}
+	if e := child.Initialise(); e != nil {
+		t.Fatalf("Initialise() return error\n%s", e.Error())
+	}
+	defer l.Close()
+	if !l.initialised {
+		t.Fatalf("child doesn't initialise the parent logger")
+	}
+
+	t.Run("WriteMsg@stamp", func(t *testing.T) {
+		msg := NewLogMsg().Setf("child message").Int("n", 1)
+		if e := child.WriteMsg(nil, msg); e != nil {
+			t.Fatalf("WriteMsg() return error\n%s", e.Error())
+		}
+		time.Sleep(SleepDelay)
+		if outp := w.String(); !strings.Contains(outp, "[app.db] child message req=r1 n=1") {
+			t.Errorf("message isn't stamped\n%s", outp)
+		}
+		if len(msg.GetFields()) != 1 || msg.GetLoggerName() != "" {
+			t.Errorf("user's message has been modified")
+		}
+	})
+
+	t.Run("SetSeverityMask@inherit", func(t *testing.T) {
+		if e := l.SetSeverityMask(recID, SeverityAll&^Debug); e != nil {
+			t.Fatalf("SetSeverityMask() return error\n%s", e.Error())
+		}
+		_ = child.Write(Debug, "inherited mask")
+		time.Sleep(SleepDelay)
+		if outp := w.String(); strings.Contains(outp, "inherited mask") {
+			t.Errorf("parent's mask is not propagated\n%s", outp)
+		}
+	})
+
+	t.Run("SetSeverityMask@override", func(t *testing.T) {
+		if e := child.SetSeverityMask(recID, SeverityAll); e != nil {
+			t.Fatalf("SetSeverityMask() return error\n%s", e.Error())
+		}
+		if e := child.SetSeverityMask("wrong-rec", SeverityAll); e != ErrWrongRecorderID {
+			t.Errorf(emsgUnexpectedError, e)
+		}
+		_ = child.Write(Debug, "overridden mask")
+		_ = l.Write(Debug, "parent message")
+		time.Sleep(SleepDelay)
+		outp := w.String()
+		if !strings.Contains(outp, "overridden mask") {
+			t.Errorf("child's override is ignored\n%s", outp)
+		}
+		if strings.Contains(outp, "parent message") {
+			t.Errorf("child's override affects the parent\n%s", outp)
+		}
+
+		if e := child.ResetSeverityMask(recID); e != nil {
+			t.Fatalf("ResetSeverityMask() return error\n%s", e.Error())
+		}
+		_ = child.Write(Debug, "after reset")
+		time.Sleep(SleepDelay)
+		if outp := w.String(); strings.Contains(outp, "after reset") {
+			t.Errorf("override is not dropped\n%s", outp)
+		}
+
+		// the root mask is kept
+		if e := l.ResetSeverityMask(recID); e != ErrRootLogger {
+			t.Errorf(emsgUnexpectedError, e)
+		}
+		_ = l.Write(Debug, "root after reset")
+		time.Sleep(SleepDelay)
+		if outp := w.String(); strings.Contains(outp, "root after reset") {
+			t.Errorf("root mask is reset\n%s", outp)
+		}
+	})
+}
+
+// slowWriter counts written lines with a delay for each write.
+type slowWriter struct {
+	delay time.Duration
+	lines int32_s
+}
+
+type int32_s struct {
+	sync.Mutex
+	v int
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.lines.Lock()
+	w.lines.v++
+	w.lines.Unlock()
+	return len(p), nil
+}
+
+func (w *slowWriter) count() int {
+	w.lines.Lock()
+	defer w.lines.Unlock()
+	return w.lines.v
+}
+
+func TestLoggerFlush(t *testing.T) {
+	const NumMessages = 20
+
+	l := NewLogger()
+	w := &slowWriter{delay: time.Millisecond * 5}
+	r1 := SpawnIoDirectRecorder(w)
+	r2 := SpawnIoDirectRecorder(NewVoidWriter())
+	defer func() { r1.Intrf().ChCtl <- SignalStop() }()
+	var rec1ID RecorderID = "rec-1"
+	var rec2ID RecorderID = "rec-2"
+
+	if e := l.Flush(context.Background()); e != ErrNoRecorders {
+		t.Errorf(emsgUnexpectedError, e)
+	}
+	if e := l.RegisterRecorder(rec1ID, r1.Intrf()); e != nil {
+		t.Fatalf("RegisterRecorder() return error\n%s", e.Error())
+	}
+	if e := l.RegisterRecorder(rec2ID, r2.Intrf(), false); e != nil {
+		t.Fatalf("RegisterRecorder() return error\n%s", e.Error())
+	}
+	if e := l.Flush(context.Background()); e != ErrNotInitialised {
+		t.Errorf(emsgUnexpectedError, e)
+	}
+	if e := l.Initialise(); e != nil {
+		t.Fatalf("Initialise() return error\n%s", e.Error())
+	}
+
+	t.Run("Flush@OK", func(t *testing.T) {
+		for i := 0; i < NumMessages; i++ {
+			_ = l.Write(Info, "message %d", i)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if e := l.Named("child").Flush(ctx); e != nil {
+			t.Fatalf("Flush() return error\n%s", e.Error())
+		}
+		if n := w.count(); n != NumMessages {
+			t.Errorf("not all messages are written (%d/%d)", n, NumMessages)
+		}
+	})
+
+	t.Run("Flush@timeout", func(t *testing.T) {
+		r2.Intrf().ChCtl <- SignalStop() // recorder will not respond
+		time.Sleep(time.Millisecond * 10)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		e := l.Flush(ctx)
+		if e == nil {
+			t.Fatal("Flush()" + emsgErrExpected)
+		}
+		br, ok := e.(BatchResult)
+		if !ok {
+			t.Fatalf(emsgUnexpectedErrType, e)
+		}
+		if err := br.GetErrors()[rec2ID]; err != context.DeadlineExceeded {
+			t.Errorf("wrong error for the stopped recorder (%v)", err)
+		}
+		if _, failed := br.GetErrors()[rec1ID]; failed {
+			t.Errorf("active recorder is reported as failed")
+		}
+	})
+
+	t.Run("Shutdown@OK", func(t *testing.T) {
+		if e := l.UnregisterRecorder(rec2ID); e != nil {
+			t.Fatalf("UnregisterRecorder() return error\n%s", e.Error())
+		}
+		var closed bool_s
+		r1.OnClose(func(interface{}) { closed.Set(true) })
+		for i := 0; i < NumMessages; i++ {
+			_ = l.Write(Info, "message %d", i)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if e := l.Shutdown(ctx); e != nil {
+			t.Fatalf("Shutdown() return error\n%s", e.Error())
+		}
+		if n := w.count(); n != NumMessages*2 {
+			t.Errorf("not all messages are written (%d/%d)", n, NumMessages*2)
+		}
+		if !closed.Get() {
+			t.Errorf("recorder hasn't been closed")
+		}
+	})
+}
+
+// logHelper is a wrapper which should be skipped in the caller info.
+func logHelper(l *Logger, msgFmt string, msgArgs ...interface{}) error {
+	return l.WithCallerSkip(1).Write(Info|Caller, msgFmt, msgArgs...)
+}
+
+func TestLoggerCaller(t *testing.T) {
+	const SleepDelay = time.Millisecond * 50
+
+	w := &bufWriter{}
+	l := NewLogger()
+	r := SpawnIoDirectRecorder(w).FormatFunc(func(msg *LogMsg) string {
+		c := msg.GetCaller()
+		return fmt.Sprintf("%s|%s|%s", c.String(), c.Func, msg.GetContent())
+	})
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	wd := &bufWriter{}
+	rd := SpawnIoDirectRecorder(wd) // default formatter
+	defer func() { rd.Intrf().ChCtl <- SignalStop() }()
+	if e := l.RegisterRecorder("rec", r.Intrf()); e != nil {
+		t.Fatalf("RegisterRecorder() return error\n%s", e.Error())
+	}
+	if e := l.RegisterRecorder("def", rd.Intrf()); e != nil {
+		t.Fatalf("RegisterRecorder() return error\n%s", e.Error())
+	}
+	if e := l.Initialise(); e != nil {
+		t.Fatalf("Initialise() return error\n%s", e.Error())
+	}
+	defer l.Close()
+
+	_, _, line, _ := runtime.Caller(0)
+	_ = l.Write(Info|Caller, "write")                                   // line+1
+	_ = l.Named("child").WriteMsg(nil, Message("msg").SetFlags(Caller)) // line+2
+	_ = logHelper(l, "helper")                                          // line+3
+	_ = l.Write(Info, "disabled")
+	time.Sleep(SleepDelay)
+
+	fn := "github.com/VisborN/xlog.TestLoggerCaller"
+	outp := w.String()
+	expected := []string{
+		fmt.Sprintf("logger_test.go:%d|%s|write\n", line+1, fn),
+		fmt.Sprintf("logger_test.go:%d|%s|msg\n", line+2, fn),
+		fmt.Sprintf("logger_test.go:%d|%s|helper\n", line+3, fn),
+		"||disabled\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(outp, e) {
+			t.Errorf("wrong caller info, expected: %s\noutput:\n%s", e, outp)
+		}
+	}
+
+	// the level is rendered without attribute flags
+	if e := fmt.Sprintf(" INFO logger_test.go:%d: write\n", line+1); !strings.Contains(wd.String(), e) {
+		t.Errorf("wrong default format, expected: %s\noutput:\n%s", e, wd.String())
+	}
+}
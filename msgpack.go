@@ -0,0 +1,351 @@
+package xlog
+
+// Minimal MessagePack encoder and decoder for the Fluent forward protocol.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+var errMsgpackFormat = errors.New("msgpack: wrong format")
+
+// msgpackExt is the extension type value (e.g. Fluent EventTime).
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+func appendMsgpackNil(b []byte) []byte { return append(b, 0xc0) }
+
+func appendMsgpackBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 0xc3)
+	}
+	return append(b, 0xc2)
+}
+
+func appendMsgpackInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return appendMsgpackUint(b, uint64(v))
+	case v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt8:
+		return append(b, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return append(b, 0xd1, byte(v>>8), byte(v))
+	case v >= math.MinInt32:
+		return append(append(b, 0xd2), be32(uint32(v))...)
+	default:
+		return append(append(b, 0xd3), be64(uint64(v))...)
+	}
+}
+
+func appendMsgpackUint(b []byte, v uint64) []byte {
+	switch {
+	case v <= 0x7f:
+		return append(b, byte(v))
+	case v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return append(b, 0xcd, byte(v>>8), byte(v))
+	case v <= math.MaxUint32:
+		return append(append(b, 0xce), be32(uint32(v))...)
+	default:
+		return append(append(b, 0xcf), be64(v)...)
+	}
+}
+
+func appendMsgpackFloat(b []byte, v float64) []byte {
+	return append(append(b, 0xcb), be64(math.Float64bits(v))...)
+}
+
+func appendMsgpackStr(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xda, byte(n>>8), byte(n))
+	default:
+		b = append(append(b, 0xdb), be32(uint32(n))...)
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackBin(b []byte, data []byte) []byte {
+	n := len(data)
+	switch {
+	case n <= math.MaxUint8:
+		b = append(b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, 0xc5, byte(n>>8), byte(n))
+	default:
+		b = append(append(b, 0xc6), be32(uint32(n))...)
+	}
+	return append(b, data...)
+}
+
+func appendMsgpackArrayHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, 0xdc, byte(n>>8), byte(n))
+	default:
+		return append(append(b, 0xdd), be32(uint32(n))...)
+	}
+}
+
+func appendMsgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n <= 15:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return append(b, 0xde, byte(n>>8), byte(n))
+	default:
+		return append(append(b, 0xdf), be32(uint32(n))...)
+	}
+}
+
+// appendMsgpackEventTime writes Fluent EventTime: ext type 0 with seconds
+// and nanoseconds as 32-bit big-endian integers.
+func appendMsgpackEventTime(b []byte, t time.Time) []byte {
+	b = append(b, 0xd7, 0x00)
+	b = append(b, be32(uint32(t.Unix()))...)
+	return append(b, be32(uint32(t.Nanosecond()))...)
+}
+
+// appendMsgpackValue writes the value of common types, maps with string
+// keys and slices. Other values are written as strings in the %v form.
+func appendMsgpackValue(b []byte, v interface{}) []byte {
+	switch x := v.(type) {
+	case nil:
+		return appendMsgpackNil(b)
+	case string:
+		return appendMsgpackStr(b, x)
+	case bool:
+		return appendMsgpackBool(b, x)
+	case int:
+		return appendMsgpackInt(b, int64(x))
+	case int64:
+		return appendMsgpackInt(b, x)
+	case uint64:
+		return appendMsgpackUint(b, x)
+	case float64:
+		return appendMsgpackFloat(b, x)
+	case float32:
+		return appendMsgpackFloat(b, float64(x))
+	case []byte:
+		return appendMsgpackBin(b, x)
+	case time.Time:
+		return appendMsgpackStr(b, x.Format(time.RFC3339Nano))
+	case error:
+		return appendMsgpackStr(b, x.Error())
+	case fmt.Stringer:
+		return appendMsgpackStr(b, x.String())
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return appendMsgpackInt(b, rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return appendMsgpackUint(b, rv.Uint())
+	case reflect.Slice, reflect.Array:
+		b = appendMsgpackArrayHeader(b, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			b = appendMsgpackValue(b, rv.Index(i).Interface())
+		}
+		return b
+	case reflect.Map:
+		if rv.Type().Key().Kind() == reflect.String {
+			b = appendMsgpackMapHeader(b, rv.Len())
+			for _, key := range sortedKeys(rv) {
+				b = appendMsgpackStr(b, key)
+				item := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+				b = appendMsgpackValue(b, item.Interface())
+			}
+			return b
+		}
+	}
+	return appendMsgpackStr(b, fmt.Sprintf("%v", v))
+}
+
+func be32(v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+func be64(v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return b[:]
+}
+
+// ----------------------------------------
+
+// decodeMsgpack reads a single value. Maps are decoded to
+// map[string]interface{} (keys in the %v form), arrays to []interface{},
+// integers to int64 or uint64, binary data to []byte.
+func decodeMsgpack(r *bufio.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return decodeMsgpackMap(r, int(c&0x0f))
+	case c&0xf0 == 0x90:
+		return decodeMsgpackArray(r, int(c&0x0f))
+	case c&0xe0 == 0xa0:
+		data, err := readN(r, int(c&0x1f))
+		return string(data), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin
+		n, err := readLength(r, 1<<(c-0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return readN(r, n)
+	case 0xca:
+		data, err := readN(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+	case 0xcb:
+		data, err := readN(r, 8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint
+		data, err := readN(r, 1<<(c-0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		for _, b := range data {
+			v = v<<8 | uint64(b)
+		}
+		return v, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int
+		size := 1 << (c - 0xd0)
+		data, err := readN(r, size)
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		for _, b := range data {
+			v = v<<8 | uint64(b)
+		}
+		shift := uint(64 - size*8)
+		return int64(v<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext
+		return decodeMsgpackExt(r, 1<<(c-0xd4))
+	case 0xc7, 0xc8, 0xc9: // ext
+		n, err := readLength(r, 1<<(c-0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackExt(r, n)
+	case 0xd9, 0xda, 0xdb: // str
+		n, err := readLength(r, 1<<(c-0xd9))
+		if err != nil {
+			return nil, err
+		}
+		data, err := readN(r, n)
+		return string(data), err
+	case 0xdc, 0xdd:
+		n, err := readLength(r, 2<<(c-0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackArray(r, n)
+	case 0xde, 0xdf:
+		n, err := readLength(r, 2<<(c-0xde))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackMap(r, n)
+	}
+	return nil, errMsgpackFormat
+}
+
+func decodeMsgpackArray(r *bufio.Reader, n int) ([]interface{}, error) {
+	arr := make([]interface{}, n)
+	for i := range arr {
+		v, err := decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+	return arr, nil
+}
+
+func decodeMsgpackMap(r *bufio.Reader, n int) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		key, err := decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		m[fmt.Sprintf("%v", key)] = v
+	}
+	return m, nil
+}
+
+func decodeMsgpackExt(r *bufio.Reader, n int) (msgpackExt, error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return msgpackExt{}, err
+	}
+	data, err := readN(r, n)
+	return msgpackExt{int8(t), data}, err
+}
+
+// readLength reads the big-endian length of the given size (1, 2 or 4).
+func readLength(r *bufio.Reader, size int) (int, error) {
+	data, err := readN(r, size)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, b := range data {
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
+
+func readN(r *bufio.Reader, n int) ([]byte, error) {
+	data := make([]byte, n)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
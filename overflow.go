@@ -0,0 +1,314 @@
+package xlog
+
+import (
+	"container/list"
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowMode determines how the logger handles a message when the
+// recorder's queue is full.
+type OverflowMode uint8
+
+const (
+	OverflowBlock        OverflowMode = iota // wait until the queue has free space (default)
+	OverflowBlockTimeout                     // wait, but not longer than the policy timeout
+	OverflowDropNewest                       // drop the message which is being written
+	OverflowDropOldest                       // drop the oldest queued message
+	OverflowDropBelow                        // drop messages less important than the policy severity
+)
+
+// default size of the logger's queue for non-blocking policies
+const defaultOverflowQueueSize = 64
+
+// default interval between synthetic "N messages dropped" messages
+const defaultOverflowReportInterval = time.Second * 10
+
+// OverflowPolicy describes the recorder's backpressure policy. It's set at
+// the recorder registration (see Logger.RegisterRecorderWithPolicy).
+//
+// For the non-blocking modes the logger keeps its own queue for the recorder
+// and a goroutine which passes messages from it to the recorder. So a slow
+// recorder does not stall the callers. Also, this goroutine periodically
+// sends a synthetic Warning message with the number of dropped messages,
+// unless the recorder's severity mask (of the root logger) excludes Warning.
+// The goroutine is stopped by Logger.Close after the queue is drained.
+type OverflowPolicy struct {
+	Mode OverflowMode
+
+	// OverflowBlockTimeout: how long to wait for free space.
+	Timeout time.Duration
+
+	// OverflowDropBelow: messages with severities placed after this one
+	// in the recorder's severity order are dropped, others are blocking.
+	Severity MsgFlagT
+
+	// Size of the logger's queue (64 by default).
+	QueueSize int
+
+	// How often to report dropped messages (10s by default).
+	// A negative value disables the reports.
+	ReportInterval time.Duration
+}
+
+func (p OverflowPolicy) valid() bool {
+	switch p.Mode {
+	case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+		return true
+	case OverflowBlockTimeout:
+		return p.Timeout > 0
+	case OverflowDropBelow:
+		sev := p.Severity &^ SeverityShadowMask
+		return sev != 0 && sev&(sev-1) == 0 // exactly one severity flag
+	default:
+		return false
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// recorderPump is the logger's queue for the recorder with a non-blocking
+// overflow policy. It passes messages to the recorder in a separate goroutine
+// which runs while the recorder is initialised.
+type recorderPump struct {
+	dropped    uint64 // total number of dropped messages (atomic)
+	unreported uint64 // dropped since the last report (atomic)
+	mask       uint32 // recorder's severity mask for the reports (atomic)
+
+	policy  OverflowPolicy
+	queue   chan pumpItem
+	target  chan<- LogMsg
+	done    chan struct{} // closed when the pump is stopped
+	stopped chan struct{} // closed when run returns
+	running bool          // guarded by the logger's lock
+}
+
+// pumpItem is the queued message or the barrier of the wait call.
+type pumpItem struct {
+	msg     LogMsg
+	barrier chan struct{} // closed when the item is reached
+}
+
+func newRecorderPump(target chan<- LogMsg, policy OverflowPolicy) *recorderPump {
+	if policy.QueueSize <= 0 {
+		policy.QueueSize = defaultOverflowQueueSize
+	}
+	if policy.ReportInterval == 0 {
+		policy.ReportInterval = defaultOverflowReportInterval
+	}
+	p := new(recorderPump)
+	p.mask = uint32(SeverityAll)
+	p.policy = policy
+	p.queue = make(chan pumpItem, policy.QueueSize)
+	p.target = target
+	p.done = make(chan struct{})
+	p.stopped = make(chan struct{})
+	return p
+}
+
+// renew returns a new (not started) pump with the same settings and
+// counters, it replaces the stopped one.
+func (p *recorderPump) renew() *recorderPump {
+	np := newRecorderPump(p.target, p.policy)
+	np.dropped = atomic.LoadUint64(&p.dropped)
+	np.unreported = atomic.LoadUint64(&p.unreported)
+	np.mask = atomic.LoadUint32(&p.mask)
+	return np
+}
+
+// start runs the pump, it's called once.
+func (p *recorderPump) start() {
+	p.running = true
+	go p.run()
+}
+
+// run passes messages to the recorder until the pump is stopped.
+//
+// It also sends the synthetic "N messages dropped" Warning to the recorder.
+// The report is written by the root logger (so it has no logger name and
+// bound fields) and it's skipped if the recorder's mask of the root logger
+// does not allow Warning, the number is available via DroppedMessages then.
+func (p *recorderPump) run() {
+	defer close(p.stopped)
+
+	var tick <-chan time.Time
+	if p.policy.ReportInterval > 0 {
+		ticker := time.NewTicker(p.policy.ReportInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case item := <-p.queue:
+			if item.barrier != nil {
+				close(item.barrier)
+				continue
+			}
+			select {
+			case p.target <- item.msg:
+			case <-p.done:
+				p.drop(1)
+				return
+			}
+		case <-tick:
+			n := atomic.SwapUint64(&p.unreported, 0)
+			if n == 0 || MsgFlagT(atomic.LoadUint32(&p.mask))&Warning == 0 {
+				continue
+			}
+			msg := NewLogMsg().SetFlags(Warning).Setf("xlog: %d messages dropped", n)
+			msg.Uint("dropped", n)
+			select {
+			case p.target <- *msg:
+			case <-p.done:
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// stop stops the pump and releases blocked writers, it's called once.
+// Messages which are left in the queue are counted as dropped.
+func (p *recorderPump) stop() {
+	close(p.done)
+	if p.running {
+		<-p.stopped
+	}
+	for {
+		select {
+		case item := <-p.queue:
+			if item.barrier != nil {
+				close(item.barrier)
+			} else {
+				p.drop(1)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// setMask updates the severity mask which is checked for the reports.
+func (p *recorderPump) setMask(mask MsgFlagT) {
+	atomic.StoreUint32(&p.mask, uint32(mask))
+}
+
+// push puts the message into the queue accordingly to the policy without
+// blocking. The 'minor' argument says whether the message is less important
+// than the policy severity. Returns the number of dropped messages; 'ok' is
+// false if the policy says to wait for free space, then the caller should
+// call pushWait (after releasing the logger's lock).
+func (p *recorderPump) push(msg LogMsg, minor bool) (n uint64, ok bool) {
+	select {
+	case p.queue <- pumpItem{msg: msg}:
+		return 0, true
+	default: // queue is full
+	}
+
+	switch p.policy.Mode {
+	case OverflowBlock, OverflowBlockTimeout:
+		return 0, false
+	case OverflowDropOldest:
+		for {
+			select {
+			case p.queue <- pumpItem{msg: msg}:
+				p.drop(n)
+				return n, true
+			default:
+			}
+			select {
+			case item := <-p.queue:
+				if item.barrier != nil {
+					// messages before the barrier are dropped too
+					close(item.barrier)
+				} else {
+					n++
+				}
+			default:
+			}
+		}
+	case OverflowDropBelow:
+		if !minor {
+			return 0, false
+		}
+	}
+
+	// OverflowDropNewest and the rest
+	p.drop(1)
+	return 1, true
+}
+
+// pushWait waits for free space in the queue (not longer than the policy
+// timeout for OverflowBlockTimeout). Returns the number of dropped messages.
+func (p *recorderPump) pushWait(msg LogMsg) uint64 {
+	var timeout <-chan time.Time
+	if p.policy.Mode == OverflowBlockTimeout {
+		timer := time.NewTimer(p.policy.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.queue <- pumpItem{msg: msg}:
+		return 0
+	case <-timeout:
+	case <-p.done:
+	}
+	p.drop(1)
+	return 1
+}
+
+// blockedPush is the message which waits for free space in the queue.
+type blockedPush struct {
+	id   RecorderID
+	pump *recorderPump
+	msg  LogMsg
+}
+
+func (p *recorderPump) drop(n uint64) {
+	if n > 0 {
+		atomic.AddUint64(&p.dropped, n)
+		atomic.AddUint64(&p.unreported, n)
+	}
+}
+
+// wait puts a barrier into the queue and waits until the pump reaches it,
+// so messages queued before the call are passed to the recorder (or
+// dropped by the policy). Messages queued after the call are not awaited.
+func (p *recorderPump) wait(ctx context.Context) error {
+	barrier := make(chan struct{})
+	select {
+	case p.queue <- pumpItem{barrier: barrier}:
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-barrier:
+	case <-p.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// severityBelow says whether the severity is placed after the threshold
+// severity in the order list (so it's less important).
+func severityBelow(orderlist *list.List, sev, threshold MsgFlagT) bool {
+	sev = sev &^ SeverityShadowMask
+	threshold = threshold &^ SeverityShadowMask
+	for e := orderlist.Front(); e != nil; e = e.Next() {
+		if flag, ok := e.Value.(MsgFlagT); ok {
+			if flag == threshold {
+				return flag != sev
+			}
+			if flag == sev {
+				return false
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package xlog
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// gateWriter blocks all writes until the gate is opened.
+type gateWriter struct {
+	bufWriter
+	gate chan struct{}
+}
+
+func newGateWriter() *gateWriter {
+	return &gateWriter{gate: make(chan struct{})}
+}
+
+func (w *gateWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	return w.bufWriter.Write(p)
+}
+
+func (w *gateWriter) open() { close(w.gate) }
+
+func TestOverflowPolicy(t *testing.T) {
+	const NumMessages = 100
+
+	cases := []struct {
+		name   string
+		policy OverflowPolicy
+	}{
+		{"DropNewest", OverflowPolicy{Mode: OverflowDropNewest, QueueSize: 2}},
+		{"DropOldest", OverflowPolicy{Mode: OverflowDropOldest, QueueSize: 2}},
+		{"BlockTimeout", OverflowPolicy{Mode: OverflowBlockTimeout, Timeout: time.Millisecond, QueueSize: 2}},
+		{"DropBelow", OverflowPolicy{Mode: OverflowDropBelow, Severity: Warning, QueueSize: 2}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.policy.ReportInterval = time.Millisecond * 20
+			w := newGateWriter()
+			l := NewLogger()
+			r := SpawnIoDirectRecorder(w)
+			defer func() { r.Intrf().ChCtl <- SignalStop() }()
+			if e := l.RegisterRecorderWithPolicy("rec", r.Intrf(), tc.policy); e != nil {
+				t.Fatalf("RegisterRecorderWithPolicy() return error\n%s", e.Error())
+			}
+			if e := l.Initialise(); e != nil {
+				t.Fatalf("Initialise() return error\n%s", e.Error())
+			}
+			defer l.Close()
+
+			var dropped uint64
+			done := make(chan struct{})
+			go func() { // shouldn't be blocked by the recorder
+				defer close(done)
+				for i := 0; i < NumMessages; i++ {
+					if e := l.Write(Debug, "message %d", i); e != nil {
+						br, ok := e.(BatchResult)
+						if !ok || br.GetErrors()["rec"] != ErrQueueOverflow {
+							t.Errorf(emsgUnexpectedError, e)
+							return
+						}
+						dropped += br.GetDropped()["rec"]
+					}
+				}
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second * 5):
+				t.Fatalf("writer has been blocked")
+			}
+
+			if n, _ := l.DroppedMessages("rec"); n == 0 || n != dropped {
+				t.Errorf("wrong number of dropped messages (%d/%d)", n, dropped)
+			}
+
+			w.open()
+			time.Sleep(tc.policy.ReportInterval * 3)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			if e := l.Flush(ctx); e != nil {
+				t.Fatalf("Flush() return error\n%s", e.Error())
+			}
+			outp := w.String()
+			if !strings.Contains(outp, "messages dropped") {
+				t.Errorf("dropped messages are not reported")
+			}
+			written := uint64(strings.Count(outp, "message "))
+			if written+dropped != NumMessages {
+				t.Errorf("messages are lost (written %d, dropped %d)", written, dropped)
+			}
+			if tc.policy.Mode == OverflowDropOldest &&
+				!strings.Contains(outp, "message 99\n") {
+				t.Errorf("the newest message has been dropped")
+			}
+		})
+	}
+
+	t.Run("WrongPolicy", func(t *testing.T) {
+		l := NewLogger()
+		r := NewIoDirectRecorder(NewVoidWriter())
+		wrong := []OverflowPolicy{
+			{Mode: OverflowBlockTimeout},
+			{Mode: OverflowDropBelow, Severity: Warning | Error},
+			{Mode: OverflowMode(100)},
+		}
+		for _, p := range wrong {
+			if e := l.RegisterRecorderWithPolicy("rec", r.Intrf(), p); e != ErrWrongParameter {
+				t.Errorf(emsgUnexpectedError, e)
+			}
+		}
+	})
+}
+
+func TestOverflowUnregister(t *testing.T) {
+	w := newGateWriter()
+	defer w.open()
+	l := NewLogger()
+	r := SpawnIoDirectRecorder(w)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	policy := OverflowPolicy{Mode: OverflowDropBelow, Severity: Warning, QueueSize: 2}
+	if e := l.RegisterRecorderWithPolicy("rec", r.Intrf(), policy); e != nil {
+		t.Fatalf("RegisterRecorderWithPolicy() return error\n%s", e.Error())
+	}
+	if e := l.Initialise(); e != nil {
+		t.Fatalf("Initialise() return error\n%s", e.Error())
+	}
+
+	done := make(chan struct{})
+	go func() { // important messages wait for free space
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			_ = l.Write(Error, "message %d", i)
+		}
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	unregistered := make(chan error, 1)
+	go func() { unregistered <- l.UnregisterRecorder("rec") }()
+	select {
+	case e := <-unregistered:
+		if e != nil {
+			t.Fatalf("UnregisterRecorder() return error\n%s", e.Error())
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("blocked writer holds the logger")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("writer is not released")
+	}
+}
+
+func TestOverflowClose(t *testing.T) {
+	w := new(bufWriter)
+	l := NewLogger()
+	r := SpawnIoDirectRecorder(w)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	policy := OverflowPolicy{Mode: OverflowDropNewest, QueueSize: 16}
+	if e := l.RegisterRecorderWithPolicy("rec", r.Intrf(), policy); e != nil {
+		t.Fatalf("RegisterRecorderWithPolicy() return error\n%s", e.Error())
+	}
+
+	for cycle := 0; cycle < 2; cycle++ {
+		if e := l.Initialise(); e != nil {
+			t.Fatalf("Initialise() return error\n%s", e.Error())
+		}
+		pump := l.pumps["rec"]
+		for i := 0; i < 10; i++ {
+			if e := l.Write(Info, "message %d", i); e != nil {
+				t.Fatalf(emsgUnexpectedError, e)
+			}
+		}
+		l.Close()
+
+		select {
+		case <-pump.stopped:
+		default:
+			t.Errorf("the pump is not stopped by Close")
+		}
+		if l.pumps["rec"] == pump {
+			t.Errorf("the stopped pump is not replaced")
+		}
+		// messages left in the stopped pump are counted as dropped
+		if n, _ := l.DroppedMessages("rec"); n != 0 {
+			t.Errorf("queued messages are not drained (%d dropped)", n)
+		}
+	}
+}
+
+func TestPumpWait(t *testing.T) {
+	target := make(chan LogMsg)
+	p := newRecorderPump(target, OverflowPolicy{Mode: OverflowDropNewest, QueueSize: 16})
+	p.start()
+	defer p.stop()
+
+	for i := 0; i < 10; i++ {
+		if n, _ := p.push(*NewLogMsg().Setf("message %d", i), false); n != 0 {
+			t.Fatalf("message is dropped")
+		}
+	}
+	var received int32
+	go func() { // slow recorder
+		for range target {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&received, 1)
+		}
+	}()
+	defer close(target)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if e := p.wait(ctx); e != nil {
+		t.Fatalf("wait() return error\n%s", e.Error())
+	}
+	// the last message is passed, but may be not counted yet
+	if n := atomic.LoadInt32(&received); n < 9 {
+		t.Errorf("wait() returned before the queue is passed (%d received)", n)
+	}
+}
+
+func TestOverflowReportMask(t *testing.T) {
+	w := newGateWriter()
+	l := NewLogger()
+	r := SpawnIoDirectRecorder(w)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	policy := OverflowPolicy{
+		Mode:           OverflowDropNewest,
+		QueueSize:      2,
+		ReportInterval: time.Millisecond * 20,
+	}
+	if e := l.RegisterRecorderWithPolicy("rec", r.Intrf(), policy); e != nil {
+		t.Fatalf("RegisterRecorderWithPolicy() return error\n%s", e.Error())
+	}
+	if e := l.SetSeverityMask("rec", Error); e != nil {
+		t.Fatalf("SetSeverityMask() return error\n%s", e.Error())
+	}
+	if e := l.Initialise(); e != nil {
+		t.Fatalf("Initialise() return error\n%s", e.Error())
+	}
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		_ = l.Write(Error, "message %d", i)
+	}
+	if n, _ := l.DroppedMessages("rec"); n == 0 {
+		t.Fatalf("messages are not dropped")
+	}
+	w.open()
+	time.Sleep(policy.ReportInterval * 3)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if e := l.Flush(ctx); e != nil {
+		t.Fatalf("Flush() return error\n%s", e.Error())
+	}
+	if strings.Contains(w.String(), "messages dropped") {
+		t.Errorf("the report ignores the severity mask")
+	}
+}
+
+func TestSeverityBelow(t *testing.T) {
+	order := defaultSeverityOrder()
+	if !severityBelow(order, Debug, Warning) {
+		t.Errorf("Debug should be below Warning")
+	}
+	if severityBelow(order, Error|StackTrace, Warning) {
+		t.Errorf("Error shouldn't be below Warning")
+	}
+	if severityBelow(order, Warning, Warning) {
+		t.Errorf("Warning shouldn't be below itself")
+	}
+}
@@ -116,6 +116,11 @@ func (R *ioDirectRecorder) Listen() {
 				R.RLock()
 				R.close()
 				R.RUnlock()
+			case SigFlush, SigReopen: // nothing to reopen
+				R._log("RECV %s SIGNAL", sig.stype)
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				respErrChan <- nil
 			case SigStop:
 				R._log("RECV STOP SIGNAL")
 				R.isListening.Set(false)
@@ -145,17 +150,29 @@ func (R *ioDirectRecorder) Listen() {
 
 		case msg := <-R.chMsg: // write log message
 			R._log("RECV MSG SIGNAL <--\n  msg=%v", msg)
-			err := R.write(msg)
-			if err != nil {
-				R._log("write error: %s", err.Error())
-				if R.chErr != nil {
-					R.chErr <- err // MAY PANIC
-				}
-			}
+			R.handle(msg)
+		}
+	}
+}
+
+// handle writes the message and reports an error if it occurs.
+func (R *ioDirectRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		if R.chErr != nil {
+			R.chErr <- err // MAY PANIC
 		}
 	}
 }
 
+// drain writes all messages which have been queued before the call.
+func (R *ioDirectRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
 func (R *ioDirectRecorder) IsListening() bool {
 	return R.isListening.Get() // rc safe
 }
@@ -213,10 +230,21 @@ func (R *ioDirectRecorder) _log(format string, args ...interface{}) { // MAY PAN
 
 // -----------------------------------------------------------------------------
 
-func IoDirectDefaultFormatter(msg *LogMsg) string { // TODO: more flags; file & line
+func IoDirectDefaultFormatter(msg *LogMsg) string {
 	// short date/time format
 	h, m, s := msg.GetTime().Clock()
 	yy, mm, dd := msg.GetTime().Date()
-	return fmt.Sprintf("%4d/%02d/%02d %02d:%02d:%02d %s %s",
-		yy, mm, dd, h, m, s, msg.GetFlags().String(), msg.GetContent())
+	str := fmt.Sprintf("%4d/%02d/%02d %02d:%02d:%02d %s ",
+		yy, mm, dd, h, m, s, (msg.GetFlags() &^ SeverityShadowMask).String())
+	if name := msg.GetLoggerName(); name != "" {
+		str += "[" + name + "] "
+	}
+	if caller := msg.GetCaller(); caller.IsSet() {
+		str += caller.String() + ": "
+	}
+	str += msg.text()
+	if fields := msg.GetFields(); len(fields) > 0 {
+		str += " " + FormatFields(fields)
+	}
+	return withStackTrace(str, msg)
 }
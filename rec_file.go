@@ -0,0 +1,585 @@
+package xlog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+var _ LogRecorder = &fileRecorder{}
+
+// BackupSuffix determines how rotated files are named.
+type BackupSuffix uint8
+
+const (
+	SuffixNumbered  BackupSuffix = iota // app.log.1, app.log.2, ... (1 is the newest)
+	SuffixTimestamp                     // app.log.20060102-150405.000 (-1, -2, ... within the same ms)
+)
+
+// layout of the timestamp suffix, it keeps the lexical order of backups
+const backupTimeLayout = "20060102-150405.000"
+
+// RotationPeriod determines how often the file is rotated by time.
+type RotationPeriod uint8
+
+const (
+	RotateNever RotationPeriod = iota
+	RotateHourly
+	RotateDaily
+)
+
+// start returns the beginning of the period which contains the given time.
+func (p RotationPeriod) start(t time.Time) time.Time {
+	switch p {
+	case RotateHourly:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case RotateDaily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	default:
+		return time.Time{}
+	}
+}
+
+type fileRecorder struct {
+	chCtl chan controlSignal
+	chMsg chan LogMsg
+	chErr chan<- error        // optional
+	chDbg chan<- debugMessage // optional
+
+	id          xid.ID
+	isListening bool_s // internal mutex
+	refCounter  int
+	path        string // path or path template
+	current     string // path of the opened file
+	file        *os.File
+	size        int64     // current file size
+	period      time.Time // beginning of the current file's period
+
+	// background compression and retention (see rec_file_retention.go)
+	jobs        chan janitorJob
+	chJanitor   chan error
+	janitorDone chan struct{}
+	backupsMu   sync.Mutex // protects backups and the current path
+
+	sync.RWMutex
+	prefix     string
+	format     FormatFunc
+	perm       os.FileMode
+	maxSize    int64 // rotate when the file exceeds this size (0 - never)
+	maxBackups int   // number of rotated files to keep (0 - all)
+	suffix     BackupSuffix
+	every      RotationPeriod
+	compress   bool          // gzip rotated files
+	maxAge     time.Duration // remove rotated files older than this (0 - never)
+	maxTotal   int64         // total size of rotated files (0 - unlimited)
+}
+
+// NewFileRecorder allocates and returns a new file recorder. This recorder
+// owns the file: it opens the file on initialisation, closes it when the
+// last logger closes the recorder and rotates it by size or time if necessary.
+//
+// The path can be a template with time verbs (see expandPathTemplate), e.g.
+// "/var/log/app/%Y-%m-%d/errors.log". The template is evaluated against the
+// message time, so each message lands in the file of its own period. The
+// directories are created as needed.
+func NewFileRecorder(path string, prefix ...string) *fileRecorder {
+	r := new(fileRecorder)
+	r.id = xid.NewWithTime(time.Now())
+	r.chCtl = make(chan controlSignal, 32)
+	r.chMsg = make(chan LogMsg, 64)
+	r.format = IoDirectDefaultFormatter
+	r.path = path
+	r.perm = 0644
+	r.chJanitor = make(chan error, 16)
+	if len(prefix) > 0 {
+		r.prefix = prefix[0]
+	}
+	return r
+}
+
+// SpawnFileRecorder creates recorder and starts a listener.
+func SpawnFileRecorder(path string, prefix ...string) *fileRecorder {
+	r := NewFileRecorder(path, prefix...)
+	go r.Listen()
+	return r
+}
+
+// Intrf returns recorder's interface channels.
+func (R *fileRecorder) Intrf() RecorderInterface {
+	return RecorderInterface{R.chCtl, R.chMsg, R.id}
+}
+
+// GetID returns recorder's xid.
+func (R *fileRecorder) GetID() xid.ID {
+	return R.id
+}
+
+// FormatFunc sets custom formatter function for this recorder.
+func (R *fileRecorder) FormatFunc(f FormatFunc) *fileRecorder {
+	R.Lock()
+	R.format = f
+	R.Unlock()
+	return R
+}
+
+// FileMode sets permissions for the new log files (0644 by default).
+func (R *fileRecorder) FileMode(perm os.FileMode) *fileRecorder {
+	R.Lock()
+	R.perm = perm
+	R.Unlock()
+	return R
+}
+
+// RotateSize sets the file size (in bytes) which causes rotation.
+// Zero value disables size-based rotation.
+func (R *fileRecorder) RotateSize(size int64) *fileRecorder {
+	R.Lock()
+	R.maxSize = size
+	R.Unlock()
+	return R
+}
+
+// MaxBackups sets the number of rotated files to keep.
+// Zero value means that all rotated files are kept.
+func (R *fileRecorder) MaxBackups(n int) *fileRecorder {
+	R.Lock()
+	R.maxBackups = n
+	R.Unlock()
+	return R
+}
+
+// BackupSuffix sets how rotated files are named (SuffixNumbered by default).
+func (R *fileRecorder) BackupSuffix(suffix BackupSuffix) *fileRecorder {
+	R.Lock()
+	R.suffix = suffix
+	R.Unlock()
+	return R
+}
+
+// Compress enables gzip compression of rotated files. Files are compressed
+// in the background, errors are reported to the recorder's error channel.
+func (R *fileRecorder) Compress(enable bool) *fileRecorder {
+	R.Lock()
+	R.compress = enable
+	R.Unlock()
+	return R
+}
+
+// MaxAge sets how long rotated files are kept. Zero value disables the limit.
+func (R *fileRecorder) MaxAge(age time.Duration) *fileRecorder {
+	R.Lock()
+	R.maxAge = age
+	R.Unlock()
+	return R
+}
+
+// MaxTotalSize sets the limit for the total size of rotated files (in bytes),
+// the oldest files are removed first. Zero value disables the limit.
+func (R *fileRecorder) MaxTotalSize(size int64) *fileRecorder {
+	R.Lock()
+	R.maxTotal = size
+	R.Unlock()
+	return R
+}
+
+// RotateEvery sets periodic rotation for the file. When the message time
+// passes to the next period, the current file is renamed to the backup name.
+func (R *fileRecorder) RotateEvery(period RotationPeriod) *fileRecorder {
+	R.Lock()
+	R.every = period
+	R.Unlock()
+	return R
+}
+
+// ChangePrefixOnFly changes log prefix for this recorder. [mutex r/w locks]
+func (R *fileRecorder) ChangePrefixOnFly(prefix string) {
+	R.Lock()
+	defer R.Unlock()
+	R.prefix = prefix
+}
+
+// -----------------------------------------------------------------------------
+
+func (R *fileRecorder) Listen() {
+	if R.isListening.Get() {
+		return
+	} else {
+		R.isListening.Set(true)
+		R._log("start listener...")
+	}
+
+	for {
+		select {
+		case sig := <-R.chCtl: // recv control signal
+			switch sig.stype {
+			case SigInit:
+				R._log("RECV INIT SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R._log("  chan: %v", respErrChan)
+				e := R.initialise()
+				R._log("  send response..")
+				respErrChan <- e
+				R._log("  done")
+			case SigClose:
+				R._log("RECV CLOSE SIGNAL")
+				R.close()
+			case SigFlush:
+				R._log("RECV FLUSH SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				R.waitJanitor()
+				respErrChan <- nil
+			case SigReopen:
+				R._log("RECV REOPEN SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				// queued messages go to the old file
+				R.drain()
+				respErrChan <- R.reopen()
+			case SigStop:
+				R._log("RECV STOP SIGNAL")
+				R.isListening.Set(false)
+				R._log("stop listener...")
+				return
+
+			case SigSetErrChan:
+				R._log("RECV SET_ERR_CHAN SIGNAL")
+				R.chErr = sig.data.(chan<- error) // MAY PANIC
+			case SigSetDbgChan:
+				R._log("RECV SET_DBG_CHAN SIGNAL")
+				R.chDbg = sig.data.(chan<- debugMessage) // MAY PANIC
+			case SigDropErrChan:
+				R._log("RECV DROP_ERR_CHAN SIGNAL")
+				R.chErr = nil
+			case SigDropDbgChan:
+				R._log("RECV DROP_DBG_CHAN SIGNAL")
+				R.chDbg = nil
+
+			default:
+				R._log("ERROR: received unknown signal (%s)", sig.stype)
+				// DO NOTHING
+			}
+
+		case msg := <-R.chMsg: // write log message
+			R._log("RECV MSG SIGNAL <--\n  msg=%v", msg)
+			R.handle(msg)
+
+		case err := <-R.chJanitor: // compression or retention error
+			R._log("janitor error: %s", err.Error())
+			R.reportError(err)
+		}
+	}
+}
+
+// handle writes the message and reports an error if it occurs.
+func (R *fileRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		R.reportError(err)
+	}
+}
+
+func (R *fileRecorder) reportError(err error) {
+	if R.chErr != nil {
+		R.chErr <- err // MAY PANIC
+	}
+}
+
+// drain writes all messages which have been queued before the call.
+func (R *fileRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
+func (R *fileRecorder) IsListening() bool {
+	return R.isListening.Get() // rc safe
+}
+
+// ----------------------------------------
+
+func (R *fileRecorder) initialise() error {
+	// file from the template is opened by the first message
+	if R.refCounter == 0 && !isPathTemplate(R.path) {
+		if err := R.open(R.path); err != nil {
+			return err
+		}
+	}
+	if R.refCounter == 0 {
+		R.startJanitor()
+	}
+	R.refCounter++
+	return nil
+}
+
+func (R *fileRecorder) close() {
+	if R.refCounter == 0 {
+		return
+	}
+	if R.refCounter == 1 {
+		if err := R.closeFile(); err != nil {
+			R.reportError(err)
+		}
+		R.stopJanitor()
+	}
+	R.refCounter--
+}
+
+// reopen opens the file by the same path (it may be moved by logrotate) and
+// closes the old one. Messages are written by the listener only, so there
+// are no writes in progress during the swap.
+func (R *fileRecorder) reopen() error {
+	if R.refCounter == 0 {
+		return ErrNotInitialised
+	}
+	if R.file == nil { // the template file is opened by the next message
+		return nil
+	}
+	if err := R.open(R.current); err != nil {
+		return fmt.Errorf("reopen fail: %s", err.Error())
+	}
+	return nil
+}
+
+// open opens (or creates) the log file in append mode. If some file is
+// opened already, it will be closed after the new one is opened.
+func (R *fileRecorder) open(path string) error {
+	R.RLock()
+	perm, every := R.perm, R.every
+	R.RUnlock()
+
+	// the janitor shouldn't take the new file for a backup
+	R.backupsMu.Lock()
+	defer R.backupsMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	var errClose error
+	if R.file != nil {
+		errClose = R.file.Close()
+	}
+	R.file = file
+	R.current = path
+	R.size = info.Size()
+	R.period = time.Time{}
+	if R.size > 0 {
+		// the file may be left from the previous period
+		R.period = every.start(info.ModTime())
+	}
+	return errClose
+}
+
+func (R *fileRecorder) closeFile() error {
+	if R.file == nil {
+		return nil
+	}
+	err := R.file.Close()
+	R.file = nil
+	R.size = 0
+	return err
+}
+
+// ----------------------------------------
+
+func (R *fileRecorder) write(msg LogMsg) error {
+	if R.refCounter == 0 {
+		return ErrNotInitialised
+	}
+	msgData := msg.content
+	R.RLock()
+	if R.format != nil {
+		msgData = R.format(&msg)
+	}
+	if R.prefix != "" {
+		msgData = fmt.Sprintf("%s %s", R.prefix, msgData)
+	}
+	maxSize, every := R.maxSize, R.every
+	R.RUnlock()
+	if len(msgData) == 0 || msgData[len(msgData)-1] != '\n' {
+		msgData += "\n"
+	}
+
+	// switch the file if the template gives another path for this message
+	if path := expandPathTemplate(R.path, msg.time); path != R.current || R.file == nil {
+		R._log("switch file %s -> %s", R.current, path)
+		previous := R.current
+		if err := R.open(path); err != nil {
+			if R.file == nil {
+				return fmt.Errorf("open fail: %s", err.Error())
+			}
+			// keep writing to the previous file if the new one can't be opened
+			R.reportError(fmt.Errorf("file switch fail: %s", err.Error()))
+		}
+		if previous != "" && previous != R.current {
+			R.schedule()
+		}
+	}
+
+	if period := every.start(msg.time); !R.period.IsZero() && period.After(R.period) {
+		if err := R.rotate(R.period); err != nil {
+			return fmt.Errorf("rotation fail: %s", err.Error())
+		}
+	} else if maxSize > 0 && R.size > 0 && R.size+int64(len(msgData)) > maxSize {
+		if err := R.rotate(time.Now()); err != nil {
+			return fmt.Errorf("rotation fail: %s", err.Error())
+		}
+	}
+	if R.period.IsZero() {
+		R.period = every.start(msg.time)
+	}
+
+	n, err := R.file.Write([]byte(msgData))
+	R.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("writer fail: %s", err.Error())
+	}
+	return nil
+}
+
+// rotate renames the current file to the backup name and opens a new one.
+// The stamp is used for the timestamp suffix.
+func (R *fileRecorder) rotate(stamp time.Time) error {
+	R._log("rotate file %s", R.current)
+	if err := R.closeFile(); err != nil {
+		return err
+	}
+
+	R.RLock()
+	suffix, maxBackups := R.suffix, R.maxBackups
+	R.RUnlock()
+
+	var err error
+	R.backupsMu.Lock()
+	switch suffix {
+	case SuffixTimestamp:
+		err = os.Rename(R.current, R.timestampName(stamp))
+	default: // SuffixNumbered
+		err = R.shiftNumbered(maxBackups)
+	}
+	R.backupsMu.Unlock()
+	if err != nil {
+		// the file should be opened anyway
+		if e := R.open(R.current); e != nil {
+			return e
+		}
+		return err
+	}
+
+	if err := R.open(R.current); err != nil {
+		return err
+	}
+	R.schedule()
+	return nil
+}
+
+// shiftNumbered renames path.N to path.N+1 (starting from the oldest one)
+// and the current file to path.1, the files which exceed limit are removed.
+// Compressed backups (path.N.gz) are shifted as well.
+func (R *fileRecorder) shiftNumbered(maxBackups int) error {
+	last := 0
+	for fileExists(R.backupName(last+1)) || fileExists(R.backupName(last+1)+gzipExt) {
+		last++
+	}
+	for i := last; i > 0; i-- {
+		for _, ext := range []string{"", gzipExt} {
+			name := R.backupName(i) + ext
+			if !fileExists(name) {
+				continue
+			}
+			var err error
+			if maxBackups > 0 && i >= maxBackups {
+				err = os.Remove(name)
+			} else {
+				err = os.Rename(name, R.backupName(i+1)+ext)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(R.current, R.backupName(1))
+}
+
+func (R *fileRecorder) backupName(n int) string {
+	return R.current + "." + strconv.Itoa(n)
+}
+
+// timestampName returns the backup name for the stamp. If the backup with
+// this stamp exists (rotations within a millisecond), a counter is added.
+func (R *fileRecorder) timestampName(stamp time.Time) string {
+	base := R.current + "." + stamp.Format(backupTimeLayout)
+	name := base
+	for n := 1; fileExists(name) || fileExists(name+gzipExt); n++ {
+		name = base + "-" + strconv.Itoa(n)
+	}
+	return name
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func (R *fileRecorder) _log(format string, args ...interface{}) { // MAY PANIC
+	if R.chDbg != nil {
+		msg := DbgMsg(R.id, format, args...)
+		msg.rtype = "fileRecorder"
+		R.chDbg <- msg
+	}
+}
+
+// isPathTemplate says whether the path contains time verbs.
+func isPathTemplate(path string) bool {
+	return expandPathTemplate(path, time.Time{}) != path
+}
+
+// expandPathTemplate replaces time verbs in the path template with values
+// of the given time: %Y - year, %m - month, %d - day, %H - hour, %M - minute,
+// %% - percent sign. Other verbs are left as is.
+func expandPathTemplate(tmpl string, t time.Time) string {
+	if strings.IndexByte(tmpl, '%') < 0 {
+		return tmpl
+	}
+	var sb strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' || i == len(tmpl)-1 {
+			sb.WriteByte(tmpl[i])
+			continue
+		}
+		i++
+		switch tmpl[i] {
+		case 'Y':
+			fmt.Fprintf(&sb, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&sb, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&sb, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&sb, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&sb, "%02d", t.Minute())
+		case '%':
+			sb.WriteByte('%')
+		default:
+			sb.WriteByte('%')
+			sb.WriteByte(tmpl[i])
+		}
+	}
+	return sb.String()
+}
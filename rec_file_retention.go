@@ -0,0 +1,331 @@
+package xlog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The file recorder's janitor compresses rotated files and removes old
+// ones in the background, so the recorder's listener is not blocked by
+// these operations. The janitor is started when the recorder opens the
+// file and stopped when the recorder is closed. It reports errors to the
+// listener, which passes them to the recorder's error channel.
+//
+// The janitor takes backupsMu only to list backups and to rename or remove
+// a file, the compression is done without the lock, so it doesn't block
+// rotation. Numbered backups may be shifted meanwhile, so each file is
+// checked (os.SameFile) before it's replaced or removed.
+
+const gzipExt = ".gz"
+
+type janitorJob struct {
+	barrier chan struct{} // closed when all previous jobs are done (flush)
+}
+
+type backupFile struct {
+	path string
+	mod  time.Time
+	size int64
+	info os.FileInfo // to detect the shifted file
+}
+
+func (R *fileRecorder) startJanitor() {
+	R.jobs = make(chan janitorJob, 64)
+	R.janitorDone = make(chan struct{})
+	go R.janitor(R.jobs, R.janitorDone)
+}
+
+// stopJanitor waits until the janitor finishes all scheduled jobs.
+func (R *fileRecorder) stopJanitor() {
+	if R.jobs == nil {
+		return
+	}
+	close(R.jobs)
+	R.jobs = nil
+	for {
+		select {
+		case err := <-R.chJanitor:
+			R.reportError(err)
+		case <-R.janitorDone:
+			for len(R.chJanitor) > 0 {
+				R.reportError(<-R.chJanitor)
+			}
+			return
+		}
+	}
+}
+
+// schedule asks the janitor to process rotated files. All uncompressed
+// backups are compressed (numbered backups may be shifted before the
+// janitor gets to them), then the retention limits are applied.
+func (R *fileRecorder) schedule() {
+	R.send(janitorJob{})
+}
+
+// waitJanitor waits until the janitor finishes all scheduled jobs, but
+// it keeps the janitor running (used by the flush barrier).
+func (R *fileRecorder) waitJanitor() {
+	barrier := make(chan struct{})
+	if !R.send(janitorJob{barrier: barrier}) {
+		return
+	}
+	for {
+		select {
+		case err := <-R.chJanitor:
+			R.reportError(err)
+		case <-barrier:
+			return
+		}
+	}
+}
+
+func (R *fileRecorder) send(job janitorJob) bool {
+	if R.jobs == nil {
+		return false
+	}
+	for {
+		select {
+		case R.jobs <- job:
+			return true
+		case err := <-R.chJanitor: // janitor may wait for it
+			R.reportError(err)
+		}
+	}
+}
+
+func (R *fileRecorder) janitor(jobs <-chan janitorJob, done chan<- struct{}) {
+	defer close(done)
+	for job := range jobs {
+		if job.barrier != nil {
+			close(job.barrier)
+			continue
+		}
+		R.RLock()
+		compress := R.compress
+		maxBackups, maxAge, maxTotal := R.maxBackups, R.maxAge, R.maxTotal
+		R.RUnlock()
+
+		// errors are sent without the lock, the listener may wait for it
+		var errs []error
+		R.backupsMu.Lock()
+		backups, err := R.listBackups(R.current)
+		R.backupsMu.Unlock()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("retention fail: %s", err.Error()))
+		}
+		if compress {
+			for i := range backups {
+				if strings.HasSuffix(backups[i].path, gzipExt) {
+					continue
+				}
+				if err := compressFile(&backups[i], &R.backupsMu); err != nil {
+					errs = append(errs, fmt.Errorf("compression fail: %s", err.Error()))
+				}
+			}
+		}
+		if maxBackups > 0 || maxAge > 0 || maxTotal > 0 {
+			if err := removeBackups(backups, maxBackups, maxAge, maxTotal, &R.backupsMu); err != nil {
+				errs = append(errs, fmt.Errorf("retention fail: %s", err.Error()))
+			}
+		}
+		for _, err := range errs {
+			R.chJanitor <- err
+		}
+	}
+}
+
+// compressFile replaces the backup with its gzip-compressed copy and
+// updates the backup's path and size. The copy is written without the
+// lock, the replacement is done under it. If the file has been shifted
+// meanwhile, the copy is discarded (the next job compresses the file under
+// its new name).
+func compressFile(b *backupFile, mu sync.Locker) error {
+	path := b.path
+	src, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) { // shifted or removed
+			return nil
+		}
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + gzipExt + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(path)
+	zw.ModTime = info.ModTime()
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// keep modification time for the age-based retention
+	if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if cur, err := os.Stat(path); err != nil || !os.SameFile(cur, info) {
+		os.Remove(tmp)
+		return nil
+	}
+	if err := os.Rename(tmp, path+gzipExt); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	b.path = path + gzipExt
+	if info, err := os.Stat(b.path); err == nil {
+		b.size, b.info = info.Size(), info
+	}
+	return nil
+}
+
+// removeBackups removes rotated files which exceed the limits (the
+// newest files are kept first). Each file is removed under the lock if
+// it hasn't been shifted.
+func removeBackups(
+	backups []backupFile, maxBackups int, maxAge time.Duration, maxTotal int64,
+	mu sync.Locker,
+) error {
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].mod.After(backups[j].mod)
+	})
+
+	now := time.Now()
+	var kept int
+	var total int64
+	for _, b := range backups {
+		if (maxBackups > 0 && kept >= maxBackups) ||
+			(maxAge > 0 && now.Sub(b.mod) > maxAge) ||
+			(maxTotal > 0 && total+b.size > maxTotal) {
+			if err := removeBackup(b, mu); err != nil {
+				return err
+			}
+			continue
+		}
+		kept++
+		total += b.size
+	}
+	return nil
+}
+
+func removeBackup(b backupFile, mu sync.Locker) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if cur, err := os.Stat(b.path); err != nil || !os.SameFile(cur, b.info) {
+		return nil // shifted or removed
+	}
+	return os.Remove(b.path)
+}
+
+// listBackups returns rotated files of the recorder. For the path template
+// it returns all files matching the template, except the current one.
+func (R *fileRecorder) listBackups(current string) ([]backupFile, error) {
+	var candidates []string
+	if isPathTemplate(R.path) {
+		pattern := templateGlob(R.path)
+		for _, p := range []string{pattern, pattern + ".*"} {
+			matches, err := filepath.Glob(p)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, matches...)
+		}
+	} else {
+		dir, base := filepath.Split(current)
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if strings.HasPrefix(name, base+".") && isBackupSuffix(name[len(base)+1:]) {
+				candidates = append(candidates, filepath.Join(dir, name))
+			}
+		}
+	}
+
+	var backups []backupFile
+	for _, path := range candidates {
+		if path == current || strings.HasSuffix(path, ".tmp") {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		backups = append(backups, backupFile{path, info.ModTime(), info.Size(), info})
+	}
+	return backups, nil
+}
+
+// isBackupSuffix checks whether the suffix is a number or a timestamp
+// (optionally with the counter and the compression extension).
+func isBackupSuffix(suffix string) bool {
+	suffix = strings.TrimSuffix(suffix, gzipExt)
+	if _, err := strconv.Atoi(suffix); err == nil {
+		return true
+	}
+	if i := strings.LastIndexByte(suffix, '-'); i > len(backupTimeLayout)-1 {
+		if _, err := strconv.Atoi(suffix[i+1:]); err != nil {
+			return false
+		}
+		suffix = suffix[:i]
+	}
+	_, err := time.Parse(backupTimeLayout, suffix)
+	return err == nil
+}
+
+// templateGlob replaces time verbs of the path template with wildcards.
+func templateGlob(tmpl string) string {
+	var sb strings.Builder
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] == '%' && i < len(tmpl)-1 {
+			switch tmpl[i+1] {
+			case 'Y', 'm', 'd', 'H', 'M':
+				sb.WriteByte('*')
+				i++
+				continue
+			case '%':
+				sb.WriteByte('%')
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(tmpl[i])
+	}
+	return sb.String()
+}
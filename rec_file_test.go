@@ -0,0 +1,433 @@
+package xlog
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func readDir(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error\n%s", err.Error())
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestFileRecorderRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xlog-test")
+	if err != nil {
+		t.Fatalf("TempDir() error\n%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	noTime := func(msg *LogMsg) string { return msg.GetContent() }
+
+	t.Run("Numbered", func(t *testing.T) {
+		path := filepath.Join(dir, "num.log")
+		r := SpawnFileRecorder(path).FormatFunc(noTime).RotateSize(64).MaxBackups(2)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		for i := 0; i < 10; i++ { // 10 lines, 20 bytes each
+			_ = l.Write(Info, "message number %04d", i)
+		}
+		flushLogger(t, l)
+
+		for _, name := range []string{path, path + ".1", path + ".2"} {
+			info, err := os.Stat(name)
+			if err != nil {
+				t.Fatalf("file %s doesn't exist", name)
+			}
+			if info.Size() > 64 {
+				t.Errorf("file %s exceeds the size limit (%d)", name, info.Size())
+			}
+		}
+		if _, err := os.Stat(path + ".3"); err == nil {
+			t.Errorf("backups limit is exceeded")
+		}
+		data, _ := ioutil.ReadFile(path + ".1")
+		if !strings.HasPrefix(string(data), "message number 0006") {
+			t.Errorf("wrong order of the backups\n%s", data)
+		}
+	})
+
+	t.Run("Timestamp", func(t *testing.T) {
+		path := filepath.Join(dir, "ts.log")
+		r := SpawnFileRecorder(path).FormatFunc(noTime).
+			RotateSize(64).MaxBackups(2).BackupSuffix(SuffixTimestamp)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		for i := 0; i < 10; i++ {
+			_ = l.Write(Info, "message number %04d", i)
+			time.Sleep(time.Millisecond * 2) // unique suffixes
+		}
+		flushLogger(t, l)
+
+		var backups int
+		for _, name := range readDir(t, dir) {
+			if strings.HasPrefix(name, "ts.log.") {
+				backups++
+			}
+		}
+		if backups != 2 {
+			t.Errorf("wrong number of backups (%d/2)", backups)
+		}
+	})
+
+	t.Run("TimestampCollision", func(t *testing.T) {
+		path := filepath.Join(dir, "same.log")
+		r := NewFileRecorder(path).BackupSuffix(SuffixTimestamp)
+		if err := r.initialise(); err != nil {
+			t.Fatalf(emsgUnexpectedError, err)
+		}
+		defer r.close()
+
+		stamp := time.Date(2020, 1, 2, 3, 4, 5, 6e6, time.UTC) // rotations within the same ms
+		for _, suffix := range []string{"", "-1", "-2"} {
+			name := r.timestampName(stamp)
+			if name != path+".20200102-030405.006"+suffix {
+				t.Fatalf("wrong backup name %s", name)
+			}
+			if err := ioutil.WriteFile(name, []byte(suffix), 0644); err != nil {
+				t.Fatalf(emsgUnexpectedError, err)
+			}
+		}
+		if err := os.Rename(path+".20200102-030405.006-2", path+".20200102-030405.006-2"+gzipExt); err != nil {
+			t.Fatalf(emsgUnexpectedError, err)
+		}
+		if name := r.timestampName(stamp); name != path+".20200102-030405.006-3" {
+			t.Errorf("compressed backup is overwritten by %s", name)
+		}
+		if backups, _ := r.listBackups(path); len(backups) != 3 {
+			t.Errorf("wrong backups: %v", backups)
+		}
+		if isBackupSuffix("20200102-030405.006-x") {
+			t.Errorf("wrong counter is recognised as a backup")
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		path := filepath.Join(dir, "reopen.log")
+		r := SpawnFileRecorder(path).FormatFunc(noTime)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+
+		_ = l.Write(Info, "first")
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if e := l.Shutdown(ctx); e != nil {
+			t.Fatalf("Shutdown() return error\n%s", e.Error())
+		}
+		if r.file != nil {
+			t.Fatalf("file is not closed")
+		}
+		if e := os.Remove(path); e != nil {
+			t.Fatalf("Remove() error\n%s", e.Error())
+		}
+
+		if e := l.Initialise(); e != nil {
+			t.Fatalf("Initialise() return error\n%s", e.Error())
+		}
+		defer l.Close()
+		_ = l.Write(Info, "second")
+		flushLogger(t, l)
+
+		if data, _ := ioutil.ReadFile(path); string(data) != "second\n" {
+			t.Errorf("wrong file content after reopening\n%s", data)
+		}
+	})
+}
+
+func TestFileRecorderTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xlog-test")
+	if err != nil {
+		t.Fatalf("TempDir() error\n%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	noTime := func(msg *LogMsg) string { return msg.GetContent() }
+	beforeMidnight := time.Date(2020, 1, 1, 23, 59, 59, 0, time.Local)
+	afterMidnight := beforeMidnight.Add(time.Second * 2)
+
+	if p := expandPathTemplate("/%Y/%m-%d/%H:%M/100%%.log", beforeMidnight); p != "/2020/01-01/23:59/100%.log" {
+		t.Errorf("wrong template expansion (%s)", p)
+	}
+
+	t.Run("Path", func(t *testing.T) {
+		tmpl := filepath.Join(dir, "%Y-%m-%d", "errors.log")
+		r := SpawnFileRecorder(tmpl).FormatFunc(noTime)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		msg := Message("first")
+		msg.time = beforeMidnight
+		_ = l.WriteMsg(nil, msg)
+		msg = Message("second")
+		msg.time = afterMidnight
+		_ = l.WriteMsg(nil, msg)
+		flushLogger(t, l)
+
+		data, _ := ioutil.ReadFile(filepath.Join(dir, "2020-01-01", "errors.log"))
+		if string(data) != "first\n" {
+			t.Errorf("wrong content of the first file\n%s", data)
+		}
+		data, _ = ioutil.ReadFile(filepath.Join(dir, "2020-01-02", "errors.log"))
+		if string(data) != "second\n" {
+			t.Errorf("wrong content of the second file\n%s", data)
+		}
+	})
+
+	t.Run("Period", func(t *testing.T) {
+		path := filepath.Join(dir, "daily.log")
+		r := SpawnFileRecorder(path).FormatFunc(noTime).
+			RotateEvery(RotateDaily).BackupSuffix(SuffixTimestamp)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		msg := Message("first")
+		msg.time = beforeMidnight
+		_ = l.WriteMsg(nil, msg)
+		msg = Message("second")
+		msg.time = afterMidnight
+		_ = l.WriteMsg(nil, msg)
+		flushLogger(t, l)
+
+		data, _ := ioutil.ReadFile(path + ".20200101-000000.000")
+		if string(data) != "first\n" {
+			t.Errorf("wrong content of the rotated file\n%s", data)
+		}
+		data, _ = ioutil.ReadFile(path)
+		if string(data) != "second\n" {
+			t.Errorf("wrong content of the current file\n%s", data)
+		}
+	})
+}
+
+func TestFileRecorderRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xlog-test")
+	if err != nil {
+		t.Fatalf("TempDir() error\n%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	noTime := func(msg *LogMsg) string { return msg.GetContent() }
+
+	t.Run("Compress", func(t *testing.T) {
+		path := filepath.Join(dir, "gz.log")
+		r := SpawnFileRecorder(path).FormatFunc(noTime).
+			RotateSize(64).MaxBackups(3).Compress(true)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		for i := 0; i < 10; i++ { // 10 lines, 20 bytes each
+			_ = l.Write(Info, "message number %04d", i)
+		}
+		flushLogger(t, l)
+
+		for _, name := range []string{path + ".1.gz", path + ".2.gz", path + ".3.gz"} {
+			if _, err := os.Stat(name); err != nil {
+				t.Errorf("file %s doesn't exist", name)
+			}
+		}
+		for _, name := range []string{path + ".1", path + ".4.gz"} {
+			if _, err := os.Stat(name); err == nil {
+				t.Errorf("file %s shouldn't exist", name)
+			}
+		}
+
+		f, err := os.Open(path + ".1.gz")
+		if err != nil {
+			t.Fatalf("Open() error\n%s", err.Error())
+		}
+		defer f.Close()
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("gzip.NewReader() error\n%s", err.Error())
+		}
+		data, _ := ioutil.ReadAll(zr)
+		if !strings.HasPrefix(string(data), "message number 0006") {
+			t.Errorf("wrong content of the compressed backup\n%s", data)
+		}
+	})
+
+	t.Run("MaxAge", func(t *testing.T) {
+		path := filepath.Join(dir, "age.log")
+		old := path + ".20000101-000000.000"
+		if e := ioutil.WriteFile(old, []byte("old\n"), 0644); e != nil {
+			t.Fatalf("WriteFile() error\n%s", e.Error())
+		}
+		stamp := time.Now().Add(-time.Hour * 48)
+		if e := os.Chtimes(old, stamp, stamp); e != nil {
+			t.Fatalf("Chtimes() error\n%s", e.Error())
+		}
+
+		r := SpawnFileRecorder(path).FormatFunc(noTime).RotateSize(64).
+			BackupSuffix(SuffixTimestamp).MaxAge(time.Hour * 24)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		for i := 0; i < 4; i++ {
+			_ = l.Write(Info, "message number %04d", i)
+		}
+		flushLogger(t, l)
+
+		if _, err := os.Stat(old); err == nil {
+			t.Errorf("expired backup is not removed")
+		}
+		var backups int
+		for _, name := range readDir(t, dir) {
+			if strings.HasPrefix(name, "age.log.") {
+				backups++
+			}
+		}
+		if backups != 1 {
+			t.Errorf("wrong number of backups (%d/1)", backups)
+		}
+	})
+
+	t.Run("MaxTotalSize", func(t *testing.T) {
+		path := filepath.Join(dir, "total.log")
+		r := SpawnFileRecorder(path).FormatFunc(noTime).RotateSize(40).MaxTotalSize(100)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		for i := 0; i < 20; i++ { // 2 lines per file
+			_ = l.Write(Info, "message number %04d", i)
+			time.Sleep(time.Millisecond * 2) // distinct modification times
+		}
+		flushLogger(t, l)
+
+		var total int64
+		for _, name := range readDir(t, dir) {
+			if strings.HasPrefix(name, "total.log.") {
+				info, _ := os.Stat(filepath.Join(dir, name))
+				total += info.Size()
+			}
+		}
+		if total == 0 || total > 100 {
+			t.Errorf("wrong total size of backups (%d)", total)
+		}
+		data, _ := ioutil.ReadFile(path + ".1")
+		if !strings.HasPrefix(string(data), "message number 0016") {
+			t.Errorf("the newest backup has been removed\n%s", data)
+		}
+	})
+
+	t.Run("Template", func(t *testing.T) {
+		tmpl := filepath.Join(dir, "tmpl-%Y%m%d.log")
+		r := SpawnFileRecorder(tmpl).FormatFunc(noTime).MaxBackups(1).Compress(true)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		day := time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)
+		for i := 0; i < 3; i++ {
+			msg := Message("message")
+			msg.time = day.AddDate(0, 0, i)
+			_ = l.WriteMsg(nil, msg)
+		}
+		flushLogger(t, l)
+
+		names := strings.Join(readDir(t, dir), " ")
+		for _, name := range []string{"tmpl-20200102.log.gz", "tmpl-20200103.log"} {
+			if !strings.Contains(names, name) {
+				t.Errorf("file %s doesn't exist (%s)", name, names)
+			}
+		}
+		if strings.Contains(names, "tmpl-20200101.log") {
+			t.Errorf("the oldest file is not removed (%s)", names)
+		}
+	})
+}
+
+func TestFileRecorderReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xlog-test")
+	if err != nil {
+		t.Fatalf("TempDir() error\n%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	noTime := func(msg *LogMsg) string { return msg.GetContent() }
+	path := filepath.Join(dir, "app.log")
+	r := SpawnFileRecorder(path).FormatFunc(noTime)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	rd := SpawnIoDirectRecorder(NewVoidWriter()) // has nothing to reopen
+	defer func() { rd.Intrf().ChCtl <- SignalStop() }()
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+	if e := l.RegisterRecorder("direct", rd.Intrf()); e != nil {
+		t.Fatalf("RegisterRecorder() return error\n%s", e.Error())
+	}
+	if e := l.Initialise(); e != nil {
+		t.Fatalf("Initialise() return error\n%s", e.Error())
+	}
+
+	t.Run("Method", func(t *testing.T) {
+		_ = l.Write(Info, "first")
+		if e := os.Rename(path, path+".old"); e != nil { // logrotate
+			t.Fatalf("Rename() error\n%s", e.Error())
+		}
+		_ = l.Write(Info, "second") // queued before the reopen
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		if e := l.Reopen(ctx); e != nil {
+			t.Fatalf("Reopen() return error\n%s", e.Error())
+		}
+		_ = l.Write(Info, "third")
+		flushLogger(t, l)
+
+		if data, _ := ioutil.ReadFile(path + ".old"); string(data) != "first\nsecond\n" {
+			t.Errorf("wrong content of the old file\n%s", data)
+		}
+		if data, _ := ioutil.ReadFile(path); string(data) != "third\n" {
+			t.Errorf("wrong content of the new file\n%s", data)
+		}
+	})
+
+	t.Run("Signal", func(t *testing.T) {
+		chErr := make(chan error, 1)
+		stop := l.ReopenOnSignal(chErr, syscall.SIGUSR1)
+		defer stop()
+
+		if e := os.Rename(path, path+".old"); e != nil {
+			t.Fatalf("Rename() error\n%s", e.Error())
+		}
+		if e := syscall.Kill(os.Getpid(), syscall.SIGUSR1); e != nil {
+			t.Fatalf("Kill() error\n%s", e.Error())
+		}
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			if _, err := os.Stat(path); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("file is not reopened")
+			}
+			time.Sleep(time.Millisecond * 5)
+		}
+		select {
+		case e := <-chErr:
+			t.Errorf(emsgUnexpectedError, e)
+		default:
+		}
+	})
+}
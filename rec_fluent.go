@@ -0,0 +1,638 @@
+package xlog
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+var _ LogRecorder = &fluentRecorder{}
+
+const (
+	defaultFluentTag          = "xlog"
+	defaultFluentBatchSize    = 100
+	defaultFluentInterval     = time.Second
+	defaultFluentDialTimeout  = time.Second * 5
+	defaultFluentWriteTimeout = time.Second * 5
+	defaultFluentAckTimeout   = time.Second * 10
+	defaultFluentAttempts     = 5
+	defaultFluentMinBackoff   = time.Millisecond * 100
+	defaultFluentMaxBackoff   = time.Second * 30
+	defaultFluentQueueSize    = 64 // batches
+)
+
+// fluentBatch is the encoded forward message ready for sending.
+type fluentBatch struct {
+	data     []byte
+	chunk    string // ack id
+	count    int    // number of messages
+	attempts int
+}
+
+type fluentRecorder struct {
+	chCtl chan controlSignal
+	chMsg chan LogMsg
+	chErr chan<- error        // optional
+	chDbg chan<- debugMessage // optional
+
+	id          xid.ID
+	isListening bool_s // internal mutex
+	refCounter  int
+	conn        net.Conn
+	reader      *bufio.Reader // ack responses
+
+	pending    []LogMsg       // messages of the current batch
+	queue      []*fluentBatch // batches waiting for sending
+	batchTimer *time.Timer
+	chBatch    <-chan time.Time
+	retryTimer *time.Timer
+	chRetry    <-chan time.Time
+	backoff    time.Duration
+	dropped    uint64 // atomic
+
+	sync.RWMutex
+	network      string // "tcp" or "unix"
+	addr         string
+	tag          string
+	loggerTag    bool
+	requireAck   bool
+	batchSize    int
+	interval     time.Duration
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	ackTimeout   time.Duration
+	maxAttempts  int
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	queueSize    int
+}
+
+// NewFluentRecorder allocates and returns a new recorder for the Fluent
+// forward protocol (Fluentd, Fluent Bit). The network is "tcp" or "unix".
+//
+// Messages are sent in batches in the PackedForward mode (or in the Message
+// mode if the batch size is 1). With acknowledgements enabled, each batch
+// has the chunk id and the recorder waits for the ack; failed and unacked
+// batches are retried with exponential backoff and dropped (and reported
+// to the error channel) when the number of attempts is exhausted. The agent
+// may be down at initialisation, the recorder connects on the first send.
+func NewFluentRecorder(network, addr string) *fluentRecorder {
+	r := new(fluentRecorder)
+	r.id = xid.NewWithTime(time.Now())
+	r.chCtl = make(chan controlSignal, 32)
+	r.chMsg = make(chan LogMsg, 64)
+	r.network = network
+	r.addr = addr
+	r.tag = defaultFluentTag
+	r.batchSize = defaultFluentBatchSize
+	r.interval = defaultFluentInterval
+	r.dialTimeout = defaultFluentDialTimeout
+	r.writeTimeout = defaultFluentWriteTimeout
+	r.ackTimeout = defaultFluentAckTimeout
+	r.maxAttempts = defaultFluentAttempts
+	r.minBackoff = defaultFluentMinBackoff
+	r.maxBackoff = defaultFluentMaxBackoff
+	r.queueSize = defaultFluentQueueSize
+	return r
+}
+
+// SpawnFluentRecorder creates recorder and starts a listener.
+func SpawnFluentRecorder(network, addr string) *fluentRecorder {
+	r := NewFluentRecorder(network, addr)
+	go r.Listen()
+	return r
+}
+
+// Intrf returns recorder's interface channels.
+func (R *fluentRecorder) Intrf() RecorderInterface {
+	return RecorderInterface{R.chCtl, R.chMsg, R.id}
+}
+
+// GetID returns recorder's xid.
+func (R *fluentRecorder) GetID() xid.ID {
+	return R.id
+}
+
+// Tag sets the event tag ("xlog" by default).
+func (R *fluentRecorder) Tag(tag string) *fluentRecorder {
+	R.Lock()
+	R.tag = tag
+	R.Unlock()
+	return R
+}
+
+// LoggerTag enables tags derived from logger names: messages of the named
+// logger get the "<tag>.<logger name>" tag, e.g. "app.db".
+func (R *fluentRecorder) LoggerTag(enable bool) *fluentRecorder {
+	R.Lock()
+	R.loggerTag = enable
+	R.Unlock()
+	return R
+}
+
+// RequireAck enables acknowledgements (the "chunk" option).
+func (R *fluentRecorder) RequireAck(enable bool) *fluentRecorder {
+	R.Lock()
+	R.requireAck = enable
+	R.Unlock()
+	return R
+}
+
+// Batch sets the max number of messages in the forward message (100 by
+// default) and the max time the message waits for the batch to fill.
+func (R *fluentRecorder) Batch(size int, interval time.Duration) *fluentRecorder {
+	R.Lock()
+	R.batchSize = size
+	R.interval = interval
+	R.Unlock()
+	return R
+}
+
+// Timeouts sets timeouts for connection, writing (5s by default) and
+// waiting for the ack (10s by default).
+func (R *fluentRecorder) Timeouts(dial, write, ack time.Duration) *fluentRecorder {
+	R.Lock()
+	R.dialTimeout = dial
+	R.writeTimeout = write
+	R.ackTimeout = ack
+	R.Unlock()
+	return R
+}
+
+// Retry sets the max number of attempts to send the batch (5 by default)
+// and the backoff delays (100ms and 30s by default).
+func (R *fluentRecorder) Retry(attempts int, min, max time.Duration) *fluentRecorder {
+	R.Lock()
+	R.maxAttempts = attempts
+	R.minBackoff = min
+	R.maxBackoff = max
+	R.Unlock()
+	return R
+}
+
+// QueueSize sets the max number of batches waiting for sending (64 by
+// default). When the queue is full, the oldest batch is dropped.
+func (R *fluentRecorder) QueueSize(size int) *fluentRecorder {
+	R.Lock()
+	R.queueSize = size
+	R.Unlock()
+	return R
+}
+
+// DroppedMessages returns the number of messages which have been dropped
+// (the recorder gave up sending their batches).
+func (R *fluentRecorder) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&R.dropped)
+}
+
+// -----------------------------------------------------------------------------
+
+func (R *fluentRecorder) Listen() {
+	if R.isListening.Get() {
+		return
+	} else {
+		R.isListening.Set(true)
+		R._log("start listener...")
+	}
+
+	for {
+		select {
+		case sig := <-R.chCtl: // recv control signal
+			switch sig.stype {
+			case SigInit:
+				R._log("RECV INIT SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R._log("  chan: %v", respErrChan)
+				e := R.initialise()
+				R._log("  send response..")
+				respErrChan <- e
+				R._log("  done")
+			case SigClose:
+				R._log("RECV CLOSE SIGNAL")
+				R.close()
+			case SigFlush, SigReopen: // nothing to reopen
+				R._log("RECV %s SIGNAL", sig.stype)
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				R.seal()
+				if R.chRetry == nil {
+					R.sendQueue()
+				}
+				if n := len(R.queue); n > 0 {
+					respErrChan <- fmt.Errorf("fluent: %d batches are waiting for retry", n)
+				} else {
+					respErrChan <- nil
+				}
+			case SigStop:
+				R._log("RECV STOP SIGNAL")
+				R.isListening.Set(false)
+				R._log("stop listener...")
+				return
+
+			case SigSetErrChan:
+				R._log("RECV SET_ERR_CHAN SIGNAL")
+				R.chErr = sig.data.(chan<- error) // MAY PANIC
+			case SigSetDbgChan:
+				R._log("RECV SET_DBG_CHAN SIGNAL")
+				R.chDbg = sig.data.(chan<- debugMessage) // MAY PANIC
+			case SigDropErrChan:
+				R._log("RECV DROP_ERR_CHAN SIGNAL")
+				R.chErr = nil
+			case SigDropDbgChan:
+				R._log("RECV DROP_DBG_CHAN SIGNAL")
+				R.chDbg = nil
+
+			default:
+				R._log("ERROR: received unknown signal (%s)", sig.stype)
+				// DO NOTHING
+			}
+
+		case msg := <-R.chMsg: // write log message
+			R._log("RECV MSG SIGNAL <--\n  msg=%v", msg)
+			R.handle(msg)
+
+		case <-R.chBatch: // batch interval is passed
+			R.chBatch = nil
+			R.seal()
+			if R.chRetry == nil {
+				R.sendQueue()
+			}
+
+		case <-R.chRetry: // retry attempt
+			R.chRetry = nil
+			R.sendQueue()
+		}
+	}
+}
+
+// handle writes the message and reports an error if it occurs.
+func (R *fluentRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		R.reportError(err)
+	}
+}
+
+func (R *fluentRecorder) reportError(err error) {
+	if R.chErr != nil {
+		R.chErr <- err // MAY PANIC
+	}
+}
+
+// drain writes all messages which have been queued before the call.
+func (R *fluentRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
+func (R *fluentRecorder) IsListening() bool {
+	return R.isListening.Get() // rc safe
+}
+
+// ----------------------------------------
+
+func (R *fluentRecorder) initialise() error {
+	if R.refCounter == 0 {
+		R.RLock()
+		network := R.network
+		R.RUnlock()
+		switch network {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return fmt.Errorf("fluent: unsupported network %q", network)
+		}
+		if err := R.connect(); err != nil {
+			// the agent may be down, batches reconnect (and retry) on send
+			R._log("connect fail: %s", err.Error())
+		}
+	}
+	R.refCounter++
+	return nil
+}
+
+func (R *fluentRecorder) close() {
+	if R.refCounter == 0 {
+		return
+	}
+	if R.refCounter == 1 {
+		R.seal()
+		R.stopRetry()
+		R.backoff = 0
+		// the last attempt, without delays
+		for len(R.queue) > 0 {
+			b := R.queue[0]
+			R.queue = R.queue[1:]
+			if err := R.send(b); err != nil {
+				b.attempts++
+				R.disconnect()
+				R.giveUp(b, err)
+			}
+		}
+		R.queue = nil
+		R.disconnect()
+	}
+	R.refCounter--
+}
+
+func (R *fluentRecorder) connect() error {
+	R.RLock()
+	network, addr, timeout := R.network, R.addr, R.dialTimeout
+	R.RUnlock()
+
+	R._log("dial %s %s", network, addr)
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return err
+	}
+	R.conn = conn
+	R.reader = bufio.NewReader(conn)
+	return nil
+}
+
+func (R *fluentRecorder) disconnect() {
+	if R.conn != nil {
+		R.conn.Close()
+		R.conn = nil
+		R.reader = nil
+	}
+}
+
+// ----------------------------------------
+
+func (R *fluentRecorder) write(msg LogMsg) error {
+	if R.refCounter == 0 {
+		return ErrNotInitialised
+	}
+	R.RLock()
+	size, interval := R.batchSize, R.interval
+	R.RUnlock()
+
+	R.pending = append(R.pending, msg)
+	if len(R.pending) == 1 && interval > 0 {
+		R.batchTimer = time.NewTimer(interval)
+		R.chBatch = R.batchTimer.C
+	}
+	if len(R.pending) >= size {
+		R.seal()
+		if R.chRetry == nil {
+			R.sendQueue()
+		}
+	}
+	return nil
+}
+
+// seal encodes the current batch (a forward message for each tag) and puts
+// it to the queue.
+func (R *fluentRecorder) seal() {
+	if R.batchTimer != nil {
+		R.batchTimer.Stop()
+		R.batchTimer = nil
+	}
+	R.chBatch = nil
+	if len(R.pending) == 0 {
+		return
+	}
+
+	R.RLock()
+	queueSize := R.queueSize
+	batches := R.encode(R.pending)
+	R.RUnlock()
+
+	R.pending = nil
+	R.queue = append(R.queue, batches...)
+	for queueSize > 0 && len(R.queue) > queueSize {
+		b := R.queue[0]
+		R.queue = R.queue[1:]
+		R.giveUp(b, fmt.Errorf("queue is full"))
+	}
+}
+
+// encode groups messages by tags and builds forward messages. It must be
+// called under the read lock.
+func (R *fluentRecorder) encode(msgs []LogMsg) []*fluentBatch {
+	var tags []string
+	entries := make(map[string][]*LogMsg)
+	for i := range msgs {
+		tag := R.tag
+		if R.loggerTag && msgs[i].logger != "" {
+			tag += "." + msgs[i].logger
+		}
+		if _, exist := entries[tag]; !exist {
+			tags = append(tags, tag)
+		}
+		entries[tag] = append(entries[tag], &msgs[i])
+	}
+
+	var batches []*fluentBatch
+	for _, tag := range tags {
+		b := &fluentBatch{count: len(entries[tag])}
+		if R.requireAck {
+			b.chunk = newFluentChunkID()
+		}
+		options := 1 // size
+		if b.chunk != "" {
+			options++
+		}
+
+		if len(msgs) == 1 { // Message mode: [tag, time, record, option]
+			b.data = appendMsgpackArrayHeader(nil, 4)
+			b.data = appendMsgpackStr(b.data, tag)
+			b.data = appendMsgpackEventTime(b.data, msgs[0].time)
+			b.data = appendFluentRecord(b.data, &msgs[0])
+		} else { // PackedForward mode: [tag, bin([time, record]...), option]
+			var stream []byte
+			for _, msg := range entries[tag] {
+				stream = appendMsgpackArrayHeader(stream, 2)
+				stream = appendMsgpackEventTime(stream, msg.time)
+				stream = appendFluentRecord(stream, msg)
+			}
+			b.data = appendMsgpackArrayHeader(nil, 3)
+			b.data = appendMsgpackStr(b.data, tag)
+			b.data = appendMsgpackBin(b.data, stream)
+		}
+		b.data = appendMsgpackMapHeader(b.data, options)
+		b.data = appendMsgpackStr(b.data, "size")
+		b.data = appendMsgpackUint(b.data, uint64(b.count))
+		if b.chunk != "" {
+			b.data = appendMsgpackStr(b.data, "chunk")
+			b.data = appendMsgpackStr(b.data, b.chunk)
+		}
+		batches = append(batches, b)
+	}
+	return batches
+}
+
+// sendQueue sends queued batches until the first failure, then it
+// schedules the retry.
+func (R *fluentRecorder) sendQueue() {
+	R.RLock()
+	maxAttempts := R.maxAttempts
+	R.RUnlock()
+
+	for len(R.queue) > 0 {
+		b := R.queue[0]
+		err := R.send(b)
+		if err == nil {
+			R.queue = R.queue[1:]
+			R.backoff = 0
+			continue
+		}
+		b.attempts++
+		R._log("send error (attempt %d): %s", b.attempts, err.Error())
+		R.disconnect()
+		if b.attempts >= maxAttempts {
+			R.queue = R.queue[1:]
+			R.giveUp(b, err)
+			continue
+		}
+		R.scheduleRetry()
+		return
+	}
+	R.queue = nil
+}
+
+// send writes the batch and waits for the ack (if it's required).
+func (R *fluentRecorder) send(b *fluentBatch) error {
+	if R.conn == nil {
+		if err := R.connect(); err != nil {
+			return err
+		}
+	}
+	R.RLock()
+	writeTimeout, ackTimeout := R.writeTimeout, R.ackTimeout
+	R.RUnlock()
+
+	if writeTimeout > 0 {
+		R.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	}
+	if _, err := R.conn.Write(b.data); err != nil {
+		return err
+	}
+	if b.chunk == "" {
+		return nil
+	}
+
+	if ackTimeout > 0 {
+		R.conn.SetReadDeadline(time.Now().Add(ackTimeout))
+	}
+	resp, err := decodeMsgpack(R.reader)
+	if err != nil {
+		return fmt.Errorf("ack is not received: %s", err.Error())
+	}
+	if m, ok := resp.(map[string]interface{}); !ok || m["ack"] != b.chunk {
+		return fmt.Errorf("wrong ack: %v", resp)
+	}
+	return nil
+}
+
+// giveUp drops the batch and reports it.
+func (R *fluentRecorder) giveUp(b *fluentBatch, err error) {
+	atomic.AddUint64(&R.dropped, uint64(b.count))
+	R.reportError(fmt.Errorf("fluent: %d messages are dropped after %d attempts: %s",
+		b.count, b.attempts, err.Error()))
+}
+
+func (R *fluentRecorder) scheduleRetry() {
+	R.RLock()
+	min, max := R.minBackoff, R.maxBackoff
+	R.RUnlock()
+
+	R.backoff *= 2
+	if R.backoff < min {
+		R.backoff = min
+	}
+	if R.backoff > max {
+		R.backoff = max
+	}
+	R.stopRetry()
+	R.retryTimer = time.NewTimer(R.backoff)
+	R.chRetry = R.retryTimer.C
+}
+
+func (R *fluentRecorder) stopRetry() {
+	if R.retryTimer != nil {
+		R.retryTimer.Stop()
+		R.retryTimer = nil
+	}
+	R.chRetry = nil
+}
+
+func (R *fluentRecorder) _log(format string, args ...interface{}) { // MAY PANIC
+	if R.chDbg != nil {
+		msg := DbgMsg(R.id, format, args...)
+		msg.rtype = "fluentRecorder"
+		R.chDbg <- msg
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// appendFluentRecord writes the record map: msg, severity, logger, caller,
+// stack, message fields and the Data (if it's a map) with the same keys as
+// JSONEncoder with inline fields.
+func appendFluentRecord(b []byte, msg *LogMsg) []byte {
+	record := map[string]interface{}{
+		"msg":      msg.text(),
+		"severity": (msg.flags &^ SeverityShadowMask).String(),
+	}
+	if msg.logger != "" {
+		record["logger"] = msg.logger
+	}
+	if msg.caller.IsSet() {
+		record["caller"] = msg.caller.String()
+	}
+	if msg.stack != "" {
+		record["stack"] = msg.stack
+	}
+	extra := make(map[string]interface{})
+	switch data := msg.Data.(type) {
+	case map[string]interface{}:
+		for key, value := range data {
+			extra[key] = value
+		}
+	case map[string]string:
+		for key, value := range data {
+			extra[key] = value
+		}
+	}
+	for _, f := range msg.fields {
+		extra[f.Key] = jsonFieldValue(f)
+	}
+	for key, value := range extra { // reserved keys have precedence
+		if _, exist := record[key]; !exist {
+			record[key] = value
+		}
+	}
+
+	keys := make([]string, 0, len(record))
+	for key := range record {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b = appendMsgpackMapHeader(b, len(keys))
+	for _, key := range keys {
+		b = appendMsgpackStr(b, key)
+		b = appendMsgpackValue(b, record[key])
+	}
+	return b
+}
+
+// newFluentChunkID returns a unique chunk id (base64 of 16 random bytes).
+func newFluentChunkID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return strings.Replace(xid.New().String(), "-", "", -1)
+	}
+	return base64.StdEncoding.EncodeToString(id[:])
+}
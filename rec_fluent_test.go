@@ -0,0 +1,261 @@
+package xlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fluentEvent is the decoded forward event.
+type fluentEvent struct {
+	tag    string
+	time   time.Time
+	record map[string]interface{}
+	chunk  string
+}
+
+// fluentAgent is a test double for fluent-bit forward input.
+type fluentAgent struct {
+	ln     net.Listener
+	events chan fluentEvent
+	chunks chan string // chunk ids of all received batches
+	nacks  int32       // number of batches which are not acknowledged (atomic)
+}
+
+func newFluentAgent(t *testing.T, network, addr string, nacks int32) *fluentAgent {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatalf("Listen() error\n%s", err.Error())
+	}
+	a := &fluentAgent{ln: ln, events: make(chan fluentEvent, 64),
+		chunks: make(chan string, 64), nacks: nacks}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go a.serve(t, conn)
+		}
+	}()
+	return a
+}
+
+func (a *fluentAgent) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		v, err := decodeMsgpack(r)
+		if err != nil {
+			if err != io.EOF {
+				t.Errorf("wrong forward message\n%s", err.Error())
+			}
+			return
+		}
+		msg, ok := v.([]interface{})
+		if !ok || len(msg) < 3 {
+			t.Errorf("wrong forward message: %v", v)
+			return
+		}
+		tag, _ := msg[0].(string)
+		options, _ := msg[len(msg)-1].(map[string]interface{})
+		chunk, _ := options["chunk"].(string)
+
+		var events []fluentEvent
+		switch entries := msg[1].(type) {
+		case msgpackExt: // Message mode
+			events = append(events, fluentEvent{tag, fluentTime(t, entries), msg[2].(map[string]interface{}), chunk})
+		case []byte: // PackedForward mode
+			er := bufio.NewReader(bytes.NewReader(entries))
+			for {
+				entry, err := decodeMsgpack(er)
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Errorf("wrong entries\n%s", err.Error())
+					return
+				}
+				pair := entry.([]interface{})
+				events = append(events, fluentEvent{tag, fluentTime(t, pair[0].(msgpackExt)),
+					pair[1].(map[string]interface{}), chunk})
+			}
+		default:
+			t.Errorf("unexpected forward mode: %T", entries)
+			return
+		}
+		if size, _ := options["size"].(int64); int(size) != len(events) {
+			t.Errorf("wrong size option: %v, expected %d", options["size"], len(events))
+		}
+
+		if chunk != "" {
+			a.chunks <- chunk
+		}
+		if chunk != "" && atomic.AddInt32(&a.nacks, -1) >= 0 { // drop the batch without the ack
+			return
+		}
+		for _, e := range events {
+			a.events <- e
+		}
+		if chunk != "" {
+			ack := appendMsgpackMapHeader(nil, 1)
+			ack = appendMsgpackStr(ack, "ack")
+			ack = appendMsgpackStr(ack, chunk)
+			conn.Write(ack)
+		}
+	}
+}
+
+func fluentTime(t *testing.T, ext msgpackExt) time.Time {
+	if ext.Type != 0 || len(ext.Data) != 8 {
+		t.Errorf("wrong EventTime: %v", ext)
+		return time.Time{}
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(ext.Data[:4])),
+		int64(binary.BigEndian.Uint32(ext.Data[4:])))
+}
+
+func (a *fluentAgent) recv(t *testing.T) fluentEvent {
+	select {
+	case e := <-a.events:
+		return e
+	case <-time.After(time.Second * 5):
+		t.Fatalf("event is not received")
+		return fluentEvent{}
+	}
+}
+
+func TestFluentRecorder(t *testing.T) {
+	a := newFluentAgent(t, "tcp", "127.0.0.1:0", 0)
+	defer a.ln.Close()
+
+	r := SpawnFluentRecorder("tcp", a.ln.Addr().String()).Tag("app").LoggerTag(true).Batch(1, 0)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	msg := NewLogMsg().SetFlags(Warning).Setf("disk is almost full").Int("free_mb", 12)
+	msg.Data = map[string]interface{}{"mount": "/var", "msg": "ignored"}
+	msg.time = stamp
+	_ = l.Named("db").WriteMsg(nil, msg)
+
+	e := a.recv(t)
+	if e.tag != "app.db" || !e.time.Equal(stamp) || e.chunk != "" {
+		t.Errorf("wrong event: %s %s %q", e.tag, e.time, e.chunk)
+	}
+	for key, value := range map[string]interface{}{
+		"msg":      "disk is almost full",
+		"severity": "WARNING",
+		"logger":   "db",
+		"free_mb":  int64(12),
+		"mount":    "/var",
+	} {
+		if e.record[key] != value {
+			t.Errorf("wrong %s: %v, expected %v", key, e.record[key], value)
+		}
+	}
+
+	_ = l.WriteMsg(nil, NewLogMsg().Setf("root"))
+	if e = a.recv(t); e.tag != "app" || e.record["msg"] != "root" {
+		t.Errorf("wrong event: %s %v", e.tag, e.record)
+	}
+	flushLogger(t, l)
+}
+
+func TestFluentRecorderAck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xlog-fluent")
+	if err != nil {
+		t.Fatalf(emsgUnexpectedError, err)
+	}
+	defer os.RemoveAll(dir)
+	a := newFluentAgent(t, "unix", filepath.Join(dir, "fluent.sock"), 1)
+	defer a.ln.Close()
+
+	r := SpawnFluentRecorder("unix", a.ln.Addr().String()).RequireAck(true).Batch(3, time.Hour)
+	r.Timeouts(time.Second, time.Second, time.Second).Retry(3, time.Millisecond, time.Millisecond)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	chErr := make(chan error, 16)
+	r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	for _, text := range []string{"one", "two", "three"} {
+		_ = l.WriteMsg(nil, NewLogMsg().Setf(text))
+	}
+	for _, expected := range []string{"one", "two", "three"} {
+		e := a.recv(t)
+		if e.tag != "xlog" || e.record["msg"] != expected || e.chunk == "" {
+			t.Errorf("wrong event: %s %v %q", e.tag, e.record, e.chunk)
+		}
+	}
+	// the unacked batch is retried with the same chunk id
+	if first, second := <-a.chunks, <-a.chunks; first == "" || first != second {
+		t.Errorf("wrong chunk ids: %q, %q", first, second)
+	}
+
+	flushLogger(t, l)
+	select {
+	case err := <-chErr:
+		t.Errorf(emsgUnexpectedError, err)
+	default:
+	}
+	if n := r.DroppedMessages(); n != 0 {
+		t.Errorf("unexpected dropped messages: %d", n)
+	}
+}
+
+func TestFluentRecorderOffline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error\n%s", err.Error())
+	}
+	addr := ln.Addr().String()
+	ln.Close() // the agent is down at initialisation
+
+	r := SpawnFluentRecorder("tcp", addr).Batch(1, 0).Retry(100, time.Millisecond*10, time.Millisecond*10)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	_ = l.WriteMsg(nil, NewLogMsg().Setf("queued"))
+	a := newFluentAgent(t, "tcp", addr, 0)
+	defer a.ln.Close()
+	if e := a.recv(t); e.record["msg"] != "queued" {
+		t.Errorf("wrong event: %v", e.record)
+	}
+}
+
+func TestFluentRecorderGiveUp(t *testing.T) {
+	a := newFluentAgent(t, "tcp", "127.0.0.1:0", 100)
+	defer a.ln.Close()
+
+	r := SpawnFluentRecorder("tcp", a.ln.Addr().String()).RequireAck(true).Batch(1, 0)
+	r.Retry(2, time.Millisecond, time.Millisecond)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	chErr := make(chan error, 16)
+	r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	_ = l.WriteMsg(nil, NewLogMsg().Setf("lost"))
+	select {
+	case err := <-chErr:
+		if err == nil || !strings.Contains(err.Error(), "1 messages are dropped after 2 attempts") {
+			t.Errorf("wrong error: %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("error is not reported")
+	}
+	if n := r.DroppedMessages(); n != 1 {
+		t.Errorf("wrong number of dropped messages: %d", n)
+	}
+}
@@ -0,0 +1,599 @@
+package xlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/xid"
+)
+
+var _ LogRecorder = &gelfRecorder{}
+
+// GELFCompression determines the compression of UDP messages.
+type GELFCompression uint8
+
+const (
+	GELFGzip GELFCompression = iota
+	GELFZlib
+	GELFNone
+)
+
+const (
+	defaultGELFChunkSize = 1420 // fits the common WAN MTU
+	gelfChunkHeaderSize  = 12   // magic, message id, sequence number and count
+	gelfMaxChunks        = 128
+)
+
+const (
+	defaultGELFDialTimeout  = time.Second * 5
+	defaultGELFWriteTimeout = time.Second * 5
+	defaultGELFMinBackoff   = time.Millisecond * 100
+	defaultGELFMaxBackoff   = time.Second * 30
+)
+
+// errNotConnected is returned when the message is written between
+// reconnection attempts.
+var errNotConnected = errors.New("not connected")
+
+type gelfRecorder struct {
+	chCtl chan controlSignal
+	chMsg chan LogMsg
+	chErr chan<- error        // optional
+	chDbg chan<- debugMessage // optional
+
+	id          xid.ID
+	isListening bool_s // internal mutex
+	refCounter  int
+	conn        net.Conn
+	backoff     time.Duration // current reconnection delay
+	retryAt     time.Time     // next reconnection attempt
+
+	sync.RWMutex
+	network      string
+	addr         string
+	host         string
+	compression  GELFCompression
+	chunkSize    int
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+
+	// syslog severity for each message severity
+	sevBindings map[MsgFlagT]syslog.Priority
+}
+
+// NewGELFRecorder allocates and returns a new GELF 1.1 recorder for Graylog.
+// The network is "udp" (compressed and chunked messages) or "tcp" (messages
+// are terminated by the null byte, without compression). The recorder
+// reconnects with exponential backoff when the connection fails (or the
+// server is down at initialisation).
+//
+// The content goes to short_message, the content with the stack trace goes
+// to full_message. Logger name, caller info, message fields and the Data
+// (if it's a map) are sent as additional "_" fields. UDP messages which
+// don't fit 128 chunks are sent with truncated short_message and
+// full_message (the "[truncated]" marker is appended).
+func NewGELFRecorder(network, addr string) *gelfRecorder {
+	r := new(gelfRecorder)
+	r.id = xid.NewWithTime(time.Now())
+	r.chCtl = make(chan controlSignal, 32)
+	r.chMsg = make(chan LogMsg, 64)
+	r.network = network
+	r.addr = addr
+	r.host, _ = os.Hostname()
+	r.chunkSize = defaultGELFChunkSize
+	r.dialTimeout = defaultGELFDialTimeout
+	r.writeTimeout = defaultGELFWriteTimeout
+	r.minBackoff = defaultGELFMinBackoff
+	r.maxBackoff = defaultGELFMaxBackoff
+	r.sevBindings = defaultSyslogBindings()
+	return r
+}
+
+// SpawnGELFRecorder creates recorder and starts a listener.
+func SpawnGELFRecorder(network, addr string) *gelfRecorder {
+	r := NewGELFRecorder(network, addr)
+	go r.Listen()
+	return r
+}
+
+// Intrf returns recorder's interface channels.
+func (R *gelfRecorder) Intrf() RecorderInterface {
+	return RecorderInterface{R.chCtl, R.chMsg, R.id}
+}
+
+// GetID returns recorder's xid.
+func (R *gelfRecorder) GetID() xid.ID {
+	return R.id
+}
+
+// BindSeverityFlag rebinds severity flag to the new syslog severity code
+// (GELF level).
+func (R *gelfRecorder) BindSeverityFlag(severity MsgFlagT, priority syslog.Priority) error {
+	severity = severity &^ SeverityShadowMask
+
+	R.Lock()
+	defer R.Unlock()
+
+	if _, exist := R.sevBindings[severity]; !exist {
+		return ErrWrongFlagValue
+	}
+	if !isSyslogSeverity(priority) {
+		return errWrongPriority
+	}
+	R.sevBindings[severity] = priority
+	return nil
+}
+
+// Host sets the host field (os.Hostname() by default).
+func (R *gelfRecorder) Host(name string) *gelfRecorder {
+	R.Lock()
+	R.host = name
+	R.Unlock()
+	return R
+}
+
+// Compression sets the compression of UDP messages (GELFGzip by default).
+func (R *gelfRecorder) Compression(c GELFCompression) *gelfRecorder {
+	R.Lock()
+	R.compression = c
+	R.Unlock()
+	return R
+}
+
+// ChunkSize sets the max size of UDP datagrams (1420 by default, use 8192
+// for the local network). Larger messages are sent in chunks, up to 128.
+func (R *gelfRecorder) ChunkSize(size int) *gelfRecorder {
+	R.Lock()
+	R.chunkSize = size
+	R.Unlock()
+	return R
+}
+
+// Timeouts sets timeouts for connection and writing (5s by default).
+func (R *gelfRecorder) Timeouts(dial, write time.Duration) *gelfRecorder {
+	R.Lock()
+	R.dialTimeout = dial
+	R.writeTimeout = write
+	R.Unlock()
+	return R
+}
+
+// Backoff sets the minimum and maximum delays between reconnection
+// attempts (100ms and 30s by default).
+func (R *gelfRecorder) Backoff(min, max time.Duration) *gelfRecorder {
+	R.Lock()
+	R.minBackoff = min
+	R.maxBackoff = max
+	R.Unlock()
+	return R
+}
+
+// -----------------------------------------------------------------------------
+
+func (R *gelfRecorder) Listen() {
+	if R.isListening.Get() {
+		return
+	} else {
+		R.isListening.Set(true)
+		R._log("start listener...")
+	}
+
+	for {
+		select {
+		case sig := <-R.chCtl: // recv control signal
+			switch sig.stype {
+			case SigInit:
+				R._log("RECV INIT SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R._log("  chan: %v", respErrChan)
+				e := R.initialise()
+				R._log("  send response..")
+				respErrChan <- e
+				R._log("  done")
+			case SigClose:
+				R._log("RECV CLOSE SIGNAL")
+				R.close()
+			case SigFlush, SigReopen: // nothing to reopen
+				R._log("RECV %s SIGNAL", sig.stype)
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				respErrChan <- nil
+			case SigStop:
+				R._log("RECV STOP SIGNAL")
+				R.isListening.Set(false)
+				R._log("stop listener...")
+				return
+
+			case SigSetErrChan:
+				R._log("RECV SET_ERR_CHAN SIGNAL")
+				R.chErr = sig.data.(chan<- error) // MAY PANIC
+			case SigSetDbgChan:
+				R._log("RECV SET_DBG_CHAN SIGNAL")
+				R.chDbg = sig.data.(chan<- debugMessage) // MAY PANIC
+			case SigDropErrChan:
+				R._log("RECV DROP_ERR_CHAN SIGNAL")
+				R.chErr = nil
+			case SigDropDbgChan:
+				R._log("RECV DROP_DBG_CHAN SIGNAL")
+				R.chDbg = nil
+
+			default:
+				R._log("ERROR: received unknown signal (%s)", sig.stype)
+				// DO NOTHING
+			}
+
+		case msg := <-R.chMsg: // write log message
+			R._log("RECV MSG SIGNAL <--\n  msg=%v", msg)
+			R.handle(msg)
+		}
+	}
+}
+
+// handle writes the message and reports an error if it occurs.
+func (R *gelfRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		if R.chErr != nil {
+			R.chErr <- err // MAY PANIC
+		}
+	}
+}
+
+// drain writes all messages which have been queued before the call.
+func (R *gelfRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
+func (R *gelfRecorder) IsListening() bool {
+	return R.isListening.Get() // rc safe
+}
+
+// ----------------------------------------
+
+func (R *gelfRecorder) initialise() error {
+	if R.refCounter == 0 {
+		R.RLock()
+		network := R.network
+		R.RUnlock()
+		switch network {
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("gelf: unsupported network %q", network)
+		}
+		if err := R.reconnect(); err != nil {
+			// the server may be down, the next writes reconnect after backoff
+			R._log("connect fail: %s", err.Error())
+		}
+	}
+	R.refCounter++
+	return nil
+}
+
+func (R *gelfRecorder) close() {
+	if R.refCounter == 0 {
+		return
+	}
+	if R.refCounter == 1 {
+		R.disconnect()
+		R.backoff = 0
+		R.retryAt = time.Time{}
+	}
+	R.refCounter--
+}
+
+func (R *gelfRecorder) connect() error {
+	R.RLock()
+	network, addr, timeout := R.network, R.addr, R.dialTimeout
+	R.RUnlock()
+
+	R._log("dial %s %s", network, addr)
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return err
+	}
+	R.conn = conn
+	return nil
+}
+
+func (R *gelfRecorder) disconnect() {
+	if R.conn != nil {
+		R.conn.Close()
+		R.conn = nil
+	}
+}
+
+// reconnect connects to the server if the backoff delay is passed.
+func (R *gelfRecorder) reconnect() error {
+	if time.Now().Before(R.retryAt) {
+		return errNotConnected
+	}
+	R.disconnect()
+	if err := R.connect(); err != nil {
+		R.RLock()
+		min, max := R.minBackoff, R.maxBackoff
+		R.RUnlock()
+		R.backoff *= 2
+		if R.backoff < min {
+			R.backoff = min
+		}
+		if R.backoff > max {
+			R.backoff = max
+		}
+		R.retryAt = time.Now().Add(R.backoff)
+		return err
+	}
+	R.backoff = 0
+	R.retryAt = time.Time{}
+	return nil
+}
+
+// ----------------------------------------
+
+func (R *gelfRecorder) write(msg LogMsg) error {
+	if R.refCounter == 0 {
+		return ErrNotInitialised
+	}
+	data, err := R.message(&msg, 0)
+	if err != nil {
+		return err
+	}
+
+	if R.conn == nil {
+		if err := R.reconnect(); err != nil {
+			return fmt.Errorf("gelf: %s", err.Error())
+		}
+	}
+	err = R.send(data)
+	// the message doesn't fit the chunks, cut the text until it fits
+	for limit := len(msg.content) / 2; err == errGELFTooLarge && limit > 0; limit /= 2 {
+		data, _ = R.message(&msg, limit)
+		err = R.send(data)
+	}
+	if err != nil {
+		if err == errGELFTooLarge { // fields are too large
+			return err
+		}
+		// the connection could be closed by the server, try again at once
+		R._log("send error: %s, reconnect", err.Error())
+		R.disconnect()
+		if err := R.reconnect(); err != nil {
+			return fmt.Errorf("gelf: %s", err.Error())
+		}
+		if err := R.send(data); err != nil {
+			R.disconnect()
+			return fmt.Errorf("gelf: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+var errGELFTooLarge = fmt.Errorf("gelf: message is too large (more than %d chunks)", gelfMaxChunks)
+
+// send writes the message: null-terminated for TCP, compressed and chunked
+// if necessary for UDP.
+func (R *gelfRecorder) send(data []byte) error {
+	R.RLock()
+	network, compression := R.network, R.compression
+	chunkSize, timeout := R.chunkSize, R.writeTimeout
+	R.RUnlock()
+
+	if timeout > 0 {
+		R.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	if !strings.HasPrefix(network, "udp") {
+		_, err := R.conn.Write(append(data, 0))
+		return err
+	}
+
+	data, err := gelfCompress(data, compression)
+	if err != nil {
+		return err
+	}
+	if len(data) <= chunkSize {
+		_, err := R.conn.Write(data)
+		return err
+	}
+	chunks, err := gelfChunks(data, chunkSize)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if _, err := R.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the marker of the text cut to fit the chunks
+const gelfTruncatedMarker = "... [truncated]"
+
+// message builds the GELF JSON object. If the limit is positive, the
+// short_message and full_message are cut to this number of bytes.
+func (R *gelfRecorder) message(msg *LogMsg, limit int) ([]byte, error) {
+	R.RLock()
+	defer R.RUnlock()
+
+	level, exist := R.sevBindings[msg.flags&^SeverityShadowMask]
+	if !exist {
+		return nil, ErrWrongFlagValue
+	}
+	obj := map[string]interface{}{
+		"version":       "1.1",
+		"host":          R.host,
+		"short_message": gelfTruncate(msg.text(), limit),
+		"timestamp":     float64(msg.time.UnixNano()/int64(time.Millisecond)) / 1000,
+		"level":         int(level),
+	}
+	if msg.stack != "" {
+		obj["full_message"] = gelfTruncate(msg.content, limit)
+	}
+	if msg.text() == "" { // short_message is required
+		obj["short_message"] = "-"
+	}
+	if msg.logger != "" {
+		obj["_logger"] = msg.logger
+	}
+	if msg.caller.IsSet() {
+		obj["_file"] = msg.caller.File
+		obj["_line"] = msg.caller.Line
+		obj["_function"] = msg.caller.Func
+	}
+	switch data := msg.Data.(type) {
+	case map[string]interface{}:
+		for key, value := range data {
+			obj[gelfFieldName(key)] = gelfValue(value)
+		}
+	case map[string]string:
+		for key, value := range data {
+			obj[gelfFieldName(key)] = value
+		}
+	}
+	for _, f := range msg.fields { // fields have precedence over the Data
+		obj[gelfFieldName(f.Key)] = gelfValue(jsonFieldValue(f))
+	}
+
+	var buf bytes.Buffer
+	writeJSON(&buf, obj)
+	return buf.Bytes(), nil
+}
+
+func (R *gelfRecorder) _log(format string, args ...interface{}) { // MAY PANIC
+	if R.chDbg != nil {
+		msg := DbgMsg(R.id, format, args...)
+		msg.rtype = "gelfRecorder"
+		R.chDbg <- msg
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// gelfFieldName returns the additional field name: "_" prefix and
+// characters [\w\.\-] only, "_id" is reserved and becomes "__id".
+func gelfFieldName(key string) string {
+	name := "_" + strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '_', c == '.', c == '-':
+			return c
+		default:
+			return '_'
+		}
+	}, key)
+	if name == "_id" {
+		name = "__id"
+	}
+	return name
+}
+
+// gelfTruncate cuts the string to the limit (if it's positive) on the rune
+// boundary and appends the truncation marker.
+func gelfTruncate(s string, limit int) string {
+	if limit <= 0 || len(s) <= limit {
+		return s
+	}
+	for limit > 0 && !utf8.RuneStart(s[limit]) {
+		limit--
+	}
+	return s[:limit] + gelfTruncatedMarker
+}
+
+// gelfValue returns the value of the additional field: GELF allows strings
+// and numbers only, other values are converted to strings (JSON for arrays
+// and objects).
+func gelfValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return x
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return strconv.FormatFloat(x, 'g', -1, 64)
+		}
+		return x
+	case float32:
+		return gelfValue(float64(x))
+	case nil:
+		return ""
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	if data, err := json.Marshal(v); err == nil {
+		return string(data)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func gelfCompress(data []byte, compression GELFCompression) ([]byte, error) {
+	var buf bytes.Buffer
+	var w interface {
+		Write(p []byte) (int, error)
+		Close() error
+	}
+	switch compression {
+	case GELFGzip:
+		w = gzip.NewWriter(&buf)
+	case GELFZlib:
+		w = zlib.NewWriter(&buf)
+	default:
+		return data, nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gelfChunks splits the message into chunks: 0x1e 0x0f, 8-byte message id,
+// sequence number, sequence count and the data.
+func gelfChunks(data []byte, chunkSize int) ([][]byte, error) {
+	size := chunkSize - gelfChunkHeaderSize
+	if size <= 0 {
+		return nil, fmt.Errorf("gelf: chunk size %d is too small", chunkSize)
+	}
+	count := (len(data) + size - 1) / size
+	if count > gelfMaxChunks {
+		return nil, errGELFTooLarge
+	}
+	var msgID [8]byte
+	if _, err := rand.Read(msgID[:]); err != nil {
+		return nil, err
+	}
+	chunks := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := make([]byte, 0, gelfChunkHeaderSize+end-i*size)
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, msgID[:]...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, data[i*size:end]...)
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
@@ -0,0 +1,285 @@
+package xlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gelfServer is a test double for Graylog input, it reassembles chunks and
+// decompresses UDP messages.
+type gelfServer struct {
+	addr   string
+	closer io.Closer
+	msgs   chan map[string]interface{}
+	chunks chan int // number of chunks of each UDP message
+}
+
+func newGELFServer(t *testing.T, network string) *gelfServer {
+	s := &gelfServer{msgs: make(chan map[string]interface{}, 16), chunks: make(chan int, 16)}
+	if network == "tcp" {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen() error\n%s", err.Error())
+		}
+		s.addr, s.closer = ln.Addr().String(), ln
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				data, err := r.ReadBytes(0)
+				if err != nil {
+					return
+				}
+				s.decode(t, data[:len(data)-1])
+			}
+		}()
+		return s
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket() error\n%s", err.Error())
+	}
+	s.addr, s.closer = conn.LocalAddr().String(), conn
+	go func() {
+		buf := make([]byte, 65536)
+		chunks := make(map[string][][]byte)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			data := append([]byte(nil), buf[:n]...)
+			if !bytes.HasPrefix(data, []byte{0x1e, 0x0f}) {
+				s.chunks <- 1
+				s.decode(t, decompressGELF(t, data))
+				continue
+			}
+			id, seq, count := string(data[2:10]), data[10], int(data[11])
+			if chunks[id] == nil {
+				chunks[id] = make([][]byte, count)
+			}
+			chunks[id][seq] = data[12:]
+			if complete := func() bool {
+				for _, c := range chunks[id] {
+					if c == nil {
+						return false
+					}
+				}
+				return true
+			}(); complete {
+				s.chunks <- count
+				s.decode(t, decompressGELF(t, bytes.Join(chunks[id], nil)))
+				delete(chunks, id)
+			}
+		}
+	}()
+	return s
+}
+
+func decompressGELF(t *testing.T, data []byte) []byte {
+	var r io.Reader
+	var err error
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case data[0] == 0x78:
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return data
+	}
+	if err != nil {
+		t.Errorf("wrong compressed message\n%s", err.Error())
+		return nil
+	}
+	data, _ = ioutil.ReadAll(r)
+	return data
+}
+
+func (s *gelfServer) decode(t *testing.T, data []byte) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Errorf("wrong GELF message %q\n%s", data, err.Error())
+		return
+	}
+	s.msgs <- msg
+}
+
+func (s *gelfServer) recv(t *testing.T) map[string]interface{} {
+	select {
+	case msg := <-s.msgs:
+		return msg
+	case <-time.After(time.Second * 5):
+		t.Fatalf("message is not received")
+		return nil
+	}
+}
+
+func TestGELFRecorder(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		network     string
+		compression GELFCompression
+	}{
+		{"UDP_gzip", "udp", GELFGzip},
+		{"UDP_zlib", "udp", GELFZlib},
+		{"UDP", "udp", GELFNone},
+		{"TCP", "tcp", GELFGzip}, // not compressed
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newGELFServer(t, tc.network)
+			defer s.closer.Close()
+
+			r := SpawnGELFRecorder(tc.network, s.addr).Host("web-1").
+				Compression(tc.compression).ChunkSize(512)
+			defer func() { r.Intrf().ChCtl <- SignalStop() }()
+			chErr := make(chan error, 16)
+			r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+			l := newTestLogger(t, r.Intrf())
+			defer l.Close()
+
+			stamp := time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+			msg := NewLogMsg().SetFlags(Error).Setf("payment failed").
+				Str("id", "42").Int("amount", 100).Bool("retry", true)
+			msg.Data = map[string]interface{}{"order": "A-1", "amount": -1}
+			msg.time = stamp
+			_ = l.Named("billing").WriteMsg(nil, msg)
+
+			got := s.recv(t)
+			for key, value := range map[string]interface{}{
+				"version":       "1.1",
+				"host":          "web-1",
+				"short_message": "payment failed",
+				"timestamp":     1577934245.006,
+				"level":         float64(3),
+				"_logger":       "billing",
+				"__id":          "42",
+				"_amount":       float64(100), // fields override the Data
+				"_retry":        "true",
+				"_order":        "A-1",
+			} {
+				if got[key] != value {
+					t.Errorf("wrong %s: %v, expected %v", key, got[key], value)
+				}
+			}
+			if _, exist := got["full_message"]; exist {
+				t.Errorf("unexpected full_message")
+			}
+
+			// large message with the stack trace
+			rnd := rand.New(rand.NewSource(1))
+			noise := make([]byte, 6000)
+			for i := range noise {
+				noise[i] = byte('a' + rnd.Intn(26))
+			}
+			_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Critical|StackTrace).Setf("%s", noise))
+			got = s.recv(t)
+			if got["short_message"] != string(noise) || got["level"] != float64(2) ||
+				!strings.Contains(got["full_message"].(string), "TestGELFRecorder") {
+				t.Errorf("wrong large message")
+			}
+			if tc.network == "udp" {
+				<-s.chunks
+				if n := <-s.chunks; n < 2 {
+					t.Errorf("large message is not chunked")
+				}
+			}
+
+			flushLogger(t, l)
+			select {
+			case err := <-chErr:
+				t.Errorf(emsgUnexpectedError, err)
+			default:
+			}
+		})
+	}
+}
+
+func TestGELFRecorderTruncate(t *testing.T) {
+	s := newGELFServer(t, "udp")
+	defer s.closer.Close()
+
+	// up to 128 chunks of 88 bytes
+	r := SpawnGELFRecorder("udp", s.addr).Compression(GELFNone).ChunkSize(100)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	chErr := make(chan error, 16)
+	r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	noise := strings.Repeat("abcdefghij", 2000)
+	_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Critical|StackTrace).Setf("%s", noise))
+	got := s.recv(t)
+	short, _ := got["short_message"].(string)
+	full, _ := got["full_message"].(string)
+	if !strings.HasSuffix(short, gelfTruncatedMarker) ||
+		!strings.HasPrefix(noise, strings.TrimSuffix(short, gelfTruncatedMarker)) {
+		t.Errorf("wrong truncated short_message (%d bytes)", len(short))
+	}
+	if !strings.HasSuffix(full, gelfTruncatedMarker) {
+		t.Errorf("wrong truncated full_message (%d bytes)", len(full))
+	}
+	if n := <-s.chunks; n > gelfMaxChunks {
+		t.Errorf("too many chunks (%d)", n)
+	}
+	select {
+	case err := <-chErr:
+		t.Errorf(emsgUnexpectedError, err)
+	default:
+	}
+
+	if s := gelfTruncate("aaж", 3); s != "aa"+gelfTruncatedMarker {
+		t.Errorf("rune is cut: %q", s)
+	}
+}
+
+func TestGELFRecorderOffline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error\n%s", err.Error())
+	}
+	ln.Close() // nobody listens
+
+	r := NewGELFRecorder("tcp", ln.Addr().String()).Backoff(time.Hour, time.Hour)
+	if err := r.initialise(); err != nil {
+		t.Fatalf("initialisation fails without the server\n%s", err.Error())
+	}
+	msg := Message("message").SetFlags(Info)
+	if err := r.write(*msg); err == nil || !strings.Contains(err.Error(), errNotConnected.Error()) {
+		t.Errorf("reconnection backoff is not respected: %v", err)
+	}
+}
+
+func TestGELFChunks(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+	chunks, err := gelfChunks(data, 42) // 30 bytes of data per chunk
+	if err != nil {
+		t.Fatalf(emsgUnexpectedError, err)
+	}
+	if len(chunks) != 4 || len(chunks[3]) != 12+10 {
+		t.Fatalf("wrong chunks: %d", len(chunks))
+	}
+	for i, c := range chunks {
+		if c[0] != 0x1e || c[1] != 0x0f || !bytes.Equal(c[2:10], chunks[0][2:10]) ||
+			c[10] != byte(i) || c[11] != 4 {
+			t.Errorf("wrong chunk header: % x", c[:12])
+		}
+	}
+	if _, err := gelfChunks(make([]byte, 129*30), 42); err != errGELFTooLarge {
+		t.Errorf("too large message is accepted: %v", err)
+	}
+}
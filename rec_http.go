@@ -0,0 +1,571 @@
+package xlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+var _ LogRecorder = &httpRecorder{}
+
+// HTTPBodyFormat determines how the batch of messages is encoded.
+type HTTPBodyFormat uint8
+
+const (
+	JSONArray HTTPBodyFormat = iota // [{...},{...}], application/json
+	NDJSON                          // {...}\n{...}\n, application/x-ndjson
+)
+
+const (
+	defaultHTTPBatchSize   = 100
+	defaultHTTPInterval    = time.Second
+	defaultHTTPTimeout     = time.Second * 10
+	defaultHTTPMaxAttempts = 5
+	defaultHTTPMinBackoff  = time.Millisecond * 500
+	defaultHTTPMaxBackoff  = time.Second * 30
+	defaultHTTPQueueSize   = 16 // batches
+)
+
+// httpBatch is the encoded request body ready for sending.
+type httpBatch struct {
+	body        []byte
+	contentType string
+	count       int // number of messages
+	attempts    int
+}
+
+// httpEncoder encodes the batch of messages and returns the request body
+// (not compressed) and its content type.
+type httpEncoder func(msgs []LogMsg) ([]byte, string)
+
+type httpRecorder struct {
+	chCtl chan controlSignal
+	chMsg chan LogMsg
+	chErr chan<- error        // optional
+	chDbg chan<- debugMessage // optional
+
+	id          xid.ID
+	isListening bool_s // internal mutex
+	refCounter  int
+	encoder     httpEncoder // JSON array or NDJSON by default
+
+	pending    []LogMsg     // messages of the current batch
+	queue      []*httpBatch // batches waiting for sending
+	batchTimer *time.Timer
+	chBatch    <-chan time.Time
+	retryTimer *time.Timer
+	chRetry    <-chan time.Time
+	backoff    time.Duration
+	dropped    uint64 // atomic
+
+	sync.RWMutex
+	url         string
+	header      http.Header
+	bodyFormat  HTTPBodyFormat
+	gzip        bool
+	format      FormatFunc
+	client      *http.Client
+	batchSize   int
+	interval    time.Duration
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	queueSize   int
+}
+
+// NewHTTPRecorder allocates and returns a new HTTP recorder. It collects
+// messages and POSTs them to the URL in batches: when the batch is full
+// (100 messages by default) or when the interval since the first message
+// of the batch is passed (1s by default).
+//
+// Failed requests (network errors, 5xx and 429 responses) are retried with
+// exponential backoff, Retry-After header is respected. When the number of
+// attempts is exhausted or the server rejects the batch (other 4xx), the
+// batch is dropped and the error is sent to the error channel.
+func NewHTTPRecorder(url string) *httpRecorder {
+	r := new(httpRecorder)
+	r.encoder = r.encode
+	r.id = xid.NewWithTime(time.Now())
+	r.chCtl = make(chan controlSignal, 32)
+	r.chMsg = make(chan LogMsg, 64)
+	r.url = url
+	r.header = make(http.Header)
+	r.format = JSONFormatter
+	r.client = &http.Client{Timeout: defaultHTTPTimeout}
+	r.batchSize = defaultHTTPBatchSize
+	r.interval = defaultHTTPInterval
+	r.maxAttempts = defaultHTTPMaxAttempts
+	r.minBackoff = defaultHTTPMinBackoff
+	r.maxBackoff = defaultHTTPMaxBackoff
+	r.queueSize = defaultHTTPQueueSize
+	return r
+}
+
+// SpawnHTTPRecorder creates recorder and starts a listener.
+func SpawnHTTPRecorder(url string) *httpRecorder {
+	r := NewHTTPRecorder(url)
+	go r.Listen()
+	return r
+}
+
+// Intrf returns recorder's interface channels.
+func (R *httpRecorder) Intrf() RecorderInterface {
+	return RecorderInterface{R.chCtl, R.chMsg, R.id}
+}
+
+// GetID returns recorder's xid.
+func (R *httpRecorder) GetID() xid.ID {
+	return R.id
+}
+
+// Header sets the request header, e.g. Authorization.
+func (R *httpRecorder) Header(key, value string) *httpRecorder {
+	R.Lock()
+	R.header.Set(key, value)
+	R.Unlock()
+	return R
+}
+
+// BodyFormat sets the encoding of the batch (JSONArray by default).
+func (R *httpRecorder) BodyFormat(format HTTPBodyFormat) *httpRecorder {
+	R.Lock()
+	R.bodyFormat = format
+	R.Unlock()
+	return R
+}
+
+// Gzip enables compression of request bodies.
+func (R *httpRecorder) Gzip(enable bool) *httpRecorder {
+	R.Lock()
+	R.gzip = enable
+	R.Unlock()
+	return R
+}
+
+// FormatFunc sets the formatter of the batch items, it must return a JSON
+// object (JSONFormatter by default, see also JSONEncoder).
+func (R *httpRecorder) FormatFunc(f FormatFunc) *httpRecorder {
+	R.Lock()
+	R.format = f
+	R.Unlock()
+	return R
+}
+
+// Client sets the HTTP client (the default one has 10s timeout).
+func (R *httpRecorder) Client(client *http.Client) *httpRecorder {
+	R.Lock()
+	R.client = client
+	R.Unlock()
+	return R
+}
+
+// Batch sets the max number of messages in the request and the max time
+// the message waits for the batch to fill.
+func (R *httpRecorder) Batch(size int, interval time.Duration) *httpRecorder {
+	R.Lock()
+	R.batchSize = size
+	R.interval = interval
+	R.Unlock()
+	return R
+}
+
+// Retry sets the max number of attempts to send the batch (5 by default)
+// and the backoff delays (500ms and 30s by default). The delay requested
+// by the server (Retry-After) is respected, but not longer than max.
+func (R *httpRecorder) Retry(attempts int, min, max time.Duration) *httpRecorder {
+	R.Lock()
+	R.maxAttempts = attempts
+	R.minBackoff = min
+	R.maxBackoff = max
+	R.Unlock()
+	return R
+}
+
+// QueueSize sets the max number of batches waiting for sending (16 by
+// default). When the queue is full, the oldest batch is dropped.
+func (R *httpRecorder) QueueSize(size int) *httpRecorder {
+	R.Lock()
+	R.queueSize = size
+	R.Unlock()
+	return R
+}
+
+// DroppedMessages returns the number of messages which have been dropped
+// (the recorder gave up sending their batches).
+func (R *httpRecorder) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&R.dropped)
+}
+
+// -----------------------------------------------------------------------------
+
+func (R *httpRecorder) Listen() {
+	if R.isListening.Get() {
+		return
+	} else {
+		R.isListening.Set(true)
+		R._log("start listener...")
+	}
+
+	for {
+		select {
+		case sig := <-R.chCtl: // recv control signal
+			switch sig.stype {
+			case SigInit:
+				R._log("RECV INIT SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R._log("  chan: %v", respErrChan)
+				e := R.initialise()
+				R._log("  send response..")
+				respErrChan <- e
+				R._log("  done")
+			case SigClose:
+				R._log("RECV CLOSE SIGNAL")
+				R.close()
+			case SigFlush, SigReopen: // nothing to reopen
+				R._log("RECV %s SIGNAL", sig.stype)
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				R.seal()
+				if R.chRetry == nil {
+					R.sendQueue()
+				}
+				if n := len(R.queue); n > 0 {
+					respErrChan <- fmt.Errorf("http: %d batches are waiting for retry", n)
+				} else {
+					respErrChan <- nil
+				}
+			case SigStop:
+				R._log("RECV STOP SIGNAL")
+				R.isListening.Set(false)
+				R._log("stop listener...")
+				return
+
+			case SigSetErrChan:
+				R._log("RECV SET_ERR_CHAN SIGNAL")
+				R.chErr = sig.data.(chan<- error) // MAY PANIC
+			case SigSetDbgChan:
+				R._log("RECV SET_DBG_CHAN SIGNAL")
+				R.chDbg = sig.data.(chan<- debugMessage) // MAY PANIC
+			case SigDropErrChan:
+				R._log("RECV DROP_ERR_CHAN SIGNAL")
+				R.chErr = nil
+			case SigDropDbgChan:
+				R._log("RECV DROP_DBG_CHAN SIGNAL")
+				R.chDbg = nil
+
+			default:
+				R._log("ERROR: received unknown signal (%s)", sig.stype)
+				// DO NOTHING
+			}
+
+		case msg := <-R.chMsg: // write log message
+			R._log("RECV MSG SIGNAL <--\n  msg=%v", msg)
+			R.handle(msg)
+
+		case <-R.chBatch: // batch interval is passed
+			R.chBatch = nil
+			R.seal()
+			if R.chRetry == nil {
+				R.sendQueue()
+			}
+
+		case <-R.chRetry: // retry attempt
+			R.chRetry = nil
+			R.sendQueue()
+		}
+	}
+}
+
+// handle writes the message and reports an error if it occurs.
+func (R *httpRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		R.reportError(err)
+	}
+}
+
+func (R *httpRecorder) reportError(err error) {
+	if R.chErr != nil {
+		R.chErr <- err // MAY PANIC
+	}
+}
+
+// drain writes all messages which have been queued before the call.
+func (R *httpRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
+func (R *httpRecorder) IsListening() bool {
+	return R.isListening.Get() // rc safe
+}
+
+// ----------------------------------------
+
+func (R *httpRecorder) initialise() error {
+	if R.refCounter == 0 {
+		R.RLock()
+		u, err := url.Parse(R.url)
+		R.RUnlock()
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("http: unsupported URL scheme %q", u.Scheme)
+		}
+	}
+	R.refCounter++
+	return nil
+}
+
+func (R *httpRecorder) close() {
+	if R.refCounter == 0 {
+		return
+	}
+	if R.refCounter == 1 {
+		R.seal()
+		R.stopRetry()
+		R.backoff = 0
+		// the last attempt, without delays
+		for len(R.queue) > 0 {
+			b := R.queue[0]
+			R.queue = R.queue[1:]
+			if _, _, err := R.post(b); err != nil {
+				b.attempts++
+				R.giveUp(b, err)
+			}
+		}
+		R.queue = nil
+	}
+	R.refCounter--
+}
+
+// ----------------------------------------
+
+func (R *httpRecorder) write(msg LogMsg) error {
+	if R.refCounter == 0 {
+		return ErrNotInitialised
+	}
+	R.RLock()
+	size, interval := R.batchSize, R.interval
+	R.RUnlock()
+
+	R.pending = append(R.pending, msg)
+	if len(R.pending) == 1 && interval > 0 {
+		R.batchTimer = time.NewTimer(interval)
+		R.chBatch = R.batchTimer.C
+	}
+	if len(R.pending) >= size {
+		R.seal()
+		if R.chRetry == nil {
+			R.sendQueue()
+		}
+	}
+	return nil
+}
+
+// seal encodes the current batch and puts it to the queue.
+func (R *httpRecorder) seal() {
+	if R.batchTimer != nil {
+		R.batchTimer.Stop()
+		R.batchTimer = nil
+	}
+	R.chBatch = nil
+	if len(R.pending) == 0 {
+		return
+	}
+
+	body, contentType := R.encoder(R.pending)
+
+	R.RLock()
+	compress, queueSize := R.gzip, R.queueSize
+	R.RUnlock()
+
+	if compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+	}
+
+	b := &httpBatch{body: body, contentType: contentType, count: len(R.pending)}
+	R.queue = append(R.queue, b)
+	R.pending = nil
+	if queueSize > 0 && len(R.queue) > queueSize {
+		b := R.queue[0]
+		R.queue = R.queue[1:]
+		R.giveUp(b, fmt.Errorf("queue is full"))
+	}
+}
+
+// encode renders messages by the formatter as a JSON array or NDJSON.
+func (R *httpRecorder) encode(msgs []LogMsg) ([]byte, string) {
+	R.RLock()
+	format, bodyFormat := R.format, R.bodyFormat
+	R.RUnlock()
+
+	var buf bytes.Buffer
+	if bodyFormat == NDJSON {
+		for i := range msgs {
+			buf.WriteString(strings.TrimRight(format(&msgs[i]), "\n"))
+			buf.WriteByte('\n')
+		}
+		return buf.Bytes(), "application/x-ndjson"
+	}
+	buf.WriteByte('[')
+	for i := range msgs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strings.TrimRight(format(&msgs[i]), "\n"))
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), "application/json"
+}
+
+// sendQueue sends queued batches until the first failure, then it
+// schedules the retry.
+func (R *httpRecorder) sendQueue() {
+	R.RLock()
+	maxAttempts := R.maxAttempts
+	R.RUnlock()
+
+	for len(R.queue) > 0 {
+		b := R.queue[0]
+		retryAfter, retryable, err := R.post(b)
+		if err == nil {
+			R.queue = R.queue[1:]
+			R.backoff = 0
+			continue
+		}
+		b.attempts++
+		R._log("post error (attempt %d): %s", b.attempts, err.Error())
+		if !retryable || b.attempts >= maxAttempts {
+			R.queue = R.queue[1:]
+			R.giveUp(b, err)
+			continue
+		}
+		R.scheduleRetry(retryAfter)
+		return
+	}
+	R.queue = nil
+}
+
+// post sends the batch. For failed requests it says whether the request
+// can be retried and returns the delay requested by the server (if any).
+func (R *httpRecorder) post(b *httpBatch) (time.Duration, bool, error) {
+	R.RLock()
+	req, err := http.NewRequest("POST", R.url, bytes.NewReader(b.body))
+	if err != nil {
+		R.RUnlock()
+		return 0, false, err
+	}
+	for key, values := range R.header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	req.Header.Set("Content-Type", b.contentType)
+	if R.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	client := R.client
+	R.RUnlock()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return 0, false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return retryAfter(resp.Header.Get("Retry-After")), true,
+			fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return 0, false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// giveUp drops the batch and reports it.
+func (R *httpRecorder) giveUp(b *httpBatch, err error) {
+	atomic.AddUint64(&R.dropped, uint64(b.count))
+	R.reportError(fmt.Errorf("http: %d messages are dropped after %d attempts: %s",
+		b.count, b.attempts, err.Error()))
+}
+
+// scheduleRetry starts the retry timer, the server's delay has precedence
+// over the backoff (it's limited by the max backoff as well).
+func (R *httpRecorder) scheduleRetry(delay time.Duration) {
+	R.RLock()
+	min, max := R.minBackoff, R.maxBackoff
+	R.RUnlock()
+
+	R.backoff *= 2
+	if R.backoff < min {
+		R.backoff = min
+	}
+	if R.backoff > max {
+		R.backoff = max
+	}
+	if delay <= 0 {
+		delay = R.backoff
+	}
+	if delay > max {
+		delay = max
+	}
+	R.stopRetry()
+	R.retryTimer = time.NewTimer(delay)
+	R.chRetry = R.retryTimer.C
+}
+
+func (R *httpRecorder) stopRetry() {
+	if R.retryTimer != nil {
+		R.retryTimer.Stop()
+		R.retryTimer = nil
+	}
+	R.chRetry = nil
+}
+
+func (R *httpRecorder) _log(format string, args ...interface{}) { // MAY PANIC
+	if R.chDbg != nil {
+		msg := DbgMsg(R.id, format, args...)
+		msg.rtype = "httpRecorder"
+		R.chDbg <- msg
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// retryAfter parses Retry-After header value: delay in seconds or the date.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(value); err == nil {
+		if sec > int(math.MaxInt64/int64(time.Second)) { // overflow
+			return math.MaxInt64
+		}
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
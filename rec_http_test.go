@@ -0,0 +1,242 @@
+package xlog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// httpRequest is the request received by the test server.
+type httpRequest struct {
+	header http.Header
+	items  []map[string]interface{}
+	time   time.Time
+}
+
+// newHTTPServer starts the test server, the status function returns the
+// response status for the n-th request (starting from 0).
+func newHTTPServer(t *testing.T, status func(n int, w http.ResponseWriter) int) (*httptest.Server, chan httpRequest) {
+	requests := make(chan httpRequest, 64)
+	var mu sync.Mutex
+	n := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		code := status(n, w)
+		n++
+		mu.Unlock()
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("wrong gzip body\n%s", err.Error())
+				return
+			}
+			body = zr
+		}
+		data, _ := ioutil.ReadAll(body)
+		req := httpRequest{header: r.Header, time: time.Now()}
+		if r.Header.Get("Content-Type") == "application/x-ndjson" {
+			scanner := bufio.NewScanner(bytes.NewReader(data))
+			for scanner.Scan() {
+				var item map[string]interface{}
+				if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+					t.Errorf("wrong NDJSON line %q\n%s", scanner.Text(), err.Error())
+				}
+				req.items = append(req.items, item)
+			}
+		} else if err := json.Unmarshal(data, &req.items); err != nil {
+			t.Errorf("wrong JSON body %q\n%s", data, err.Error())
+		}
+		w.WriteHeader(code)
+		requests <- req
+	}))
+	return srv, requests
+}
+
+func recvHTTPRequest(t *testing.T, requests chan httpRequest) httpRequest {
+	select {
+	case req := <-requests:
+		return req
+	case <-time.After(time.Second * 5):
+		t.Fatalf("request is not received")
+		return httpRequest{}
+	}
+}
+
+func itemMessages(items []map[string]interface{}) string {
+	var msgs []string
+	for _, item := range items {
+		msgs = append(msgs, item["msg"].(string))
+	}
+	return strings.Join(msgs, ",")
+}
+
+func TestHTTPRecorder(t *testing.T) {
+	ok := func(int, http.ResponseWriter) int { return http.StatusOK }
+
+	t.Run("BatchSize", func(t *testing.T) {
+		srv, requests := newHTTPServer(t, ok)
+		defer srv.Close()
+
+		r := SpawnHTTPRecorder(srv.URL).Batch(3, time.Hour).Gzip(true).
+			Header("Authorization", "Bearer secret")
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		for _, s := range []string{"a", "b", "c", "d"} {
+			_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf(s))
+		}
+		req := recvHTTPRequest(t, requests)
+		if msgs := itemMessages(req.items); msgs != "a,b,c" {
+			t.Errorf("wrong batch: %s", msgs)
+		}
+		if req.header.Get("Authorization") != "Bearer secret" ||
+			req.header.Get("Content-Type") != "application/json" {
+			t.Errorf("wrong headers: %v", req.header)
+		}
+
+		flushLogger(t, l) // sends incomplete batch
+		if msgs := itemMessages(recvHTTPRequest(t, requests).items); msgs != "d" {
+			t.Errorf("wrong batch: %s", msgs)
+		}
+	})
+
+	t.Run("Interval", func(t *testing.T) {
+		srv, requests := newHTTPServer(t, ok)
+		defer srv.Close()
+
+		r := SpawnHTTPRecorder(srv.URL).Batch(100, time.Millisecond*50).BodyFormat(NDJSON)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf("a"))
+		_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf("b"))
+		req := recvHTTPRequest(t, requests)
+		if msgs := itemMessages(req.items); msgs != "a,b" {
+			t.Errorf("wrong batch: %s", msgs)
+		}
+		if req.header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("wrong content type: %s", req.header.Get("Content-Type"))
+		}
+	})
+
+	t.Run("Retry", func(t *testing.T) {
+		srv, requests := newHTTPServer(t, func(n int, w http.ResponseWriter) int {
+			switch n {
+			case 0:
+				return http.StatusServiceUnavailable
+			case 1:
+				w.Header().Set("Retry-After", "1")
+				return http.StatusTooManyRequests
+			default:
+				return http.StatusOK
+			}
+		})
+		defer srv.Close()
+
+		r := SpawnHTTPRecorder(srv.URL).Batch(1, 0).Retry(5, time.Millisecond, time.Second*2)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		chErr := make(chan error, 16)
+		r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf("a"))
+		recvHTTPRequest(t, requests)
+		limited := recvHTTPRequest(t, requests)
+		req := recvHTTPRequest(t, requests)
+		if msgs := itemMessages(req.items); msgs != "a" {
+			t.Errorf("wrong batch: %s", msgs)
+		}
+		if d := req.time.Sub(limited.time); d < time.Millisecond*900 {
+			t.Errorf("Retry-After is ignored (retried in %s)", d)
+		}
+		select {
+		case err := <-chErr:
+			t.Errorf(emsgUnexpectedError, err)
+		default:
+		}
+	})
+
+	t.Run("RetryAfterLimit", func(t *testing.T) {
+		srv, requests := newHTTPServer(t, func(n int, w http.ResponseWriter) int {
+			if n == 0 {
+				w.Header().Set("Retry-After", "3600")
+				return http.StatusTooManyRequests
+			}
+			return http.StatusOK
+		})
+		defer srv.Close()
+
+		r := SpawnHTTPRecorder(srv.URL).Batch(1, 0).Retry(5, time.Millisecond, time.Millisecond*10)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf("a"))
+		limited := recvHTTPRequest(t, requests)
+		req := recvHTTPRequest(t, requests)
+		if d := req.time.Sub(limited.time); d > time.Second {
+			t.Errorf("Retry-After is not limited by the max backoff (retried in %s)", d)
+		}
+		if d := retryAfter("99999999999999999999"); d > 0 {
+			t.Errorf("wrong delay for the huge value: %s", d)
+		}
+		if d := retryAfter("9999999999999"); d != math.MaxInt64 {
+			t.Errorf("delay overflow: %s", d)
+		}
+	})
+
+	t.Run("GiveUp", func(t *testing.T) {
+		srv, requests := newHTTPServer(t, func(n int, w http.ResponseWriter) int {
+			if n < 2 {
+				return http.StatusInternalServerError
+			}
+			return http.StatusBadRequest
+		})
+		defer srv.Close()
+
+		r := SpawnHTTPRecorder(srv.URL).Batch(2, 0).Retry(2, time.Millisecond, time.Millisecond)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		chErr := make(chan error, 16)
+		r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		for _, s := range []string{"a", "b", "c", "d"} {
+			_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf(s))
+		}
+		for i := 0; i < 3; i++ { // two attempts + rejected batch
+			recvHTTPRequest(t, requests)
+		}
+		for _, expected := range []string{
+			"http: 2 messages are dropped after 2 attempts: unexpected status 500 Internal Server Error",
+			"http: 2 messages are dropped after 1 attempts: unexpected status 400 Bad Request",
+		} {
+			select {
+			case err := <-chErr:
+				if err.Error() != expected {
+					t.Errorf("wrong error\n%s\nexpected:\n%s", err.Error(), expected)
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatalf("error is not reported")
+			}
+		}
+		if n := r.DroppedMessages(); n != 4 {
+			t.Errorf("wrong number of dropped messages: %d", n)
+		}
+	})
+}
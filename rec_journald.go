@@ -0,0 +1,458 @@
+//go:build linux
+// +build linux
+
+package xlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/rs/xid"
+)
+
+var _ LogRecorder = &journaldRecorder{}
+
+// default path of the journald native protocol socket
+const defaultJournalSocket = "/run/systemd/journal/socket"
+
+type journaldRecorder struct {
+	chCtl chan controlSignal
+	chMsg chan LogMsg
+	chErr chan<- error        // optional
+	chDbg chan<- debugMessage // optional
+
+	id          xid.ID
+	isListening bool_s // internal mutex
+	refCounter  int
+	conn        *net.UnixConn // unbound datagram socket
+
+	sync.RWMutex
+	socket     string
+	identifier string
+	format     FormatFunc
+
+	// syslog priority for each message severity
+	sevBindings map[MsgFlagT]syslog.Priority
+}
+
+// NewJournaldRecorder allocates and returns a new journald recorder. It
+// writes to the journal via the native protocol: the message content goes
+// to MESSAGE, severity to PRIORITY, message fields become uppercase journal
+// fields (e.g. "user_id" -> USER_ID, "message" -> F_MESSAGE, so they can't
+// override the recorder's own fields), caller information goes to CODE_FILE,
+// CODE_LINE and CODE_FUNC. The identifier (SYSLOG_IDENTIFIER) is the
+// executable name by default.
+func NewJournaldRecorder(identifier ...string) *journaldRecorder {
+	r := new(journaldRecorder)
+	r.id = xid.NewWithTime(time.Now())
+	r.chCtl = make(chan controlSignal, 32)
+	r.chMsg = make(chan LogMsg, 64)
+	r.socket = defaultJournalSocket
+	r.identifier = filepath.Base(os.Args[0])
+	if len(identifier) > 0 {
+		r.identifier = identifier[0]
+	}
+	r.sevBindings = defaultSyslogBindings()
+	return r
+}
+
+// SpawnJournaldRecorder creates recorder and starts a listener.
+func SpawnJournaldRecorder(identifier ...string) *journaldRecorder {
+	r := NewJournaldRecorder(identifier...)
+	go r.Listen()
+	return r
+}
+
+// Intrf returns recorder's interface channels.
+func (R *journaldRecorder) Intrf() RecorderInterface {
+	return RecorderInterface{R.chCtl, R.chMsg, R.id}
+}
+
+// GetID returns recorder's xid.
+func (R *journaldRecorder) GetID() xid.ID {
+	return R.id
+}
+
+// SocketPath sets the path of the journald socket
+// ("/run/systemd/journal/socket" by default).
+func (R *journaldRecorder) SocketPath(path string) *journaldRecorder {
+	R.Lock()
+	R.socket = path
+	R.Unlock()
+	return R
+}
+
+// FormatFunc sets custom formatter function for the MESSAGE field.
+func (R *journaldRecorder) FormatFunc(f FormatFunc) *journaldRecorder {
+	R.Lock()
+	R.format = f
+	R.Unlock()
+	return R
+}
+
+// BindSeverityFlag rebinds severity flag to the new syslog priority code.
+func (R *journaldRecorder) BindSeverityFlag(severity MsgFlagT, priority syslog.Priority) error {
+	severity = severity &^ SeverityShadowMask
+
+	R.Lock()
+	defer R.Unlock()
+
+	if _, exist := R.sevBindings[severity]; !exist {
+		return ErrWrongFlagValue
+	}
+	if !isSyslogSeverity(priority) {
+		return errWrongPriority
+	}
+	R.sevBindings[severity] = priority
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+
+func (R *journaldRecorder) Listen() {
+	if R.isListening.Get() {
+		return
+	} else {
+		R.isListening.Set(true)
+		R._log("start listener...")
+	}
+
+	for {
+		select {
+		case sig := <-R.chCtl: // recv control signal
+			switch sig.stype {
+			case SigInit:
+				R._log("RECV INIT SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R._log("  chan: %v", respErrChan)
+				e := R.initialise()
+				R._log("  send response..")
+				respErrChan <- e
+				R._log("  done")
+			case SigClose:
+				R._log("RECV CLOSE SIGNAL")
+				R.close()
+			case SigFlush, SigReopen: // nothing to reopen
+				R._log("RECV %s SIGNAL", sig.stype)
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				respErrChan <- nil
+			case SigStop:
+				R._log("RECV STOP SIGNAL")
+				R.isListening.Set(false)
+				R._log("stop listener...")
+				return
+
+			case SigSetErrChan:
+				R._log("RECV SET_ERR_CHAN SIGNAL")
+				R.chErr = sig.data.(chan<- error) // MAY PANIC
+			case SigSetDbgChan:
+				R._log("RECV SET_DBG_CHAN SIGNAL")
+				R.chDbg = sig.data.(chan<- debugMessage) // MAY PANIC
+			case SigDropErrChan:
+				R._log("RECV DROP_ERR_CHAN SIGNAL")
+				R.chErr = nil
+			case SigDropDbgChan:
+				R._log("RECV DROP_DBG_CHAN SIGNAL")
+				R.chDbg = nil
+
+			default:
+				R._log("ERROR: received unknown signal (%s)", sig.stype)
+				// DO NOTHING
+			}
+
+		case msg := <-R.chMsg: // write log message
+			R._log("RECV MSG SIGNAL <--\n  msg=%v", msg)
+			R.handle(msg)
+		}
+	}
+}
+
+// handle writes the message and reports an error if it occurs.
+func (R *journaldRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		if R.chErr != nil {
+			R.chErr <- err // MAY PANIC
+		}
+	}
+}
+
+// drain writes all messages which have been queued before the call.
+func (R *journaldRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
+func (R *journaldRecorder) IsListening() bool {
+	return R.isListening.Get() // rc safe
+}
+
+// ----------------------------------------
+
+func (R *journaldRecorder) initialise() error {
+	if R.refCounter == 0 {
+		// the socket is not connected, so journald restarts don't break it
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: "", Net: "unixgram"})
+		if err != nil {
+			return err
+		}
+		R.conn = conn
+	}
+	R.refCounter++
+	return nil
+}
+
+func (R *journaldRecorder) close() {
+	if R.refCounter == 0 {
+		return
+	}
+	if R.refCounter == 1 {
+		R.conn.Close()
+		R.conn = nil
+	}
+	R.refCounter--
+}
+
+// ----------------------------------------
+
+func (R *journaldRecorder) write(msg LogMsg) error {
+	if R.refCounter == 0 {
+		return ErrNotInitialised
+	}
+	data, err := R.entry(&msg)
+	if err != nil {
+		return err
+	}
+
+	R.RLock()
+	addr := &net.UnixAddr{Name: R.socket, Net: "unixgram"}
+	R.RUnlock()
+
+	_, _, err = R.conn.WriteMsgUnix(data, nil, addr)
+	if err == nil {
+		return nil
+	}
+	if !isMessageTooLarge(err) {
+		return fmt.Errorf("journald write fail: %s", err.Error())
+	}
+
+	// large entries are passed by the file descriptor
+	R._log("entry is too large (%d bytes), use memfd", len(data))
+	file, err := journalDataFile(data)
+	if err != nil {
+		return fmt.Errorf("journald write fail: %s", err.Error())
+	}
+	defer file.Close()
+	rights := syscall.UnixRights(int(file.Fd()))
+	if _, _, err := R.conn.WriteMsgUnix(nil, rights, addr); err != nil {
+		return fmt.Errorf("journald write fail: %s", err.Error())
+	}
+	return nil
+}
+
+// entry serializes the message by the journald native protocol.
+func (R *journaldRecorder) entry(msg *LogMsg) ([]byte, error) {
+	R.RLock()
+	defer R.RUnlock()
+
+	priority, exist := R.sevBindings[msg.flags&^SeverityShadowMask]
+	if !exist {
+		return nil, ErrWrongFlagValue
+	}
+	content := msg.text() // the stack trace is sent in STACK_TRACE
+	if R.format != nil {
+		content = R.format(msg)
+	} else if msg.logger != "" {
+		content = "[" + msg.logger + "] " + content
+	}
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", content)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(int(priority)))
+	if R.identifier != "" {
+		writeJournalField(&buf, "SYSLOG_IDENTIFIER", R.identifier)
+	}
+	if msg.caller.IsSet() {
+		writeJournalField(&buf, "CODE_FILE", msg.caller.File)
+		writeJournalField(&buf, "CODE_LINE", strconv.Itoa(msg.caller.Line))
+		writeJournalField(&buf, "CODE_FUNC", msg.caller.Func)
+	}
+	if msg.logger != "" {
+		writeJournalField(&buf, "LOGGER", msg.logger)
+	}
+	if msg.stack != "" {
+		writeJournalField(&buf, "STACK_TRACE", msg.stack)
+	}
+	for _, f := range msg.fields {
+		writeJournalField(&buf, journalFieldName(f.Key), f.String())
+	}
+	return buf.Bytes(), nil
+}
+
+func (R *journaldRecorder) _log(format string, args ...interface{}) { // MAY PANIC
+	if R.chDbg != nil {
+		msg := DbgMsg(R.id, format, args...)
+		msg.rtype = "journaldRecorder"
+		R.chDbg <- msg
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// writeJournalField writes KEY=value line, values with newlines are written
+// in the binary form: KEY\n, 64-bit little-endian length, value, \n.
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	buf.WriteString(key)
+	if strings.IndexByte(value, '\n') < 0 {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.Write(size[:])
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journal fields written by the recorder itself, message fields with these
+// names are prefixed so they don't override them
+var journalReservedFields = map[string]bool{
+	"MESSAGE":           true,
+	"PRIORITY":          true,
+	"SYSLOG_IDENTIFIER": true,
+	"CODE_FILE":         true,
+	"CODE_LINE":         true,
+	"CODE_FUNC":         true,
+	"LOGGER":            true,
+	"STACK_TRACE":       true,
+}
+
+// journalFieldName converts the key to the journal field name: uppercase
+// letters, digits and underscores, it can't start with a digit or an
+// underscore (such fields are trusted ones), up to 64 characters. Keys
+// which clash with reserved fields or start with a digit get F_ prefix.
+func journalFieldName(key string) string {
+	name := strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z':
+			return c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			return c
+		default:
+			return '_'
+		}
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') || journalReservedFields[name] {
+		name = "F_" + name
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+func isMessageTooLarge(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.EMSGSIZE || sysErr.Err == syscall.ENOBUFS
+		}
+	}
+	return false
+}
+
+// memfd_create syscall numbers (there is no constant in the syscall package
+// for all architectures), other architectures use the temporary file
+var memfdCreateTrap = map[string]uintptr{
+	"386":      356,
+	"amd64":    319,
+	"arm":      385,
+	"arm64":    279,
+	"loong64":  279,
+	"mips":     4354,
+	"mipsle":   4354,
+	"mips64":   5314,
+	"mips64le": 5314,
+	"ppc64":    360,
+	"ppc64le":  360,
+	"riscv64":  279,
+	"s390x":    350,
+}
+
+const (
+	mfdCloexec       = 0x1
+	mfdAllowSealing  = 0x2
+	fcntlAddSeals    = 1033
+	sealAll          = 0x1 | 0x2 | 0x4 | 0x8 // SEAL, SHRINK, GROW, WRITE
+	journalMemfdName = "xlog-journal"
+)
+
+// journalDataFile returns a sealed memfd with the data. If memfd is not
+// supported (unknown architecture, old kernel, no sealing), an unlinked
+// temporary file is used (journald accepts both).
+func journalDataFile(data []byte) (*os.File, error) {
+	if file, err := journalMemfd(data); err == nil {
+		return file, nil
+	}
+	return journalTempFile(data)
+}
+
+func journalMemfd(data []byte) (*os.File, error) {
+	trap, exist := memfdCreateTrap[runtime.GOARCH]
+	if !exist {
+		return nil, syscall.ENOSYS
+	}
+	name, _ := syscall.BytePtrFromString(journalMemfdName)
+	fd, _, errno := syscall.Syscall(trap,
+		uintptr(unsafe.Pointer(name)), mfdCloexec|mfdAllowSealing, 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	file := os.NewFile(fd, journalMemfdName)
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return nil, err
+	}
+	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, fd, fcntlAddSeals, sealAll)
+	if errno != 0 {
+		file.Close()
+		return nil, errno
+	}
+	return file, nil
+}
+
+func journalTempFile(data []byte) (*os.File, error) {
+	dir := "/dev/shm"
+	if _, err := os.Stat(dir); err != nil {
+		dir = ""
+	}
+	file, err := ioutil.TempFile(dir, journalMemfdName)
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
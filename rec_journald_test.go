@@ -0,0 +1,207 @@
+//go:build linux
+// +build linux
+
+package xlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// journalSocket is a test double for the journald native socket.
+type journalSocket struct {
+	path    string
+	conn    *net.UnixConn
+	entries chan map[string]string
+}
+
+func newJournalSocket(t *testing.T) *journalSocket {
+	dir, err := ioutil.TempDir("", "xlog-test")
+	if err != nil {
+		t.Fatalf("TempDir() error\n%s", err.Error())
+	}
+	path := filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("ListenUnixgram() error\n%s", err.Error())
+	}
+	s := &journalSocket{path: path, conn: conn, entries: make(chan map[string]string, 16)}
+	go s.serve(t)
+	return s
+}
+
+func (s *journalSocket) serve(t *testing.T) {
+	buf := make([]byte, 65536)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	for {
+		n, oobn, _, _, err := s.conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return
+		}
+		data := append([]byte(nil), buf[:n]...)
+		if oobn > 0 { // the entry is passed by the file descriptor
+			if data, err = readJournalFD(oob[:oobn]); err != nil {
+				t.Errorf("can't read the passed fd\n%s", err.Error())
+				continue
+			}
+		}
+		s.entries <- parseJournalEntry(data)
+	}
+}
+
+func (s *journalSocket) close() {
+	s.conn.Close()
+	os.RemoveAll(filepath.Dir(s.path))
+}
+
+func (s *journalSocket) recv(t *testing.T) map[string]string {
+	select {
+	case entry := <-s.entries:
+		return entry
+	case <-time.After(time.Second * 5):
+		t.Fatalf("entry is not received")
+		return nil
+	}
+}
+
+func readJournalFD(oob []byte) ([]byte, error) {
+	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	fds, err := syscall.ParseUnixRights(&cmsgs[0])
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(fds[0]), "journal-entry")
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(io.NewSectionReader(file, 0, info.Size()))
+}
+
+func parseJournalEntry(data []byte) map[string]string {
+	entry := make(map[string]string)
+	for len(data) > 0 {
+		n := bytes.IndexByte(data, '\n')
+		if n < 0 {
+			entry["PARSE_ERROR"] = string(data)
+			break
+		}
+		line := string(data[:n])
+		data = data[n+1:]
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			entry[line[:eq]] = line[eq+1:]
+			continue
+		}
+		size := binary.LittleEndian.Uint64(data[:8])
+		entry[line] = string(data[8 : 8+size])
+		data = data[8+size+1:]
+	}
+	return entry
+}
+
+func TestJournaldRecorder(t *testing.T) {
+	s := newJournalSocket(t)
+	defer s.close()
+
+	r := SpawnJournaldRecorder("xlog-test").SocketPath(s.path)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	chErr := make(chan error, 16)
+	r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	t.Run("Fields", func(t *testing.T) {
+		msg := NewLogMsg().SetFlags(Warning | Caller).Setf("disk is\nalmost full")
+		msg.Str("mount", "/var").Int("free-mb", 12).Str("_trusted", "no")
+		_ = l.WriteMsg(nil, msg)
+
+		entry := s.recv(t)
+		expected := map[string]string{
+			"MESSAGE":           "disk is\nalmost full",
+			"PRIORITY":          "4",
+			"SYSLOG_IDENTIFIER": "xlog-test",
+			"MOUNT":             "/var",
+			"FREE_MB":           "12",
+			"TRUSTED":           "no",
+		}
+		for key, value := range expected {
+			if entry[key] != value {
+				t.Errorf("wrong %s field: %q, expected %q", key, entry[key], value)
+			}
+		}
+		if !strings.HasSuffix(entry["CODE_FILE"], "rec_journald_test.go") ||
+			entry["CODE_LINE"] == "" ||
+			!strings.HasSuffix(entry["CODE_FUNC"], "TestJournaldRecorder.func2") {
+			t.Errorf("wrong caller fields: %s:%s %s",
+				entry["CODE_FILE"], entry["CODE_LINE"], entry["CODE_FUNC"])
+		}
+	})
+
+	t.Run("LargeEntry", func(t *testing.T) {
+		content := strings.Repeat("0123456789abcdef", 1<<16) // 1 MiB
+		_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Error).Setf("%s", content))
+
+		entry := s.recv(t)
+		if entry["MESSAGE"] != content || entry["PRIORITY"] != "3" {
+			t.Errorf("wrong large entry (%d bytes, priority %q)",
+				len(entry["MESSAGE"]), entry["PRIORITY"])
+		}
+	})
+
+	flushLogger(t, l)
+	select {
+	case err := <-chErr:
+		t.Errorf(emsgUnexpectedError, err)
+	default:
+	}
+}
+
+func TestJournalFieldName(t *testing.T) {
+	for key, expected := range map[string]string{
+		"user_id":               "USER_ID",
+		"Request.ID":            "REQUEST_ID",
+		"__cursor":              "CURSOR",
+		"1st":                   "F_1ST",
+		"message":               "F_MESSAGE",
+		"Priority":              "F_PRIORITY",
+		"code.line":             "F_CODE_LINE",
+		"message_id":            "MESSAGE_ID",
+		"":                      "F_",
+		strings.Repeat("a", 70): strings.Repeat("A", 64),
+	} {
+		if name := journalFieldName(key); name != expected {
+			t.Errorf("journalFieldName(%q) = %q, expected %q", key, name, expected)
+		}
+	}
+}
+
+func TestJournalDataFile(t *testing.T) {
+	data := []byte("MESSAGE=large entry\n")
+	for name, create := range map[string]func([]byte) (*os.File, error){
+		"DataFile": journalDataFile,
+		"TempFile": journalTempFile, // fallback
+	} {
+		file, err := create(data)
+		if err != nil {
+			t.Fatalf("%s: unexpected error\n%s", name, err.Error())
+		}
+		content, err := ioutil.ReadAll(io.NewSectionReader(file, 0, int64(len(data))*2))
+		file.Close()
+		if err != nil || !bytes.Equal(content, data) {
+			t.Errorf("%s: wrong content %q (%v)", name, content, err)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package xlog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ LogRecorder = &lokiRecorder{}
+
+// path of the Loki push API
+const lokiPushPath = "/loki/api/v1/push"
+
+// lokiRecorder is the HTTP recorder which sends batches in the format of
+// the Loki push API. Batching, retries, headers and compression are
+// configured by the httpRecorder's methods.
+type lokiRecorder struct {
+	*httpRecorder
+
+	// guarded by the httpRecorder's mutex
+	labels        map[string]string // static labels
+	loggerLabel   string
+	severityLabel string
+	fieldLabels   map[string]string // field key -> label name
+}
+
+// lokiStream is the stream of the push request.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"` // [unix ns, line]
+}
+
+// NewLokiRecorder allocates and returns a new Loki recorder. The URL is the
+// Loki address, the push API path is added if the URL has no path.
+//
+// Messages are grouped into streams by labels: the logger name ("logger"
+// label), the severity ("level" label: error, warning, info..., "custom" for
+// CustomB1 and CustomB2), static
+// labels and selected message fields. The line is the message content with
+// the rest of fields (or the FormatFunc result).
+func NewLokiRecorder(addr string) *lokiRecorder {
+	if u, err := url.Parse(addr); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = lokiPushPath
+		addr = u.String()
+	}
+	r := &lokiRecorder{httpRecorder: NewHTTPRecorder(addr)}
+	r.httpRecorder.encoder = r.encode
+	r.httpRecorder.format = nil
+	r.labels = make(map[string]string)
+	r.loggerLabel = "logger"
+	r.severityLabel = "level"
+	r.fieldLabels = make(map[string]string)
+	return r
+}
+
+// SpawnLokiRecorder creates recorder and starts a listener.
+func SpawnLokiRecorder(addr string) *lokiRecorder {
+	r := NewLokiRecorder(addr)
+	go r.Listen()
+	return r
+}
+
+// Label adds the static label to all streams, e.g. job="billing".
+func (R *lokiRecorder) Label(name, value string) *lokiRecorder {
+	R.Lock()
+	R.labels[lokiLabelName(name)] = value
+	R.Unlock()
+	return R
+}
+
+// LoggerLabel sets the name of the logger name label ("logger" by
+// default), an empty name disables the label.
+func (R *lokiRecorder) LoggerLabel(name string) *lokiRecorder {
+	R.Lock()
+	R.loggerLabel = lokiLabelName(name)
+	R.Unlock()
+	return R
+}
+
+// SeverityLabel sets the name of the severity label ("level" by default),
+// an empty name disables the label.
+func (R *lokiRecorder) SeverityLabel(name string) *lokiRecorder {
+	R.Lock()
+	R.severityLabel = lokiLabelName(name)
+	R.Unlock()
+	return R
+}
+
+// FieldLabel makes the label from the message field (the label name is
+// the field key by default). Such fields are not written to the line.
+// Use it only for fields with few distinct values (e.g. "component"),
+// every combination of labels is a separate stream in Loki.
+func (R *lokiRecorder) FieldLabel(key string, name ...string) *lokiRecorder {
+	label := key
+	if len(name) > 0 {
+		label = name[0]
+	}
+	R.Lock()
+	R.fieldLabels[key] = lokiLabelName(label)
+	R.Unlock()
+	return R
+}
+
+// TenantID sets the X-Scope-OrgID header for multi-tenant Loki.
+func (R *lokiRecorder) TenantID(id string) *lokiRecorder {
+	R.Header("X-Scope-OrgID", id)
+	return R
+}
+
+// Header sets the request header, e.g. Authorization.
+func (R *lokiRecorder) Header(key, value string) *lokiRecorder {
+	R.httpRecorder.Header(key, value)
+	return R
+}
+
+// Gzip enables compression of request bodies.
+func (R *lokiRecorder) Gzip(enable bool) *lokiRecorder {
+	R.httpRecorder.Gzip(enable)
+	return R
+}
+
+// FormatFunc sets the formatter of the log line (the content with the
+// caller and fields which are not labels by default).
+func (R *lokiRecorder) FormatFunc(f FormatFunc) *lokiRecorder {
+	R.httpRecorder.FormatFunc(f)
+	return R
+}
+
+// Client sets the HTTP client (the default one has 10s timeout).
+func (R *lokiRecorder) Client(client *http.Client) *lokiRecorder {
+	R.httpRecorder.Client(client)
+	return R
+}
+
+// Batch sets the max number of messages in the request and the max time
+// the message waits for the batch to fill.
+func (R *lokiRecorder) Batch(size int, interval time.Duration) *lokiRecorder {
+	R.httpRecorder.Batch(size, interval)
+	return R
+}
+
+// Retry sets the max number of attempts to send the batch (5 by default)
+// and the backoff delays (500ms and 30s by default).
+func (R *lokiRecorder) Retry(attempts int, min, max time.Duration) *lokiRecorder {
+	R.httpRecorder.Retry(attempts, min, max)
+	return R
+}
+
+// QueueSize sets the max number of batches waiting for sending (16 by
+// default). When the queue is full, the oldest batch is dropped.
+func (R *lokiRecorder) QueueSize(size int) *lokiRecorder {
+	R.httpRecorder.QueueSize(size)
+	return R
+}
+
+// ----------------------------------------
+
+// encode builds the push request, messages are grouped into streams by
+// labels.
+func (R *lokiRecorder) encode(msgs []LogMsg) ([]byte, string) {
+	R.RLock()
+	defer R.RUnlock()
+
+	// entries of the stream must be ordered by time
+	order := make([]int, len(msgs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return msgs[order[i]].time.Before(msgs[order[j]].time)
+	})
+
+	var streams []*lokiStream
+	index := make(map[string]*lokiStream)
+	for _, i := range order {
+		msg := &msgs[i]
+		labels := R.streamLabels(msg)
+		key := lokiStreamKey(labels)
+		stream, exist := index[key]
+		if !exist {
+			stream = &lokiStream{Stream: labels}
+			index[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.Values = append(stream.Values, [2]string{
+			strconv.FormatInt(msg.time.UnixNano(), 10), R.line(msg),
+		})
+	}
+	body, _ := json.Marshal(struct {
+		Streams []*lokiStream `json:"streams"`
+	}{streams})
+	return body, "application/json"
+}
+
+func (R *lokiRecorder) streamLabels(msg *LogMsg) map[string]string {
+	labels := make(map[string]string, len(R.labels)+2)
+	for name, value := range R.labels {
+		labels[name] = value
+	}
+	if R.loggerLabel != "" && msg.logger != "" {
+		labels[R.loggerLabel] = msg.logger
+	}
+	if R.severityLabel != "" {
+		labels[R.severityLabel] = lokiLevel(msg.flags)
+	}
+	for _, f := range msg.fields {
+		if name, exist := R.fieldLabels[f.Key]; exist {
+			labels[name] = f.String()
+		}
+	}
+	return labels
+}
+
+// lokiLevel returns the severity label value. Custom severities share
+// one value, so they don't make a stream per flag combination.
+func lokiLevel(flags MsgFlagT) string {
+	switch sev := flags &^ SeverityShadowMask; sev {
+	case Emerg, Alert, Critical, Error, Warning, Notice, Info, Debug:
+		return strings.ToLower(sev.String())
+	default:
+		return "custom"
+	}
+}
+
+// line returns the log line: "file.go:12: content key=value ...".
+func (R *lokiRecorder) line(msg *LogMsg) string {
+	if R.format != nil {
+		return R.format(msg)
+	}
+	line := msg.text()
+	if msg.caller.IsSet() {
+		line = msg.caller.String() + ": " + line
+	}
+	var fields []Field
+	for _, f := range msg.fields {
+		if _, exist := R.fieldLabels[f.Key]; !exist {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) > 0 {
+		line += " " + FormatFields(fields)
+	}
+	return withStackTrace(line, msg)
+}
+
+// -----------------------------------------------------------------------------
+
+// lokiStreamKey returns the unique key of the label set.
+func lokiStreamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteString("=")
+		sb.WriteString(strconv.Quote(labels[name]))
+		sb.WriteString(",")
+	}
+	return sb.String()
+}
+
+// lokiLabelName returns the valid label name: [a-zA-Z_][a-zA-Z0-9_]*.
+func lokiLabelName(name string) string {
+	name = strings.Map(func(c rune) rune {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+			return c
+		default:
+			return '_'
+		}
+	}, name)
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
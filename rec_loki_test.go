@@ -0,0 +1,117 @@
+package xlog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type lokiPush struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+func TestLokiRecorder(t *testing.T) {
+	type request struct {
+		path   string
+		tenant string
+		push   lokiPush
+	}
+	requests := make(chan request, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{path: r.URL.Path, tenant: r.Header.Get("X-Scope-OrgID")}
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &req.push); err != nil {
+			t.Errorf("wrong push request %q\n%s", data, err.Error())
+		}
+		w.WriteHeader(http.StatusNoContent)
+		requests <- req
+	}))
+	defer srv.Close()
+
+	r := SpawnLokiRecorder(srv.URL).Label("job", "test").
+		FieldLabel("component").FieldLabel("req-kind", "kind").Batch(4, time.Hour).TenantID("team-a")
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	newMsg := func(sev MsgFlagT, offset time.Duration, content string) *LogMsg {
+		msg := NewLogMsg().SetFlags(sev).Setf(content)
+		msg.time = stamp.Add(offset)
+		return msg
+	}
+	db := l.Named("db")
+	_ = db.WriteMsg(nil, newMsg(Error, time.Second, "b").Str("component", "pool").Int("conns", 0))
+	_ = db.WriteMsg(nil, newMsg(Error, 0, "a").Str("component", "pool").Str("req-kind", "rw"))
+	_ = db.WriteMsg(nil, newMsg(Error, 2*time.Second, "c").Str("component", "pool"))
+	_ = l.WriteMsg(nil, newMsg(Info, 0, "d"))
+
+	var req request
+	select {
+	case req = <-requests:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("request is not received")
+	}
+	if req.path != "/loki/api/v1/push" || req.tenant != "team-a" {
+		t.Errorf("wrong request: %s (tenant %q)", req.path, req.tenant)
+	}
+
+	expected := []lokiStream{
+		{
+			Stream: map[string]string{"job": "test", "logger": "db", "level": "error", "component": "pool", "kind": "rw"},
+			Values: [][2]string{{strconv.FormatInt(stamp.UnixNano(), 10), "a"}},
+		},
+		{
+			Stream: map[string]string{"job": "test", "level": "info"},
+			Values: [][2]string{{strconv.FormatInt(stamp.UnixNano(), 10), "d"}},
+		},
+		{
+			Stream: map[string]string{"job": "test", "logger": "db", "level": "error", "component": "pool"},
+			Values: [][2]string{
+				{strconv.FormatInt(stamp.Add(time.Second).UnixNano(), 10), "b conns=0"},
+				{strconv.FormatInt(stamp.Add(2*time.Second).UnixNano(), 10), "c"},
+			},
+		},
+	}
+	if got, _ := json.Marshal(req.push.Streams); string(got) != mustJSON(expected) {
+		t.Errorf("wrong streams\n%s\nexpected:\n%s", got, mustJSON(expected))
+	}
+}
+
+func mustJSON(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err.Error())
+	}
+	return string(data)
+}
+
+func TestLokiLabelName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"job":          "job",
+		"req-kind":     "req_kind",
+		"1st":          "_1st",
+		"service.name": "service_name",
+	} {
+		if got := lokiLabelName(name); got != expected {
+			t.Errorf("lokiLabelName(%q) = %q, expected %q", name, got, expected)
+		}
+	}
+}
+
+func TestLokiLevel(t *testing.T) {
+	for flags, expected := range map[MsgFlagT]string{
+		Error:               "error",
+		Critical | Caller:   "crit",
+		CustomB1:            "custom",
+		CustomB2 | CustomB3: "custom",
+	} {
+		if got := lokiLevel(flags); got != expected {
+			t.Errorf("lokiLevel(%s) = %q, expected %q", flags, got, expected)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package xlog
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+var _ LogRecorder = &netRecorder{}
+
+const (
+	defaultNetBufferSize   = 1024
+	defaultNetDialTimeout  = time.Second * 5
+	defaultNetWriteTimeout = time.Second * 5
+	defaultNetMinBackoff   = time.Millisecond * 100
+	defaultNetMaxBackoff   = time.Second * 30
+)
+
+type netRecorder struct {
+	chCtl chan controlSignal
+	chMsg chan LogMsg
+	chErr chan<- error        // optional
+	chDbg chan<- debugMessage // optional
+
+	id          xid.ID
+	isListening bool_s // internal mutex
+	refCounter  int
+	conn        net.Conn
+
+	// reconnection state (see rec_net_spool.go)
+	pending    [][]byte   // messages buffered while disconnected
+	spool      *diskSpool // older messages, optional
+	dropped    uint64     // atomic
+	unreported uint64     // dropped, but not reported yet
+	backoff    time.Duration
+	retryTimer *time.Timer
+	chRetry    <-chan time.Time
+
+	sync.RWMutex
+	network      string
+	addr         string
+	format       FormatFunc
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	bufferSize   int
+	framing      NetFraming
+	spoolPath    string
+	spoolLimit   int64
+}
+
+// NetFraming is the way the network recorder separates messages in the TCP
+// stream. UDP datagrams always carry one message as is.
+type NetFraming int
+
+const (
+	NewlineFraming       NetFraming = iota // one message per line, line breaks are escaped
+	OctetCountingFraming                   // MSG-LEN SP MSG (RFC 6587), messages are sent as is
+)
+
+// NewNetRecorder allocates and returns a new network recorder, it sends
+// formatted messages to the remote collector. The network is "tcp" (one
+// message per line by default, see Framing) or "udp" (one message per
+// datagram).
+//
+// When the connection fails (or the collector is down at initialisation),
+// the recorder reconnects with exponential backoff and buffers messages in
+// memory meanwhile. If the disk spool is enabled, messages which don't fit
+// the buffer are moved to the spool. After the reconnection all buffered
+// messages are sent in order.
+func NewNetRecorder(network, addr string) *netRecorder {
+	r := new(netRecorder)
+	r.id = xid.NewWithTime(time.Now())
+	r.chCtl = make(chan controlSignal, 32)
+	r.chMsg = make(chan LogMsg, 64)
+	r.network = network
+	r.addr = addr
+	r.format = IoDirectDefaultFormatter
+	r.dialTimeout = defaultNetDialTimeout
+	r.writeTimeout = defaultNetWriteTimeout
+	r.minBackoff = defaultNetMinBackoff
+	r.maxBackoff = defaultNetMaxBackoff
+	r.bufferSize = defaultNetBufferSize
+	return r
+}
+
+// SpawnNetRecorder creates recorder and starts a listener.
+func SpawnNetRecorder(network, addr string) *netRecorder {
+	r := NewNetRecorder(network, addr)
+	go r.Listen()
+	return r
+}
+
+// Intrf returns recorder's interface channels.
+func (R *netRecorder) Intrf() RecorderInterface {
+	return RecorderInterface{R.chCtl, R.chMsg, R.id}
+}
+
+// GetID returns recorder's xid.
+func (R *netRecorder) GetID() xid.ID {
+	return R.id
+}
+
+// FormatFunc sets custom formatter function (IoDirectDefaultFormatter by
+// default), e.g. JSONFormatter.
+func (R *netRecorder) FormatFunc(f FormatFunc) *netRecorder {
+	R.Lock()
+	R.format = f
+	R.Unlock()
+	return R
+}
+
+// Framing sets the TCP framing (NewlineFraming by default). With the newline
+// framing line breaks inside the message (e.g. stack traces) are replaced
+// with "\n" and "\r" sequences, so the message stays a single line.
+func (R *netRecorder) Framing(f NetFraming) *netRecorder {
+	R.Lock()
+	R.framing = f
+	R.Unlock()
+	return R
+}
+
+// Timeouts sets timeouts for connection and writing (5s by default).
+func (R *netRecorder) Timeouts(dial, write time.Duration) *netRecorder {
+	R.Lock()
+	R.dialTimeout = dial
+	R.writeTimeout = write
+	R.Unlock()
+	return R
+}
+
+// Backoff sets the minimum and maximum delays between reconnection
+// attempts (100ms and 30s by default). The delay doubles after each
+// failed attempt.
+func (R *netRecorder) Backoff(min, max time.Duration) *netRecorder {
+	R.Lock()
+	R.minBackoff = min
+	R.maxBackoff = max
+	R.Unlock()
+	return R
+}
+
+// BufferSize sets the number of messages which are kept in memory while
+// the recorder is disconnected (1024 by default).
+func (R *netRecorder) BufferSize(size int) *netRecorder {
+	R.Lock()
+	R.bufferSize = size
+	R.Unlock()
+	return R
+}
+
+// Spool enables the disk queue: when the memory buffer is full, the oldest
+// messages are moved to the file instead of being dropped. The maxSize
+// limits the file size (0 means no limit). Messages left in the spool are
+// sent after the next initialisation, so they survive the restart (but
+// some of them can be sent twice if the process stops during the replay).
+func (R *netRecorder) Spool(path string, maxSize int64) *netRecorder {
+	R.Lock()
+	R.spoolPath = path
+	R.spoolLimit = maxSize
+	R.Unlock()
+	return R
+}
+
+// DroppedMessages returns the number of messages which have been dropped
+// because the buffer (and the spool) was full.
+func (R *netRecorder) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&R.dropped)
+}
+
+// -----------------------------------------------------------------------------
+
+func (R *netRecorder) Listen() {
+	if R.isListening.Get() {
+		return
+	} else {
+		R.isListening.Set(true)
+		R._log("start listener...")
+	}
+
+	for {
+		select {
+		case sig := <-R.chCtl: // recv control signal
+			switch sig.stype {
+			case SigInit:
+				R._log("RECV INIT SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R._log("  chan: %v", respErrChan)
+				e := R.initialise()
+				R._log("  send response..")
+				respErrChan <- e
+				R._log("  done")
+			case SigClose:
+				R._log("RECV CLOSE SIGNAL")
+				R.close()
+			case SigFlush, SigReopen: // nothing to reopen
+				R._log("RECV %s SIGNAL", sig.stype)
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				if R.backlogged() {
+					respErrChan <- fmt.Errorf("net: %d messages are buffered while disconnected", len(R.pending)+R.spool.count())
+				} else {
+					respErrChan <- nil
+				}
+			case SigStop:
+				R._log("RECV STOP SIGNAL")
+				R.isListening.Set(false)
+				R._log("stop listener...")
+				return
+
+			case SigSetErrChan:
+				R._log("RECV SET_ERR_CHAN SIGNAL")
+				R.chErr = sig.data.(chan<- error) // MAY PANIC
+			case SigSetDbgChan:
+				R._log("RECV SET_DBG_CHAN SIGNAL")
+				R.chDbg = sig.data.(chan<- debugMessage) // MAY PANIC
+			case SigDropErrChan:
+				R._log("RECV DROP_ERR_CHAN SIGNAL")
+				R.chErr = nil
+			case SigDropDbgChan:
+				R._log("RECV DROP_DBG_CHAN SIGNAL")
+				R.chDbg = nil
+
+			default:
+				R._log("ERROR: received unknown signal (%s)", sig.stype)
+				// DO NOTHING
+			}
+
+		case msg := <-R.chMsg: // write log message
+			R._log("RECV MSG SIGNAL <--\n  msg=%v", msg)
+			R.handle(msg)
+
+		case <-R.chRetry: // reconnection attempt
+			R._log("reconnect")
+			R.retry()
+		}
+	}
+}
+
+// handle writes the message and reports an error if it occurs.
+func (R *netRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		R.reportError(err)
+	}
+}
+
+func (R *netRecorder) reportError(err error) {
+	if R.chErr != nil {
+		R.chErr <- err // MAY PANIC
+	}
+}
+
+// drain writes all messages which have been queued before the call.
+func (R *netRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
+func (R *netRecorder) IsListening() bool {
+	return R.isListening.Get() // rc safe
+}
+
+// ----------------------------------------
+
+func (R *netRecorder) initialise() error {
+	if R.refCounter == 0 {
+		R.RLock()
+		network, path, limit := R.network, R.spoolPath, R.spoolLimit
+		R.RUnlock()
+		switch network {
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("net: unsupported network %q", network)
+		}
+		if path != "" {
+			spool, err := openSpool(path, limit)
+			if err != nil {
+				return err
+			}
+			R.spool = spool
+		}
+		if err := R.connect(); err != nil {
+			// the collector may be down, messages are buffered meanwhile
+			R._log("connect fail: %s", err.Error())
+			R.scheduleRetry()
+		} else if R.backlogged() { // left from the previous run
+			R._log("replay %d spooled messages", R.spool.count())
+			R.replay()
+		}
+	}
+	R.refCounter++
+	return nil
+}
+
+func (R *netRecorder) close() {
+	if R.refCounter == 0 {
+		return
+	}
+	if R.refCounter == 1 {
+		if R.backlogged() { // the last chance to deliver them
+			R.stopRetry()
+			R.retry()
+		}
+		R.stopRetry()
+		R.backoff = 0
+		R.closeBacklog()
+		R.closeConn()
+	}
+	R.refCounter--
+}
+
+func (R *netRecorder) connect() error {
+	R.RLock()
+	network, addr, timeout := R.network, R.addr, R.dialTimeout
+	R.RUnlock()
+
+	R._log("dial %s %s", network, addr)
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return err
+	}
+	R.conn = conn
+	return nil
+}
+
+// ----------------------------------------
+
+func (R *netRecorder) write(msg LogMsg) error {
+	if R.refCounter == 0 {
+		return ErrNotInitialised
+	}
+	data := R.message(&msg)
+	if R.conn == nil || R.backlogged() { // keep the order
+		R.buffer(data)
+		return nil
+	}
+	if err := R.send(data); err != nil {
+		R.disconnect()
+		R.buffer(data)
+		return fmt.Errorf("net write fail: %s", err.Error())
+	}
+	return nil
+}
+
+// send writes the message with the transport framing.
+func (R *netRecorder) send(data []byte) error {
+	R.RLock()
+	timeout, network, framing := R.writeTimeout, R.network, R.framing
+	R.RUnlock()
+
+	switch {
+	case strings.HasPrefix(network, "udp"):
+	case framing == OctetCountingFraming:
+		data = append([]byte(strconv.Itoa(len(data))+" "), data...)
+	default:
+		data = append([]byte(netLineEscaper.Replace(string(data))), '\n')
+	}
+	if timeout > 0 {
+		R.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err := R.conn.Write(data)
+	return err
+}
+
+// netLineEscaper keeps the message in a single line for the newline framing.
+var netLineEscaper = strings.NewReplacer("\r", `\r`, "\n", `\n`)
+
+// message formats the message, the result doesn't contain the framing.
+func (R *netRecorder) message(msg *LogMsg) []byte {
+	R.RLock()
+	format := R.format
+	R.RUnlock()
+
+	var data string
+	if format != nil {
+		data = format(msg)
+	} else {
+		data = msg.content
+	}
+	return []byte(strings.TrimRight(data, "\n"))
+}
+
+func (R *netRecorder) _log(format string, args ...interface{}) { // MAY PANIC
+	if R.chDbg != nil {
+		msg := DbgMsg(R.id, format, args...)
+		msg.rtype = "netRecorder"
+		R.chDbg <- msg
+	}
+}
@@ -0,0 +1,306 @@
+package xlog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// While the network recorder is disconnected, messages are kept in the
+// memory buffer. When the buffer is full, the oldest messages are moved to
+// the disk spool (if it's enabled) or dropped. So the spool always holds
+// older messages than the buffer, and the replay sends the spool first.
+// New messages are buffered until the backlog is empty to keep the order.
+
+var errSpoolFull = errors.New("spool is full")
+
+// disconnect closes the connection and schedules the reconnection.
+func (R *netRecorder) disconnect() {
+	R.closeConn()
+	R.scheduleRetry()
+}
+
+func (R *netRecorder) closeConn() {
+	if R.conn != nil {
+		R.conn.Close()
+		R.conn = nil
+	}
+}
+
+// backlogged says whether there are messages waiting for the replay.
+func (R *netRecorder) backlogged() bool {
+	return len(R.pending) > 0 || R.spool.count() > 0
+}
+
+// buffer keeps the message until the reconnection.
+func (R *netRecorder) buffer(data []byte) {
+	R.RLock()
+	size := R.bufferSize
+	R.RUnlock()
+
+	R.pending = append(R.pending, data)
+	for len(R.pending) > size && len(R.pending) > 0 {
+		if R.spool != nil {
+			err := R.spool.push(R.pending[0])
+			if err == nil {
+				R.pending = R.pending[1:]
+				continue
+			}
+			if err != errSpoolFull {
+				R.reportError(fmt.Errorf("net spool write fail: %s", err.Error()))
+			}
+		}
+		R.pending = R.pending[1:]
+		R.drop(1)
+	}
+}
+
+func (R *netRecorder) drop(n int) {
+	atomic.AddUint64(&R.dropped, uint64(n))
+	R.unreported += uint64(n)
+}
+
+func (R *netRecorder) scheduleRetry() {
+	R.RLock()
+	min, max := R.minBackoff, R.maxBackoff
+	R.RUnlock()
+
+	R.backoff *= 2
+	if R.backoff < min {
+		R.backoff = min
+	}
+	if R.backoff > max {
+		R.backoff = max
+	}
+	R.stopRetry()
+	R.retryTimer = time.NewTimer(R.backoff)
+	R.chRetry = R.retryTimer.C
+}
+
+func (R *netRecorder) stopRetry() {
+	if R.retryTimer != nil {
+		R.retryTimer.Stop()
+		R.retryTimer = nil
+	}
+	R.chRetry = nil
+}
+
+// retry reconnects and sends buffered messages.
+func (R *netRecorder) retry() {
+	R.chRetry = nil
+	if R.refCounter == 0 || R.conn != nil {
+		return
+	}
+	if err := R.connect(); err != nil {
+		R.scheduleRetry()
+		R.reportError(fmt.Errorf("net reconnect fail: %s", err.Error()))
+		return
+	}
+	R._log("reconnected, %d messages are buffered", len(R.pending)+R.spool.count())
+	R.backoff = 0
+	R.replay()
+}
+
+// replay sends the drop report, spooled and buffered messages in order.
+func (R *netRecorder) replay() {
+	if R.unreported > 0 {
+		msg := NewLogMsg().SetFlags(Warning).
+			Setf("xlog: %d messages dropped while disconnected", R.unreported)
+		msg.Uint("dropped", R.unreported)
+		if err := R.send(R.message(msg)); err != nil {
+			R.disconnect()
+			R.reportError(fmt.Errorf("net write fail: %s", err.Error()))
+			return
+		}
+		R.unreported = 0
+	}
+	for R.spool.count() > 0 {
+		data, err := R.spool.next()
+		if err != nil { // the spool is broken, don't try it again
+			R.reportError(fmt.Errorf("net spool read fail: %s", err.Error()))
+			R.drop(R.spool.count())
+			R.spool.reset()
+			break
+		}
+		if err := R.send(data); err != nil {
+			R.disconnect()
+			R.reportError(fmt.Errorf("net write fail: %s", err.Error()))
+			return
+		}
+		R.spool.advance(data)
+	}
+	for len(R.pending) > 0 {
+		if err := R.send(R.pending[0]); err != nil {
+			R.disconnect()
+			R.reportError(fmt.Errorf("net write fail: %s", err.Error()))
+			return
+		}
+		R.pending = R.pending[1:]
+	}
+	R.pending = nil
+}
+
+// closeBacklog saves buffered messages to the spool (if it's enabled) and
+// closes it. Messages which can't be saved are lost.
+func (R *netRecorder) closeBacklog() {
+	if R.spool != nil {
+		for len(R.pending) > 0 {
+			if err := R.spool.push(R.pending[0]); err != nil {
+				break
+			}
+			R.pending = R.pending[1:]
+		}
+		if err := R.spool.close(); err != nil {
+			R.reportError(fmt.Errorf("net spool close fail: %s", err.Error()))
+		}
+		R.spool = nil
+	}
+	if n := len(R.pending); n > 0 {
+		R.drop(n)
+		R.reportError(fmt.Errorf("net: %d buffered messages are lost on close", n))
+	}
+	R.pending = nil
+}
+
+// -----------------------------------------------------------------------------
+
+// diskSpool is a file queue of messages. Each record is a message with
+// 32-bit big-endian length prefix. Records are appended to the end and read
+// from the offset, the file is truncated when all records are read.
+type diskSpool struct {
+	file    *os.File
+	path    string
+	limit   int64 // max file size, 0 - no limit
+	size    int64
+	offset  int64 // the first unread record
+	records int
+}
+
+// openSpool opens the spool file and counts records left in it. A partial
+// record at the end (e.g. after a crash) is truncated.
+func openSpool(path string, limit int64) (*diskSpool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	S := &diskSpool{file: file, path: path, limit: limit}
+
+	var hdr [4]byte
+	for S.size+4 <= info.Size() {
+		if _, err := file.ReadAt(hdr[:], S.size); err != nil {
+			break
+		}
+		next := S.size + 4 + int64(binary.BigEndian.Uint32(hdr[:]))
+		if next > info.Size() {
+			break
+		}
+		S.size = next
+		S.records++
+	}
+	if S.size != info.Size() {
+		if err := file.Truncate(S.size); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return S, nil
+}
+
+// count returns the number of unread records (nil spool is empty).
+func (S *diskSpool) count() int {
+	if S == nil {
+		return 0
+	}
+	return S.records
+}
+
+// push appends the record, it returns errSpoolFull if the size limit
+// would be exceeded.
+func (S *diskSpool) push(data []byte) error {
+	if S.limit > 0 && S.size+4+int64(len(data)) > S.limit {
+		return errSpoolFull
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	if _, err := S.file.WriteAt(buf, S.size); err != nil {
+		S.file.Truncate(S.size) // drop the partial record
+		return err
+	}
+	S.size += int64(len(buf))
+	S.records++
+	return nil
+}
+
+// next returns the first unread record, it doesn't remove it.
+func (S *diskSpool) next() ([]byte, error) {
+	if S.records == 0 {
+		return nil, io.EOF
+	}
+	var hdr [4]byte
+	if _, err := S.file.ReadAt(hdr[:], S.offset); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(hdr[:]))
+	if _, err := S.file.ReadAt(data, S.offset+4); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// advance removes the record returned by next.
+func (S *diskSpool) advance(data []byte) {
+	S.offset += 4 + int64(len(data))
+	S.records--
+	if S.records == 0 {
+		S.reset()
+	}
+}
+
+// reset removes all records.
+func (S *diskSpool) reset() {
+	S.file.Truncate(0)
+	S.size, S.offset, S.records = 0, 0, 0
+}
+
+// close removes read records from the file and closes it.
+func (S *diskSpool) close() error {
+	if S.offset > 0 {
+		if err := S.compact(); err != nil {
+			S.file.Close()
+			return err
+		}
+	}
+	return S.file.Close()
+}
+
+// compact rewrites unread records to the beginning of the file.
+func (S *diskSpool) compact() error {
+	tmp, err := os.OpenFile(S.path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(S.file, S.offset, S.size-S.offset))
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(S.path+".tmp", S.path)
+	}
+	if err != nil {
+		os.Remove(S.path + ".tmp")
+		return err
+	}
+	S.size -= S.offset
+	S.offset = 0
+	return nil
+}
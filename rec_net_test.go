@@ -0,0 +1,386 @@
+package xlog
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lineCollector is a test double for the remote collector, it receives
+// lines (or octet-counted frames) over TCP or datagrams over UDP.
+type lineCollector struct {
+	network string
+	addr    string
+	octets  bool
+	lines   chan string
+
+	mu    sync.Mutex
+	ln    net.Listener
+	pconn net.PacketConn
+	conns []net.Conn
+}
+
+func newLineCollector(t *testing.T, network string) *lineCollector {
+	c := &lineCollector{network: network, addr: "127.0.0.1:0", lines: make(chan string, 1024)}
+	c.start(t)
+	return c
+}
+
+func (c *lineCollector) start(t *testing.T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.network == "udp" {
+		pconn, err := net.ListenPacket("udp", c.addr)
+		if err != nil {
+			t.Fatalf("ListenPacket() error\n%s", err.Error())
+		}
+		c.pconn, c.addr = pconn, pconn.LocalAddr().String()
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, _, err := pconn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				c.lines <- string(buf[:n])
+			}
+		}()
+		return
+	}
+
+	ln, err := net.Listen("tcp", c.addr)
+	if err != nil {
+		t.Fatalf("Listen() error\n%s", err.Error())
+	}
+	c.ln, c.addr = ln, ln.Addr().String()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			if c.ln != ln { // stopped
+				c.mu.Unlock()
+				conn.Close()
+				return
+			}
+			c.conns = append(c.conns, conn)
+			c.mu.Unlock()
+			go func() {
+				if c.octets {
+					r := bufio.NewReader(conn)
+					for {
+						var n int
+						if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+							return
+						}
+						frame := make([]byte, n)
+						if _, err := io.ReadFull(r, frame); err != nil {
+							return
+						}
+						c.lines <- string(frame)
+					}
+				}
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					c.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+}
+
+func (c *lineCollector) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.pconn != nil {
+		c.pconn.Close()
+	}
+	if c.ln != nil {
+		c.ln.Close()
+		c.ln = nil
+	}
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.conns = nil
+}
+
+func (c *lineCollector) recv(t *testing.T) string {
+	select {
+	case line := <-c.lines:
+		return line
+	case <-time.After(time.Second * 5):
+		t.Fatalf("line is not received")
+		return ""
+	}
+}
+
+// waitBacklog flushes the logger until the recorder sends its backlog.
+func waitBacklog(t *testing.T, l *Logger) {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := l.Flush(ctx)
+		cancel()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backlog is not sent\n%s", err.Error())
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+// disconnectRecorder stops the collector and writes messages until the
+// recorder notices the lost connection.
+func disconnectRecorder(t *testing.T, l *Logger, c *lineCollector, chErr chan error) {
+	c.stop()
+	deadline := time.After(time.Second * 5)
+	for {
+		_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf("probe"))
+		select {
+		case err := <-chErr:
+			if !strings.Contains(err.Error(), "net write fail") {
+				t.Fatalf(emsgUnexpectedError, err)
+			}
+			return
+		case <-deadline:
+			t.Fatalf("disconnection is not detected")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+}
+
+func TestNetRecorder(t *testing.T) {
+	contentOnly := func(msg *LogMsg) string { return msg.GetContent() }
+
+	for _, network := range []string{"tcp", "udp"} {
+		t.Run(network, func(t *testing.T) {
+			c := newLineCollector(t, network)
+			defer c.stop()
+
+			r := SpawnNetRecorder(network, c.addr).FormatFunc(JSONFormatter)
+			defer func() { r.Intrf().ChCtl <- SignalStop() }()
+			l := newTestLogger(t, r.Intrf())
+			defer l.Close()
+
+			for i := 0; i < 3; i++ {
+				_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Warning).Setf("line\n%d", i).Int("n", i))
+				var obj map[string]interface{}
+				line := c.recv(t)
+				if err := json.Unmarshal([]byte(line), &obj); err != nil {
+					t.Fatalf("wrong JSON line %q\n%s", line, err.Error())
+				}
+				if obj["msg"] != fmt.Sprintf("line\n%d", i) || obj["fields"].(map[string]interface{})["n"] != float64(i) {
+					t.Errorf("wrong message: %s", line)
+				}
+			}
+		})
+	}
+
+	t.Run("Framing", func(t *testing.T) {
+		for _, framing := range []NetFraming{NewlineFraming, OctetCountingFraming} {
+			c := &lineCollector{network: "tcp", addr: "127.0.0.1:0",
+				octets: framing == OctetCountingFraming, lines: make(chan string, 16)}
+			c.start(t)
+			r := SpawnNetRecorder("tcp", c.addr).FormatFunc(contentOnly).Framing(framing)
+			l := newTestLogger(t, r.Intrf())
+
+			_ = l.WriteMsg(nil, NewLogMsg().Setf("panic: oops\r\n\tmain.go:10\n"))
+			_ = l.WriteMsg(nil, NewLogMsg().Setf("next"))
+			expected := "panic: oops\\r\\n\tmain.go:10"
+			if framing == OctetCountingFraming {
+				expected = "panic: oops\r\n\tmain.go:10"
+			}
+			if line := c.recv(t); line != expected {
+				t.Errorf("wrong message (framing %d): %q", framing, line)
+			}
+			if line := c.recv(t); line != "next" {
+				t.Errorf("wrong message (framing %d): %q", framing, line)
+			}
+			l.Close()
+			r.Intrf().ChCtl <- SignalStop()
+			c.stop()
+		}
+	})
+
+	t.Run("Reconnect", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "xlog-test")
+		if err != nil {
+			t.Fatalf("TempDir() error\n%s", err.Error())
+		}
+		defer os.RemoveAll(dir)
+		c := newLineCollector(t, "tcp")
+		defer c.stop()
+
+		r := SpawnNetRecorder("tcp", c.addr).FormatFunc(contentOnly).
+			Backoff(time.Millisecond*10, time.Millisecond*50).
+			BufferSize(3).Spool(filepath.Join(dir, "spool"), 0)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		chErr := make(chan error, 1024)
+		r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		disconnectRecorder(t, l, c, chErr)
+		for i := 0; i < 10; i++ {
+			_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf("msg %d", i))
+		}
+		c.start(t)
+		waitBacklog(t, l)
+		_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf("after"))
+
+		// the failed probe is buffered, so it's sent before the messages
+		expected := []string{"probe"}
+		for i := 0; i < 10; i++ {
+			expected = append(expected, fmt.Sprintf("msg %d", i))
+		}
+		expected = append(expected, "after")
+		for i := 0; i < len(expected); {
+			line := c.recv(t)
+			if i == 0 && line == "probe" {
+				continue // probes before the failed one could be received
+			}
+			if i == 0 {
+				i++ // the failed probe could be received as well
+			}
+			if line != expected[i] {
+				t.Fatalf("wrong order: %q, expected %q", line, expected[i])
+			}
+			i++
+		}
+		if n := r.DroppedMessages(); n != 0 {
+			t.Errorf("%d messages are dropped", n)
+		}
+	})
+
+	t.Run("InitialiseOffline", func(t *testing.T) {
+		c := newLineCollector(t, "tcp")
+		c.stop() // the collector is down, its address is kept
+
+		r := SpawnNetRecorder("tcp", c.addr).FormatFunc(contentOnly).
+			Backoff(time.Millisecond*10, time.Millisecond*50)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf()) // fails on the Initialise error
+		defer l.Close()
+
+		_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf("buffered"))
+		c.start(t)
+		defer c.stop()
+		waitBacklog(t, l)
+		if line := c.recv(t); line != "buffered" {
+			t.Errorf("wrong message: %q", line)
+		}
+	})
+
+	t.Run("SpoolOnClose", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "xlog-test")
+		if err != nil {
+			t.Fatalf("TempDir() error\n%s", err.Error())
+		}
+		defer os.RemoveAll(dir)
+		spool := filepath.Join(dir, "spool")
+		c := newLineCollector(t, "tcp")
+		defer c.stop()
+
+		r := SpawnNetRecorder("tcp", c.addr).FormatFunc(contentOnly).
+			Backoff(time.Hour, time.Hour).Spool(spool, 0)
+		chErr := make(chan error, 1024)
+		r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+		l := newTestLogger(t, r.Intrf())
+
+		disconnectRecorder(t, l, c, chErr)
+		for i := 0; i < 3; i++ {
+			_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Info).Setf("msg %d", i))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		_ = l.Flush(ctx) // reports buffered messages
+		cancel()
+		l.Close()
+		r.Intrf().ChCtl <- SignalStop()
+		for r.IsListening() {
+			time.Sleep(time.Millisecond)
+		}
+		if info, err := os.Stat(spool); err != nil || info.Size() == 0 {
+			t.Fatalf("messages are not spooled")
+		}
+
+		// the next run sends them on initialisation
+		c.start(t)
+		r = SpawnNetRecorder("tcp", c.addr).FormatFunc(contentOnly).Spool(spool, 0)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l = newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		var lines []string
+		for len(lines) < 3 {
+			if line := c.recv(t); line != "probe" {
+				lines = append(lines, line)
+			}
+		}
+		if strings.Join(lines, ",") != "msg 0,msg 1,msg 2" {
+			t.Errorf("wrong spooled messages: %q", lines)
+		}
+		if info, err := os.Stat(spool); err != nil || info.Size() != 0 {
+			t.Errorf("spool is not empty")
+		}
+	})
+}
+
+func TestDiskSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xlog-test")
+	if err != nil {
+		t.Fatalf("TempDir() error\n%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spool")
+
+	S, err := openSpool(path, 20)
+	if err != nil {
+		t.Fatalf(emsgUnexpectedError, err)
+	}
+	for _, rec := range []string{"first", "second"} {
+		if err := S.push([]byte(rec)); err != nil {
+			t.Fatalf(emsgUnexpectedError, err)
+		}
+	}
+	if err := S.push([]byte("third")); err != errSpoolFull {
+		t.Errorf("size limit is ignored: %v", err)
+	}
+	data, _ := S.next()
+	S.advance(data)
+	if err := S.close(); err != nil {
+		t.Fatalf(emsgUnexpectedError, err)
+	}
+
+	// simulate a crash during the write
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0640)
+	f.Write([]byte{0, 0, 0, 9, 'p', 'a'})
+	f.Close()
+
+	if S, err = openSpool(path, 0); err != nil {
+		t.Fatalf(emsgUnexpectedError, err)
+	}
+	defer S.close()
+	if S.count() != 1 {
+		t.Fatalf("wrong number of records: %d", S.count())
+	}
+	if data, err := S.next(); err != nil || string(data) != "second" {
+		t.Errorf("wrong record %q (%v)", data, err)
+	}
+}
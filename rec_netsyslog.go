@@ -0,0 +1,599 @@
+package xlog
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+var _ LogRecorder = &netSyslogRecorder{}
+
+// SyslogProtocol determines the syslog message format.
+type SyslogProtocol uint8
+
+const (
+	RFC5424 SyslogProtocol = iota // <PRI>1 TIMESTAMP HOST APP PROCID MSGID [SD] MSG
+	RFC3164                       // <PRI>Mmm dd hh:mm:ss HOST TAG[PID]: MSG
+)
+
+// default SD-ID for message fields (32473 is the example enterprise number)
+const defaultSyslogSDID = "fields@32473"
+
+const (
+	defaultSyslogDialTimeout  = time.Second * 5
+	defaultSyslogWriteTimeout = time.Second * 5
+	defaultSyslogMinBackoff   = time.Millisecond * 100
+	defaultSyslogMaxBackoff   = time.Second * 30
+)
+
+type netSyslogRecorder struct {
+	chCtl chan controlSignal
+	chMsg chan LogMsg
+	chErr chan<- error        // optional
+	chDbg chan<- debugMessage // optional
+
+	id          xid.ID
+	isListening bool_s // internal mutex
+	refCounter  int
+	conn        net.Conn
+
+	// reconnection state (see rec_netsyslog_retry.go)
+	pending    [][]byte      // messages buffered while disconnected
+	dropped    uint64        // total number of dropped messages (atomic)
+	unreported uint64        // dropped since the last report
+	backoff    time.Duration // current reconnection delay
+	retryTimer *time.Timer
+	chRetry    <-chan time.Time
+
+	sync.RWMutex
+	network      string // "udp", "tcp" or "tls"
+	addr         string
+	tlsConfig    *tls.Config
+	protocol     SyslogProtocol
+	facility     syslog.Priority
+	hostname     string
+	appName      string
+	procID       string
+	msgID        string
+	sdID         string
+	format       FormatFunc
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	bufferSize   int
+
+	// syslog severity for each message severity
+	sevBindings map[MsgFlagT]syslog.Priority
+}
+
+// NewNetSyslogRecorder allocates and returns a new network syslog recorder.
+// The network is "udp", "tcp" (octet-counting framing, RFC 6587) or "tls"
+// (RFC 5425), both protocols use the same framing. The recorder connects to
+// the server on initialisation and reconnects with exponential backoff when
+// the connection fails (or the server is down at initialisation). Messages
+// are buffered meanwhile and sent in order after the reconnection.
+//
+// By default it sends RFC 5424 messages with LOG_USER facility, the host
+// name, executable name and process id of the current process.
+func NewNetSyslogRecorder(network, addr string) *netSyslogRecorder {
+	r := new(netSyslogRecorder)
+	r.id = xid.NewWithTime(time.Now())
+	r.chCtl = make(chan controlSignal, 32)
+	r.chMsg = make(chan LogMsg, 64)
+	r.network = network
+	r.addr = addr
+	r.facility = syslog.LOG_USER
+	r.hostname, _ = os.Hostname()
+	r.appName = filepath.Base(os.Args[0])
+	r.procID = strconv.Itoa(os.Getpid())
+	r.sdID = defaultSyslogSDID
+	r.dialTimeout = defaultSyslogDialTimeout
+	r.writeTimeout = defaultSyslogWriteTimeout
+	r.minBackoff = defaultSyslogMinBackoff
+	r.maxBackoff = defaultSyslogMaxBackoff
+	r.bufferSize = defaultSyslogBufferSize
+	r.sevBindings = defaultSyslogBindings()
+	return r
+}
+
+// SpawnNetSyslogRecorder creates recorder and starts a listener.
+func SpawnNetSyslogRecorder(network, addr string) *netSyslogRecorder {
+	r := NewNetSyslogRecorder(network, addr)
+	go r.Listen()
+	return r
+}
+
+func defaultSyslogBindings() map[MsgFlagT]syslog.Priority {
+	return map[MsgFlagT]syslog.Priority{
+		Emerg:    syslog.LOG_EMERG,
+		Alert:    syslog.LOG_ALERT,
+		Critical: syslog.LOG_CRIT,
+		Error:    syslog.LOG_ERR,
+		Warning:  syslog.LOG_WARNING,
+		Notice:   syslog.LOG_NOTICE,
+		Info:     syslog.LOG_INFO,
+		Debug:    syslog.LOG_DEBUG,
+		CustomB1: syslog.LOG_INFO,
+		CustomB2: syslog.LOG_INFO,
+	}
+}
+
+// isSyslogSeverity says whether the priority is a severity code only
+// (syslog.Priority can contain facility codes).
+func isSyslogSeverity(priority syslog.Priority) bool {
+	return priority >= syslog.LOG_EMERG && priority <= syslog.LOG_DEBUG
+}
+
+// Intrf returns recorder's interface channels.
+func (R *netSyslogRecorder) Intrf() RecorderInterface {
+	return RecorderInterface{R.chCtl, R.chMsg, R.id}
+}
+
+// GetID returns recorder's xid.
+func (R *netSyslogRecorder) GetID() xid.ID {
+	return R.id
+}
+
+// BindSeverityFlag rebinds severity flag to the new syslog severity code.
+func (R *netSyslogRecorder) BindSeverityFlag(severity MsgFlagT, priority syslog.Priority) error {
+	severity = severity &^ SeverityShadowMask
+
+	R.Lock()
+	defer R.Unlock()
+
+	if _, exist := R.sevBindings[severity]; !exist {
+		return ErrWrongFlagValue
+	}
+	if !isSyslogSeverity(priority) {
+		return errWrongPriority
+	}
+	R.sevBindings[severity] = priority
+	return nil
+}
+
+// Protocol sets the message format (RFC5424 by default).
+func (R *netSyslogRecorder) Protocol(protocol SyslogProtocol) *netSyslogRecorder {
+	R.Lock()
+	R.protocol = protocol
+	R.Unlock()
+	return R
+}
+
+// Facility sets the facility code (e.g. syslog.LOG_LOCAL0), severity bits
+// of the value are ignored.
+func (R *netSyslogRecorder) Facility(facility syslog.Priority) *netSyslogRecorder {
+	R.Lock()
+	R.facility = facility &^ 0x07
+	R.Unlock()
+	return R
+}
+
+// Hostname sets the HOSTNAME header field (os.Hostname() by default).
+func (R *netSyslogRecorder) Hostname(name string) *netSyslogRecorder {
+	R.Lock()
+	R.hostname = name
+	R.Unlock()
+	return R
+}
+
+// AppName sets the APP-NAME header field (RFC 3164 TAG), the executable
+// name is used by default.
+func (R *netSyslogRecorder) AppName(name string) *netSyslogRecorder {
+	R.Lock()
+	R.appName = name
+	R.Unlock()
+	return R
+}
+
+// ProcID sets the PROCID header field (process id by default).
+func (R *netSyslogRecorder) ProcID(id string) *netSyslogRecorder {
+	R.Lock()
+	R.procID = id
+	R.Unlock()
+	return R
+}
+
+// MsgID sets the MSGID header field (empty by default).
+func (R *netSyslogRecorder) MsgID(id string) *netSyslogRecorder {
+	R.Lock()
+	R.msgID = id
+	R.Unlock()
+	return R
+}
+
+// StructuredDataID sets SD-ID of the element with message fields
+// ("fields@32473" by default). Empty value disables structured data,
+// then fields are appended to the message.
+func (R *netSyslogRecorder) StructuredDataID(id string) *netSyslogRecorder {
+	R.Lock()
+	R.sdID = id
+	R.Unlock()
+	return R
+}
+
+// TLSConfig sets the TLS configuration for the "tls" network.
+func (R *netSyslogRecorder) TLSConfig(config *tls.Config) *netSyslogRecorder {
+	R.Lock()
+	R.tlsConfig = config
+	R.Unlock()
+	return R
+}
+
+// Timeouts sets timeouts for connection and writing (5s by default).
+func (R *netSyslogRecorder) Timeouts(dial, write time.Duration) *netSyslogRecorder {
+	R.Lock()
+	R.dialTimeout = dial
+	R.writeTimeout = write
+	R.Unlock()
+	return R
+}
+
+// Backoff sets the minimum and maximum delays between reconnection
+// attempts (100ms and 30s by default). The delay doubles after each
+// failed attempt.
+func (R *netSyslogRecorder) Backoff(min, max time.Duration) *netSyslogRecorder {
+	R.Lock()
+	R.minBackoff = min
+	R.maxBackoff = max
+	R.Unlock()
+	return R
+}
+
+// BufferSize sets how many messages are kept while the recorder is
+// disconnected (256 by default), the oldest ones are dropped first.
+func (R *netSyslogRecorder) BufferSize(n int) *netSyslogRecorder {
+	R.Lock()
+	R.bufferSize = n
+	R.Unlock()
+	return R
+}
+
+// DroppedMessages returns the number of messages which have been dropped
+// because the buffer was full while the recorder was disconnected.
+func (R *netSyslogRecorder) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&R.dropped)
+}
+
+// FormatFunc sets custom formatter function for the MSG part.
+func (R *netSyslogRecorder) FormatFunc(f FormatFunc) *netSyslogRecorder {
+	R.Lock()
+	R.format = f
+	R.Unlock()
+	return R
+}
+
+// -----------------------------------------------------------------------------
+
+func (R *netSyslogRecorder) Listen() {
+	if R.isListening.Get() {
+		return
+	} else {
+		R.isListening.Set(true)
+		R._log("start listener...")
+	}
+
+	for {
+		select {
+		case sig := <-R.chCtl: // recv control signal
+			switch sig.stype {
+			case SigInit:
+				R._log("RECV INIT SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R._log("  chan: %v", respErrChan)
+				e := R.initialise()
+				R._log("  send response..")
+				respErrChan <- e
+				R._log("  done")
+			case SigClose:
+				R._log("RECV CLOSE SIGNAL")
+				R.close()
+			case SigFlush, SigReopen: // nothing to reopen
+				R._log("RECV %s SIGNAL", sig.stype)
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				if n := len(R.pending); n > 0 {
+					respErrChan <- fmt.Errorf("syslog: %d messages are buffered while disconnected", n)
+				} else {
+					respErrChan <- nil
+				}
+			case SigStop:
+				R._log("RECV STOP SIGNAL")
+				R.isListening.Set(false)
+				R._log("stop listener...")
+				return
+
+			case SigSetErrChan:
+				R._log("RECV SET_ERR_CHAN SIGNAL")
+				R.chErr = sig.data.(chan<- error) // MAY PANIC
+			case SigSetDbgChan:
+				R._log("RECV SET_DBG_CHAN SIGNAL")
+				R.chDbg = sig.data.(chan<- debugMessage) // MAY PANIC
+			case SigDropErrChan:
+				R._log("RECV DROP_ERR_CHAN SIGNAL")
+				R.chErr = nil
+			case SigDropDbgChan:
+				R._log("RECV DROP_DBG_CHAN SIGNAL")
+				R.chDbg = nil
+
+			default:
+				R._log("ERROR: received unknown signal (%s)", sig.stype)
+				// DO NOTHING
+			}
+
+		case msg := <-R.chMsg: // write log message
+			R._log("RECV MSG SIGNAL <--\n  msg=%v", msg)
+			R.handle(msg)
+
+		case <-R.chRetry: // reconnection attempt
+			R._log("reconnect")
+			R.retry()
+		}
+	}
+}
+
+// handle writes the message and reports an error if it occurs.
+func (R *netSyslogRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		R.reportError(err)
+	}
+}
+
+func (R *netSyslogRecorder) reportError(err error) {
+	if R.chErr != nil {
+		R.chErr <- err // MAY PANIC
+	}
+}
+
+// drain writes all messages which have been queued before the call.
+func (R *netSyslogRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
+func (R *netSyslogRecorder) IsListening() bool {
+	return R.isListening.Get() // rc safe
+}
+
+// ----------------------------------------
+
+func (R *netSyslogRecorder) initialise() error {
+	if R.refCounter == 0 {
+		R.RLock()
+		network := R.network
+		R.RUnlock()
+		switch network {
+		case "tls", "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("syslog: unsupported network %q", network)
+		}
+		if err := R.connect(); err != nil {
+			// the server may be down, messages are buffered meanwhile
+			R._log("connect fail: %s", err.Error())
+			R.scheduleRetry()
+		}
+	}
+	R.refCounter++
+	return nil
+}
+
+func (R *netSyslogRecorder) close() {
+	if R.refCounter == 0 {
+		return
+	}
+	if R.refCounter == 1 {
+		if len(R.pending) > 0 { // the last chance to deliver them
+			R.stopRetry()
+			R.retry()
+		}
+		R.stopRetry()
+		R.backoff = 0
+		if n := len(R.pending); n > 0 {
+			R.drop(n)
+			R.pending = nil
+			R.reportError(fmt.Errorf("syslog: %d buffered messages are lost on close", n))
+		}
+		R.closeConn()
+	}
+	R.refCounter--
+}
+
+func (R *netSyslogRecorder) connect() error {
+	R.RLock()
+	network, addr, config := R.network, R.addr, R.tlsConfig
+	timeout := R.dialTimeout
+	R.RUnlock()
+
+	R._log("dial %s %s", network, addr)
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: timeout}
+	switch network {
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		conn, err = dialer.Dial(network, addr)
+	default:
+		return fmt.Errorf("syslog: unsupported network %q", network)
+	}
+	if err != nil {
+		return err
+	}
+	R.conn = conn
+	return nil
+}
+
+// ----------------------------------------
+
+func (R *netSyslogRecorder) write(msg LogMsg) error {
+	if R.refCounter == 0 {
+		return ErrNotInitialised
+	}
+	data, err := R.message(&msg)
+	if err != nil {
+		return err
+	}
+	if R.conn == nil || len(R.pending) > 0 { // keep the order
+		R.buffer(data)
+		return nil
+	}
+	if err := R.send(data); err != nil {
+		R.disconnect()
+		R.buffer(data)
+		return fmt.Errorf("syslog write fail: %s", err.Error())
+	}
+	return nil
+}
+
+// send writes the message with the transport framing.
+func (R *netSyslogRecorder) send(data []byte) error {
+	R.RLock()
+	timeout, network := R.writeTimeout, R.network
+	R.RUnlock()
+
+	// octet counting for both protocols, messages may contain newlines
+	if !strings.HasPrefix(network, "udp") {
+		data = append([]byte(strconv.Itoa(len(data))+" "), data...)
+	}
+	if timeout > 0 {
+		R.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	_, err := R.conn.Write(data)
+	return err
+}
+
+// message builds the syslog message accordingly to the protocol.
+func (R *netSyslogRecorder) message(msg *LogMsg) ([]byte, error) {
+	R.RLock()
+	defer R.RUnlock()
+
+	severity, exist := R.sevBindings[msg.flags&^SeverityShadowMask]
+	if !exist {
+		return nil, ErrWrongFlagValue
+	}
+	pri := int(R.facility | severity)
+
+	// structured data is available in RFC 5424 only
+	withSD := R.protocol == RFC5424 && R.sdID != ""
+
+	var content string
+	if R.format != nil {
+		content = R.format(msg)
+	} else {
+		content = msg.text()
+		if msg.caller.IsSet() {
+			content = msg.caller.String() + ": " + content
+		}
+		if msg.logger != "" {
+			content = "[" + msg.logger + "] " + content
+		}
+		if len(msg.fields) > 0 && !withSD {
+			content += " " + FormatFields(msg.fields)
+		}
+		content = withStackTrace(content, msg)
+	}
+
+	var sb strings.Builder
+	if R.protocol == RFC3164 {
+		fmt.Fprintf(&sb, "<%d>%s %s %s",
+			pri, msg.time.Format(time.Stamp),
+			syslogHeaderField(R.hostname, 255), syslogHeaderField(R.appName, 32))
+		if R.procID != "" {
+			sb.WriteString("[" + R.procID + "]")
+		}
+		sb.WriteString(": ")
+		sb.WriteString(content)
+		return []byte(sb.String()), nil
+	}
+
+	fmt.Fprintf(&sb, "<%d>1 %s %s %s %s %s ",
+		pri, msg.time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(R.hostname, 255), syslogHeaderField(R.appName, 48),
+		syslogHeaderField(R.procID, 128), syslogHeaderField(R.msgID, 32))
+	if withSD && len(msg.fields) > 0 {
+		writeStructuredData(&sb, R.sdID, msg.fields)
+	} else {
+		sb.WriteByte('-')
+	}
+	if content != "" {
+		sb.WriteByte(' ')
+		sb.WriteString(content)
+	}
+	return []byte(sb.String()), nil
+}
+
+func (R *netSyslogRecorder) _log(format string, args ...interface{}) { // MAY PANIC
+	if R.chDbg != nil {
+		msg := DbgMsg(R.id, format, args...)
+		msg.rtype = "netSyslogRecorder"
+		R.chDbg <- msg
+	}
+}
+
+// -----------------------------------------------------------------------------
+
+// syslogHeaderField returns the value suitable for the header field:
+// printable ASCII without spaces, limited length, "-" for empty values.
+func syslogHeaderField(s string, limit int) string {
+	s = strings.Map(func(c rune) rune {
+		if c < 33 || c > 126 {
+			return '_'
+		}
+		return c
+	}, s)
+	if len(s) > limit {
+		s = s[:limit]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// writeStructuredData writes fields as a single SD-ELEMENT.
+func writeStructuredData(sb *strings.Builder, id string, fields []Field) {
+	sb.WriteByte('[')
+	sb.WriteString(sdName(id))
+	for _, f := range fields {
+		sb.WriteByte(' ')
+		sb.WriteString(sdName(f.Key))
+		sb.WriteString(`="`)
+		sdEscaper.WriteString(sb, f.String())
+		sb.WriteByte('"')
+	}
+	sb.WriteByte(']')
+}
+
+// PARAM-VALUE escaping (RFC 5424, 6.3.3)
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// sdName returns the value suitable for SD-ID and PARAM-NAME: printable
+// ASCII except '=', ' ', ']', '"', up to 32 characters.
+func sdName(s string) string {
+	s = strings.Map(func(c rune) rune {
+		if c < 33 || c > 126 || c == '=' || c == ']' || c == '"' {
+			return '_'
+		}
+		return c
+	}, s)
+	if len(s) > 32 {
+		s = s[:32]
+	}
+	if s == "" {
+		return "_"
+	}
+	return s
+}
@@ -0,0 +1,117 @@
+package xlog
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// While the network syslog recorder is disconnected, messages are kept in
+// the buffer and the connection is re-dialled by the listener with
+// exponential backoff, so writes never wait for the dial. After the
+// reconnection buffered messages are sent in order. If the buffer is full,
+// the oldest messages are dropped, the number of dropped messages is
+// reported by a synthetic message.
+
+// disconnect closes the connection and schedules the reconnection.
+func (R *netSyslogRecorder) disconnect() {
+	R.closeConn()
+	R.scheduleRetry()
+}
+
+func (R *netSyslogRecorder) closeConn() {
+	if R.conn != nil {
+		R.conn.Close()
+		R.conn = nil
+	}
+}
+
+// buffer keeps the message until the reconnection.
+func (R *netSyslogRecorder) buffer(data []byte) {
+	R.RLock()
+	size := R.bufferSize
+	R.RUnlock()
+
+	if size <= 0 {
+		R.drop(1)
+		return
+	}
+	if len(R.pending) >= size {
+		n := len(R.pending) - size + 1
+		R.pending = R.pending[n:]
+		R.drop(n)
+	}
+	R.pending = append(R.pending, data)
+}
+
+func (R *netSyslogRecorder) drop(n int) {
+	atomic.AddUint64(&R.dropped, uint64(n))
+	R.unreported += uint64(n)
+}
+
+func (R *netSyslogRecorder) scheduleRetry() {
+	R.RLock()
+	min, max := R.minBackoff, R.maxBackoff
+	R.RUnlock()
+
+	R.backoff *= 2
+	if R.backoff < min {
+		R.backoff = min
+	}
+	if R.backoff > max {
+		R.backoff = max
+	}
+	R.stopRetry()
+	R.retryTimer = time.NewTimer(R.backoff)
+	R.chRetry = R.retryTimer.C
+}
+
+func (R *netSyslogRecorder) stopRetry() {
+	if R.retryTimer != nil {
+		R.retryTimer.Stop()
+		R.retryTimer = nil
+	}
+	R.chRetry = nil
+}
+
+// retry reconnects and sends buffered messages.
+func (R *netSyslogRecorder) retry() {
+	R.chRetry = nil
+	if R.refCounter == 0 || R.conn != nil {
+		return
+	}
+	if err := R.connect(); err != nil {
+		R.scheduleRetry()
+		R.reportError(fmt.Errorf("syslog reconnect fail: %s", err.Error()))
+		return
+	}
+	R._log("reconnected, %d messages are buffered", len(R.pending))
+	R.backoff = 0
+	R.replay()
+}
+
+// replay sends the drop report and buffered messages in order.
+func (R *netSyslogRecorder) replay() {
+	if R.unreported > 0 {
+		msg := NewLogMsg().SetFlags(Warning).
+			Setf("xlog: %d messages dropped while disconnected", R.unreported)
+		msg.Uint("dropped", R.unreported)
+		if data, err := R.message(msg); err == nil {
+			if err := R.send(data); err != nil {
+				R.disconnect()
+				R.reportError(fmt.Errorf("syslog write fail: %s", err.Error()))
+				return
+			}
+		}
+		R.unreported = 0
+	}
+	for len(R.pending) > 0 {
+		if err := R.send(R.pending[0]); err != nil {
+			R.disconnect()
+			R.reportError(fmt.Errorf("syslog write fail: %s", err.Error()))
+			return
+		}
+		R.pending = R.pending[1:]
+	}
+	R.pending = nil
+}
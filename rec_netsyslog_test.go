@@ -0,0 +1,301 @@
+package xlog
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/syslog"
+	"math/big"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syslogServer collects messages received by UDP or TCP (octet counting).
+type syslogServer struct {
+	addr  string
+	msgs  chan string
+	conns chan net.Conn
+	close func()
+}
+
+func newSyslogServer(t *testing.T, network string, config *tls.Config) *syslogServer {
+	s := &syslogServer{msgs: make(chan string, 64), conns: make(chan net.Conn, 8)}
+	if network == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("ListenPacket() error\n%s", err.Error())
+		}
+		s.addr, s.close = pc.LocalAddr().String(), func() { pc.Close() }
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, _, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				s.msgs <- string(buf[:n])
+			}
+		}()
+		return s
+	}
+
+	var l net.Listener
+	var err error
+	if config != nil {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", config)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatalf("Listen() error\n%s", err.Error())
+	}
+	s.serve(l)
+	return s
+}
+
+// serve accepts TCP connections and reads messages from them.
+func (s *syslogServer) serve(l net.Listener) {
+	s.addr, s.close = l.Addr().String(), func() { l.Close() }
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns <- conn
+			go s.readFrames(conn)
+		}
+	}()
+}
+
+// readFrames reads "LEN SP MSG" frames.
+func (s *syslogServer) readFrames(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			s.msgs <- "WRONG FRAME: " + length
+			return
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return
+		}
+		s.msgs <- string(buf)
+	}
+}
+
+func (s *syslogServer) recv(t *testing.T) string {
+	select {
+	case msg := <-s.msgs:
+		return msg
+	case <-time.After(time.Second * 5):
+		t.Fatalf("message is not received")
+		return ""
+	}
+}
+
+func selfSignedConfig(t *testing.T) (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error\n%s", err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error\n%s", err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return config, pool
+}
+
+func TestNetSyslogRecorder(t *testing.T) {
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	newMsg := func() *LogMsg {
+		msg := NewLogMsg().SetFlags(Warning).Setf("disk is almost full")
+		msg.time = stamp
+		return msg.Str("mount", "/var").Str("quote", `a "b" [c]`)
+	}
+
+	t.Run("Message", func(t *testing.T) {
+		r := NewNetSyslogRecorder("udp", "").Hostname("host one").AppName("app").
+			ProcID("42").MsgID("DISK").Facility(syslog.LOG_LOCAL0)
+		r.sevBindings[Warning] = syslog.LOG_WARNING
+
+		data, err := r.message(newMsg())
+		if err != nil {
+			t.Fatalf(emsgUnexpectedError, err)
+		}
+		expected := `<132>1 2020-01-02T03:04:05.000006Z host_one app 42 DISK ` +
+			`[fields@32473 mount="/var" quote="a \"b\" [c\]"] disk is almost full`
+		if string(data) != expected {
+			t.Errorf("wrong RFC 5424 message\n%s\nexpected:\n%s", data, expected)
+		}
+
+		r.Protocol(RFC3164)
+		data, _ = r.message(newMsg())
+		expected = `<132>Jan  2 03:04:05 host_one app[42]: disk is almost full ` +
+			`mount=/var quote="a \"b\" [c]"`
+		if string(data) != expected {
+			t.Errorf("wrong RFC 3164 message\n%s\nexpected:\n%s", data, expected)
+		}
+
+		if err := r.BindSeverityFlag(Warning, syslog.LOG_LOCAL0); err != errWrongPriority {
+			t.Errorf(emsgUnexpectedError, err)
+		}
+	})
+
+	rfc5424 := regexp.MustCompile(`^<12>1 \S+ \S+ \S+ \d+ - \[fields@32473 mount="/var" quote="a \\"b\\" \[c\\]"\] disk is almost full$`)
+
+	for _, network := range []string{"udp", "tcp", "tls"} {
+		t.Run(network, func(t *testing.T) {
+			var serverConfig, clientConfig *tls.Config
+			if network == "tls" {
+				var pool *x509.CertPool
+				serverConfig, pool = selfSignedConfig(t)
+				clientConfig = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+			}
+			listenNetwork := network
+			if network == "tls" {
+				listenNetwork = "tcp"
+			}
+			s := newSyslogServer(t, listenNetwork, serverConfig)
+			defer s.close()
+
+			r := SpawnNetSyslogRecorder(network, s.addr).TLSConfig(clientConfig)
+			defer func() { r.Intrf().ChCtl <- SignalStop() }()
+			l := newTestLogger(t, r.Intrf())
+			defer l.Close()
+
+			for i := 0; i < 2; i++ {
+				_ = l.WriteMsg(nil, newMsg())
+				if msg := s.recv(t); !rfc5424.MatchString(msg) {
+					t.Errorf("wrong message\n%s", msg)
+				}
+			}
+		})
+	}
+
+	t.Run("Reconnect", func(t *testing.T) {
+		s := newSyslogServer(t, "tcp", nil)
+		defer s.close()
+
+		r := SpawnNetSyslogRecorder("tcp", s.addr).Backoff(time.Millisecond, time.Millisecond*10)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		chErr := make(chan error, 64)
+		r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		_ = l.Write(Info, "first")
+		if msg := s.recv(t); !strings.HasSuffix(msg, " first") {
+			t.Fatalf("wrong message\n%s", msg)
+		}
+		(<-s.conns).Close() // server drops the connection
+
+		// the first writes after the drop may be lost in the socket buffer
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			_ = l.Write(Info, "after")
+			select {
+			case <-s.conns:
+				if msg := s.recv(t); !strings.HasSuffix(msg, " after") {
+					t.Errorf("wrong message\n%s", msg)
+				}
+				return
+			case <-time.After(time.Millisecond * 10):
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("recorder is not reconnected")
+			}
+		}
+	})
+
+	t.Run("Backoff", func(t *testing.T) {
+		s := newSyslogServer(t, "tcp", nil)
+		s.close() // nobody listens
+
+		r := NewNetSyslogRecorder("tcp", s.addr).Backoff(time.Hour, time.Hour*2)
+		if err := r.initialise(); err != nil { // the first attempt
+			t.Fatalf("initialisation fails without the server\n%s", err.Error())
+		}
+		defer r.close()
+		msg := Message("message").SetFlags(Info)
+		if err := r.write(*msg); err != nil {
+			t.Errorf(emsgUnexpectedError, err)
+		}
+		if len(r.pending) != 1 {
+			t.Errorf("message is not buffered while disconnected")
+		}
+		if r.backoff != time.Hour {
+			t.Errorf("wrong backoff delay (%s)", r.backoff)
+		}
+	})
+
+	t.Run("Buffer", func(t *testing.T) {
+		s := newSyslogServer(t, "tcp", nil)
+		s.close() // nobody listens
+
+		r := SpawnNetSyslogRecorder("tcp", s.addr).Protocol(RFC3164).
+			Backoff(time.Millisecond, time.Millisecond*10).BufferSize(2)
+		defer func() { r.Intrf().ChCtl <- SignalStop() }()
+		l := newTestLogger(t, r.Intrf())
+		defer l.Close()
+
+		for i := 1; i <= 3; i++ {
+			// the framing keeps multiline messages whole
+			if e := l.Write(Info, "message %d\nline", i); e != nil {
+				t.Fatalf(emsgUnexpectedError, e)
+			}
+		}
+		if e := l.Flush(context.Background()); e == nil {
+			t.Errorf("buffered messages are not reported by Flush")
+		}
+		if n := r.DroppedMessages(); n != 1 {
+			t.Errorf("wrong number of dropped messages (%d)", n)
+		}
+
+		ln, err := net.Listen("tcp", s.addr)
+		if err != nil {
+			t.Skipf("can't listen the same address\n%s", err.Error())
+		}
+		s.serve(ln)
+		defer s.close()
+
+		// the drop report is sent before the buffered messages
+		expected := []string{"1 messages dropped", ": message 2\nline", ": message 3\nline"}
+		for _, suffix := range expected {
+			if msg := s.recv(t); !strings.Contains(msg, suffix) {
+				t.Errorf("wrong message\n%s\nexpected: %q", msg, suffix)
+			}
+		}
+	})
+}
@@ -0,0 +1,368 @@
+package xlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var _ LogRecorder = &otlpRecorder{}
+
+var errWrongSeverityNumber = errors.New("wrong severity number")
+
+// path of the OTLP/HTTP logs endpoint
+const otlpLogsPath = "/v1/logs"
+
+// default instrumentation scope for messages of the unnamed logger
+const defaultOTLPScope = "github.com/VisborN/xlog"
+
+// otlpRecorder is the HTTP recorder which exports messages as OTLP log
+// records (OTLP/HTTP with JSON encoding). Batching, retries, headers and
+// compression are configured by the httpRecorder's methods.
+type otlpRecorder struct {
+	*httpRecorder
+
+	// guarded by the httpRecorder's mutex
+	resource []otlpKeyValue
+	scope    string // default scope name
+	version  string // scope version
+
+	// OTLP severity number for each message severity
+	sevNumbers map[MsgFlagT]int
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"` // AnyValue
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string                 `json:"timeUnixNano"`
+	ObservedTimeUnixNano string                 `json:"observedTimeUnixNano"`
+	SeverityNumber       int                    `json:"severityNumber"`
+	SeverityText         string                 `json:"severityText"`
+	Body                 map[string]interface{} `json:"body"`
+	Attributes           []otlpKeyValue         `json:"attributes,omitempty"`
+}
+
+type otlpScopeLogs struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	} `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpResourceLogs struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeLogs []*otlpScopeLogs `json:"scopeLogs"`
+}
+
+// NewOTLPRecorder allocates and returns a new OTLP recorder. The URL is the
+// collector address, "/v1/logs" path is added if the URL has no path.
+//
+// The content becomes the record body, the severity is mapped to OTLP
+// severity number and text. Message fields and the Data (if it's a map)
+// become record attributes, caller information goes to code.* attributes.
+// The logger name is used as the instrumentation scope name. The resource
+// has service.name attribute (the executable name) by default.
+func NewOTLPRecorder(addr string) *otlpRecorder {
+	if u, err := url.Parse(addr); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = otlpLogsPath
+		addr = u.String()
+	}
+	r := &otlpRecorder{httpRecorder: NewHTTPRecorder(addr)}
+	r.httpRecorder.encoder = r.encode
+	r.httpRecorder.format = nil
+	r.resource = []otlpKeyValue{{"service.name", otlpValue(filepath.Base(os.Args[0]))}}
+	r.scope = defaultOTLPScope
+	r.sevNumbers = defaultOTLPSeverities()
+	return r
+}
+
+// SpawnOTLPRecorder creates recorder and starts a listener.
+func SpawnOTLPRecorder(addr string) *otlpRecorder {
+	r := NewOTLPRecorder(addr)
+	go r.Listen()
+	return r
+}
+
+func defaultOTLPSeverities() map[MsgFlagT]int {
+	return map[MsgFlagT]int{
+		Emerg:    22, // FATAL2
+		Alert:    21, // FATAL
+		Critical: 18, // ERROR2
+		Error:    17, // ERROR
+		Warning:  13, // WARN
+		Notice:   10, // INFO2
+		Info:     9,  // INFO
+		Debug:    5,  // DEBUG
+		CustomB1: 9,
+		CustomB2: 9,
+	}
+}
+
+// Resource sets the resource attribute, e.g. service.name or
+// deployment.environment.
+func (R *otlpRecorder) Resource(key string, value interface{}) *otlpRecorder {
+	R.Lock()
+	defer R.Unlock()
+
+	for i := range R.resource {
+		if R.resource[i].Key == key {
+			R.resource[i].Value = otlpValue(value)
+			return R
+		}
+	}
+	R.resource = append(R.resource, otlpKeyValue{key, otlpValue(value)})
+	return R
+}
+
+// Scope sets the instrumentation scope name for messages of the unnamed
+// logger and the scope version.
+func (R *otlpRecorder) Scope(name, version string) *otlpRecorder {
+	R.Lock()
+	R.scope = name
+	R.version = version
+	R.Unlock()
+	return R
+}
+
+// Header sets the request header, e.g. Authorization.
+func (R *otlpRecorder) Header(key, value string) *otlpRecorder {
+	R.httpRecorder.Header(key, value)
+	return R
+}
+
+// Gzip enables compression of request bodies.
+func (R *otlpRecorder) Gzip(enable bool) *otlpRecorder {
+	R.httpRecorder.Gzip(enable)
+	return R
+}
+
+// FormatFunc sets the formatter of the record body (the content by default).
+func (R *otlpRecorder) FormatFunc(f FormatFunc) *otlpRecorder {
+	R.httpRecorder.FormatFunc(f)
+	return R
+}
+
+// Client sets the HTTP client (the default one has 10s timeout).
+func (R *otlpRecorder) Client(client *http.Client) *otlpRecorder {
+	R.httpRecorder.Client(client)
+	return R
+}
+
+// Batch sets the max number of messages in the request and the max time
+// the message waits for the batch to fill.
+func (R *otlpRecorder) Batch(size int, interval time.Duration) *otlpRecorder {
+	R.httpRecorder.Batch(size, interval)
+	return R
+}
+
+// Retry sets the max number of attempts to send the batch (5 by default)
+// and the backoff delays (500ms and 30s by default).
+func (R *otlpRecorder) Retry(attempts int, min, max time.Duration) *otlpRecorder {
+	R.httpRecorder.Retry(attempts, min, max)
+	return R
+}
+
+// QueueSize sets the max number of batches waiting for sending (16 by
+// default). When the queue is full, the oldest batch is dropped.
+func (R *otlpRecorder) QueueSize(size int) *otlpRecorder {
+	R.httpRecorder.QueueSize(size)
+	return R
+}
+
+// BindSeverityFlag rebinds severity flag to the OTLP severity number (1-24).
+func (R *otlpRecorder) BindSeverityFlag(severity MsgFlagT, number int) error {
+	severity = severity &^ SeverityShadowMask
+
+	R.Lock()
+	defer R.Unlock()
+
+	if _, exist := R.sevNumbers[severity]; !exist {
+		return ErrWrongFlagValue
+	}
+	if number < 1 || number > 24 {
+		return errWrongSeverityNumber
+	}
+	R.sevNumbers[severity] = number
+	return nil
+}
+
+// ----------------------------------------
+
+// encode builds the export request, records are grouped by scopes.
+func (R *otlpRecorder) encode(msgs []LogMsg) ([]byte, string) {
+	R.RLock()
+	defer R.RUnlock()
+
+	observed := strconv.FormatInt(time.Now().UnixNano(), 10)
+	resourceLogs := &otlpResourceLogs{}
+	resourceLogs.Resource.Attributes = R.resource
+	scopes := make(map[string]*otlpScopeLogs)
+	for i := range msgs {
+		msg := &msgs[i]
+		name := msg.logger
+		if name == "" {
+			name = R.scope
+		}
+		scope, exist := scopes[name]
+		if !exist {
+			scope = &otlpScopeLogs{}
+			scope.Scope.Name = name
+			scope.Scope.Version = R.version
+			scopes[name] = scope
+			resourceLogs.ScopeLogs = append(resourceLogs.ScopeLogs, scope)
+		}
+		scope.LogRecords = append(scope.LogRecords, R.record(msg, observed))
+	}
+
+	body, _ := json.Marshal(struct {
+		ResourceLogs []*otlpResourceLogs `json:"resourceLogs"`
+	}{[]*otlpResourceLogs{resourceLogs}})
+	return body, "application/json"
+}
+
+func (R *otlpRecorder) record(msg *LogMsg, observed string) otlpLogRecord {
+	sev := msg.flags &^ SeverityShadowMask
+	rec := otlpLogRecord{
+		TimeUnixNano:         strconv.FormatInt(msg.time.UnixNano(), 10),
+		ObservedTimeUnixNano: observed,
+		SeverityNumber:       R.sevNumbers[sev],
+		SeverityText:         sev.String(),
+	}
+	if R.format != nil {
+		rec.Body = otlpValue(R.format(msg))
+	} else {
+		rec.Body = otlpValue(msg.text())
+	}
+
+	for _, f := range msg.fields {
+		rec.Attributes = append(rec.Attributes, otlpKeyValue{f.Key, otlpValue(jsonFieldValue(f))})
+	}
+	switch data := msg.Data.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(reflect.ValueOf(data)) {
+			rec.Attributes = append(rec.Attributes, otlpKeyValue{key, otlpValue(data[key])})
+		}
+	case map[string]string:
+		for _, key := range sortedKeys(reflect.ValueOf(data)) {
+			rec.Attributes = append(rec.Attributes, otlpKeyValue{key, otlpValue(data[key])})
+		}
+	}
+	if msg.caller.IsSet() {
+		rec.Attributes = append(rec.Attributes,
+			otlpKeyValue{"code.filepath", otlpValue(msg.caller.File)},
+			otlpKeyValue{"code.lineno", otlpValue(msg.caller.Line)},
+			otlpKeyValue{"code.function", otlpValue(msg.caller.Func)})
+	}
+	if msg.stack != "" {
+		rec.Attributes = append(rec.Attributes, otlpKeyValue{"code.stacktrace", otlpValue(msg.stack)})
+	}
+	return rec
+}
+
+// -----------------------------------------------------------------------------
+
+// otlpValue converts the value to AnyValue in the OTLP JSON form (64-bit
+// integers are strings, NaN and infinities are strings as well). Unsigned
+// integers which don't fit int64 are sent as stringValue. Pointers are
+// dereferenced, nil is an empty value.
+func otlpValue(v interface{}) map[string]interface{} {
+	switch x := v.(type) {
+	case nil:
+		return map[string]interface{}{}
+	case string:
+		return map[string]interface{}{"stringValue": x}
+	case bool:
+		return map[string]interface{}{"boolValue": x}
+	case int:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(x), 10)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(x, 10)}
+	case uint64:
+		return otlpUint(x)
+	case float64:
+		return otlpDouble(x)
+	case float32:
+		return otlpDouble(float64(x))
+	case error:
+		return map[string]interface{}{"stringValue": x.Error()}
+	case fmt.Stringer:
+		return map[string]interface{}{"stringValue": x.String()}
+	case []byte:
+		return map[string]interface{}{"bytesValue": x} // base64 by encoding/json
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return map[string]interface{}{}
+		}
+		return otlpValue(rv.Elem().Interface())
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return map[string]interface{}{"intValue": strconv.FormatInt(rv.Int(), 10)}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return otlpUint(rv.Uint())
+	case reflect.Slice, reflect.Array:
+		values := make([]map[string]interface{}, rv.Len())
+		for i := range values {
+			values[i] = otlpValue(rv.Index(i).Interface())
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	case reflect.Map:
+		if rv.Type().Key().Kind() == reflect.String {
+			values := []otlpKeyValue{}
+			for _, key := range sortedKeys(rv) {
+				item := rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()))
+				values = append(values, otlpKeyValue{key, otlpValue(item.Interface())})
+			}
+			return map[string]interface{}{"kvlistValue": map[string]interface{}{"values": values}}
+		}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprintf("%v", v)}
+}
+
+// otlpUint converts the value to intValue (it's signed int64 in OTLP) or to
+// stringValue if it overflows.
+func otlpUint(u uint64) map[string]interface{} {
+	if u > math.MaxInt64 {
+		return map[string]interface{}{"stringValue": strconv.FormatUint(u, 10)}
+	}
+	return map[string]interface{}{"intValue": strconv.FormatUint(u, 10)}
+}
+
+func otlpDouble(f float64) map[string]interface{} {
+	switch {
+	case math.IsNaN(f):
+		return map[string]interface{}{"doubleValue": "NaN"}
+	case math.IsInf(f, 1):
+		return map[string]interface{}{"doubleValue": "Infinity"}
+	case math.IsInf(f, -1):
+		return map[string]interface{}{"doubleValue": "-Infinity"}
+	}
+	return map[string]interface{}{"doubleValue": f}
+}
+
+// sortedKeys returns sorted keys of the map with string keys.
+func sortedKeys(rv reflect.Value) []string {
+	keys := make([]string, 0, rv.Len())
+	for _, k := range rv.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,131 @@
+package xlog
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// otlpRequest is the decoded export request.
+type otlpRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"scope"`
+			LogRecords []otlpLogRecord `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+func TestOTLPRecorder(t *testing.T) {
+	requests := make(chan otlpRequest, 16)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("wrong request: %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		if attempts++; attempts == 1 { // the first export fails
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var req otlpRequest
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &req); err != nil {
+			t.Errorf("wrong export request %q\n%s", data, err.Error())
+		}
+		requests <- req
+	}))
+	defer srv.Close()
+
+	r := SpawnOTLPRecorder(srv.URL).Resource("service.name", "billing").
+		Batch(2, time.Hour).Retry(3, time.Millisecond, time.Millisecond).
+		Resource("service.instance.id", 7).Scope("app", "1.2.3")
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	msg := NewLogMsg().SetFlags(Warning|Caller).Setf("disk is almost full").Int("free_mb", 12)
+	msg.Data = map[string]interface{}{"mount": "/var", "ratio": math.Inf(1), "tags": []string{"a", "b"}}
+	msg.time = stamp
+	_ = l.WriteMsg(nil, msg)
+	msg = NewLogMsg().SetFlags(Critical).Setf("no space left")
+	_ = l.Named("db").WriteMsg(nil, msg)
+
+	var req otlpRequest
+	select {
+	case req = <-requests:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("request is not received")
+	}
+	if len(req.ResourceLogs) != 1 || len(req.ResourceLogs[0].ScopeLogs) != 2 {
+		t.Fatalf("wrong request structure: %+v", req)
+	}
+	if got := mustJSON(req.ResourceLogs[0].Resource.Attributes); got !=
+		`[{"key":"service.name","value":{"stringValue":"billing"}},`+
+			`{"key":"service.instance.id","value":{"intValue":"7"}}]` {
+		t.Errorf("wrong resource attributes: %s", got)
+	}
+
+	scope := req.ResourceLogs[0].ScopeLogs[0]
+	if scope.Scope.Name != "app" || scope.Scope.Version != "1.2.3" || len(scope.LogRecords) != 1 {
+		t.Fatalf("wrong scope: %+v", scope)
+	}
+	rec := scope.LogRecords[0]
+	if rec.TimeUnixNano != strconv.FormatInt(stamp.UnixNano(), 10) ||
+		rec.SeverityNumber != 13 || rec.SeverityText != "WARNING" ||
+		rec.Body["stringValue"] != "disk is almost full" {
+		t.Errorf("wrong record: %+v", rec)
+	}
+	attrs := mustJSON(rec.Attributes)
+	for _, expected := range []string{
+		`{"key":"free_mb","value":{"intValue":"12"}}`,
+		`{"key":"mount","value":{"stringValue":"/var"}}`,
+		`{"key":"ratio","value":{"doubleValue":"Infinity"}}`,
+		`{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"stringValue":"b"}]}}}`,
+		`{"key":"code.function","value":{"stringValue":"github.com/VisborN/xlog.TestOTLPRecorder"}}`,
+	} {
+		if !strings.Contains(attrs, expected) {
+			t.Errorf("attribute %s is not found in\n%s", expected, attrs)
+		}
+	}
+
+	scope = req.ResourceLogs[0].ScopeLogs[1]
+	if scope.Scope.Name != "db" || len(scope.LogRecords) != 1 ||
+		scope.LogRecords[0].SeverityNumber != 18 || scope.LogRecords[0].SeverityText != "CRIT" {
+		t.Errorf("wrong scope: %+v", scope)
+	}
+}
+
+func TestOTLPValue(t *testing.T) {
+	type counter uint64
+	n, name := 42, "disk"
+	for _, tc := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{uint64(math.MaxInt64), `{"intValue":"9223372036854775807"}`},
+		{uint64(math.MaxUint64), `{"stringValue":"18446744073709551615"}`},
+		{counter(math.MaxUint64), `{"stringValue":"18446744073709551615"}`},
+		{uint32(7), `{"intValue":"7"}`},
+		{&n, `{"intValue":"42"}`},
+		{&name, `{"stringValue":"disk"}`},
+		{(*int)(nil), `{}`},
+		{[]*string{&name}, `{"arrayValue":{"values":[{"stringValue":"disk"}]}}`},
+	} {
+		if got := mustJSON(otlpValue(tc.value)); got != tc.expected {
+			t.Errorf("otlpValue(%v) = %s, expected %s", tc.value, got, tc.expected)
+		}
+	}
+}
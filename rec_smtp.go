@@ -0,0 +1,528 @@
+package xlog
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+var _ LogRecorder = &smtpRecorder{}
+
+// SMTPTLSPolicy determines the usage of STARTTLS.
+type SMTPTLSPolicy uint8
+
+const (
+	SMTPTLSOpportunistic SMTPTLSPolicy = iota // if the server supports it
+	SMTPTLSRequired                           // fail if the server doesn't support it
+	SMTPTLSDisabled
+)
+
+const (
+	defaultSMTPSeverities  = Emerg | Alert | Critical
+	defaultSMTPWindow      = time.Minute
+	defaultSMTPMaxMessages = 100 // per digest
+	defaultSMTPMaxMails    = 10
+	defaultSMTPPeriod      = time.Hour
+	defaultSMTPTimeout     = time.Second * 30
+	defaultSMTPSubject     = "xlog alerts"
+)
+
+var errSMTPNoStartTLS = errors.New("smtp: server doesn't support STARTTLS")
+
+type smtpRecorder struct {
+	chCtl chan controlSignal
+	chMsg chan LogMsg
+	chErr chan<- error        // optional
+	chDbg chan<- debugMessage // optional
+
+	id          xid.ID
+	isListening bool_s // internal mutex
+	refCounter  int
+
+	pending     []LogMsg    // messages of the current digest
+	suppressed  int         // messages which didn't fit the digest
+	sent        []time.Time // sending time of mails in the throttling period
+	windowTimer *time.Timer
+	chWindow    <-chan time.Time
+	dropped     uint64 // atomic
+
+	sync.RWMutex
+	addr        string // host:port
+	from        string
+	to          []string
+	auth        smtp.Auth
+	tlsPolicy   SMTPTLSPolicy
+	tlsConfig   *tls.Config
+	subject     string
+	severities  MsgFlagT
+	format      FormatFunc
+	window      time.Duration
+	maxMessages int
+	maxMails    int
+	period      time.Duration
+	timeout     time.Duration
+}
+
+// NewSMTPRecorder allocates and returns a new recorder which sends alert
+// digests by email. By default only Emerg, Alert and Critical messages are
+// sent (see Severities).
+//
+// The first message starts the digest window, all messages received in the
+// window are sent in the single mail when it ends. The number of mails is
+// throttled (at most 10 per hour by default): when the limit is reached,
+// the digest is delayed until the mail can be sent. Messages which don't
+// fit the digest are counted in the "suppressed" footer of the next mail.
+//
+// Flush doesn't send the digest before the window ends, the pending digest
+// is sent when the recorder is closed (unless it's throttled).
+func NewSMTPRecorder(addr, from string, to ...string) *smtpRecorder {
+	r := new(smtpRecorder)
+	r.id = xid.NewWithTime(time.Now())
+	r.chCtl = make(chan controlSignal, 32)
+	r.chMsg = make(chan LogMsg, 64)
+	r.addr = addr
+	r.from = from
+	r.to = to
+	r.subject = defaultSMTPSubject
+	r.severities = defaultSMTPSeverities
+	r.format = IoDirectDefaultFormatter
+	r.window = defaultSMTPWindow
+	r.maxMessages = defaultSMTPMaxMessages
+	r.maxMails = defaultSMTPMaxMails
+	r.period = defaultSMTPPeriod
+	r.timeout = defaultSMTPTimeout
+	return r
+}
+
+// SpawnSMTPRecorder creates recorder and starts a listener.
+func SpawnSMTPRecorder(addr, from string, to ...string) *smtpRecorder {
+	r := NewSMTPRecorder(addr, from, to...)
+	go r.Listen()
+	return r
+}
+
+// Intrf returns recorder's interface channels.
+func (R *smtpRecorder) Intrf() RecorderInterface {
+	return RecorderInterface{R.chCtl, R.chMsg, R.id}
+}
+
+// GetID returns recorder's xid.
+func (R *smtpRecorder) GetID() xid.ID {
+	return R.id
+}
+
+// Auth sets the authentication mechanism, e.g. smtp.PlainAuth. It's used
+// only if the server supports the AUTH extension.
+func (R *smtpRecorder) Auth(auth smtp.Auth) *smtpRecorder {
+	R.Lock()
+	R.auth = auth
+	R.Unlock()
+	return R
+}
+
+// StartTLS sets the STARTTLS policy (SMTPTLSOpportunistic by default) and
+// the TLS config (nil means the default config for the server host).
+func (R *smtpRecorder) StartTLS(policy SMTPTLSPolicy, config *tls.Config) *smtpRecorder {
+	R.Lock()
+	R.tlsPolicy = policy
+	R.tlsConfig = config
+	R.Unlock()
+	return R
+}
+
+// Subject sets the mail subject prefix ("xlog alerts" by default).
+func (R *smtpRecorder) Subject(subject string) *smtpRecorder {
+	R.Lock()
+	R.subject = subject
+	R.Unlock()
+	return R
+}
+
+// Severities sets severities of messages which are sent, other messages
+// are ignored (Emerg | Alert | Critical by default).
+func (R *smtpRecorder) Severities(flags MsgFlagT) *smtpRecorder {
+	R.Lock()
+	R.severities = flags &^ SeverityShadowMask
+	R.Unlock()
+	return R
+}
+
+// FormatFunc sets custom formatter function (IoDirectDefaultFormatter by
+// default).
+func (R *smtpRecorder) FormatFunc(f FormatFunc) *smtpRecorder {
+	R.Lock()
+	R.format = f
+	R.Unlock()
+	return R
+}
+
+// Digest sets the digest window (1m by default) and the max number of
+// messages in the mail (100 by default).
+func (R *smtpRecorder) Digest(window time.Duration, maxMessages int) *smtpRecorder {
+	R.Lock()
+	R.window = window
+	R.maxMessages = maxMessages
+	R.Unlock()
+	return R
+}
+
+// Throttle sets the max number of mails per period (10 per hour by
+// default). Zero disables throttling.
+func (R *smtpRecorder) Throttle(maxMails int, period time.Duration) *smtpRecorder {
+	R.Lock()
+	R.maxMails = maxMails
+	R.period = period
+	R.Unlock()
+	return R
+}
+
+// Timeout sets the timeout of the SMTP session (30s by default). The mail
+// is sent synchronously by the listener, so control signals (e.g. Flush or
+// Close) wait for the session meanwhile, up to this timeout.
+func (R *smtpRecorder) Timeout(timeout time.Duration) *smtpRecorder {
+	R.Lock()
+	R.timeout = timeout
+	R.Unlock()
+	return R
+}
+
+// DroppedMessages returns the number of messages which haven't been sent
+// (suppressed or failed).
+func (R *smtpRecorder) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&R.dropped)
+}
+
+// -----------------------------------------------------------------------------
+
+func (R *smtpRecorder) Listen() {
+	if R.isListening.Get() {
+		return
+	} else {
+		R.isListening.Set(true)
+		R._log("start listener...")
+	}
+
+	for {
+		select {
+		case sig := <-R.chCtl: // recv control signal
+			switch sig.stype {
+			case SigInit:
+				R._log("RECV INIT SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R._log("  chan: %v", respErrChan)
+				e := R.initialise()
+				R._log("  send response..")
+				respErrChan <- e
+				R._log("  done")
+			case SigClose:
+				R._log("RECV CLOSE SIGNAL")
+				R.close()
+			case SigFlush: // the digest is sent when the window ends
+				R._log("RECV FLUSH SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				respErrChan <- nil
+			case SigReopen: // nothing to reopen
+				R._log("RECV REOPEN SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				respErrChan <- nil
+			case SigStop:
+				R._log("RECV STOP SIGNAL")
+				R.isListening.Set(false)
+				R._log("stop listener...")
+				return
+
+			case SigSetErrChan:
+				R._log("RECV SET_ERR_CHAN SIGNAL")
+				R.chErr = sig.data.(chan<- error) // MAY PANIC
+			case SigSetDbgChan:
+				R._log("RECV SET_DBG_CHAN SIGNAL")
+				R.chDbg = sig.data.(chan<- debugMessage) // MAY PANIC
+			case SigDropErrChan:
+				R._log("RECV DROP_ERR_CHAN SIGNAL")
+				R.chErr = nil
+			case SigDropDbgChan:
+				R._log("RECV DROP_DBG_CHAN SIGNAL")
+				R.chDbg = nil
+
+			default:
+				R._log("ERROR: received unknown signal (%s)", sig.stype)
+				// DO NOTHING
+			}
+
+		case msg := <-R.chMsg: // write log message
+			R._log("RECV MSG SIGNAL <--\n  msg=%v", msg)
+			R.handle(msg)
+
+		case <-R.chWindow: // digest window is passed or throttling is over
+			R.chWindow = nil
+			R.digest()
+		}
+	}
+}
+
+// handle writes the message and reports an error if it occurs.
+func (R *smtpRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		R.reportError(err)
+	}
+}
+
+func (R *smtpRecorder) reportError(err error) {
+	if R.chErr != nil {
+		R.chErr <- err // MAY PANIC
+	}
+}
+
+// drain writes all messages which have been queued before the call.
+func (R *smtpRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
+func (R *smtpRecorder) IsListening() bool {
+	return R.isListening.Get() // rc safe
+}
+
+// ----------------------------------------
+
+func (R *smtpRecorder) initialise() error {
+	if R.refCounter == 0 {
+		R.RLock()
+		addr, to := R.addr, R.to
+		R.RUnlock()
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
+		}
+		if len(to) == 0 {
+			return errors.New("smtp: no recipients")
+		}
+	}
+	R.refCounter++
+	return nil
+}
+
+func (R *smtpRecorder) close() {
+	if R.refCounter == 0 {
+		return
+	}
+	if R.refCounter == 1 {
+		if !R.digest().IsZero() {
+			n := len(R.pending) + R.suppressed
+			atomic.AddUint64(&R.dropped, uint64(len(R.pending)))
+			R.reportError(fmt.Errorf("smtp: %d messages are dropped (throttled)", n))
+		}
+		R.stopWindow()
+		R.pending = nil
+		R.suppressed = 0
+	}
+	R.refCounter--
+}
+
+// ----------------------------------------
+
+func (R *smtpRecorder) write(msg LogMsg) error {
+	if R.refCounter == 0 {
+		return ErrNotInitialised
+	}
+	R.RLock()
+	severities, window, maxMessages := R.severities, R.window, R.maxMessages
+	R.RUnlock()
+
+	if (msg.flags&^SeverityShadowMask)&severities == 0 {
+		return nil
+	}
+	if maxMessages > 0 && len(R.pending) >= maxMessages {
+		R.suppressed++
+		atomic.AddUint64(&R.dropped, 1)
+		return nil
+	}
+	R.pending = append(R.pending, msg)
+	if R.chWindow == nil {
+		R.windowTimer = time.NewTimer(window)
+		R.chWindow = R.windowTimer.C
+	}
+	return nil
+}
+
+// digest sends the mail with pending messages. If the mail is throttled,
+// it schedules the next attempt and returns its time.
+func (R *smtpRecorder) digest() time.Time {
+	if len(R.pending) == 0 && R.suppressed == 0 {
+		return time.Time{}
+	}
+	R.RLock()
+	maxMails, period := R.maxMails, R.period
+	R.RUnlock()
+
+	now := time.Now()
+	for len(R.sent) > 0 && now.Sub(R.sent[0]) >= period {
+		R.sent = R.sent[1:]
+	}
+	if maxMails > 0 && len(R.sent) >= maxMails {
+		until := R.sent[0].Add(period)
+		R._log("throttled until %s", until)
+		R.stopWindow()
+		R.windowTimer = time.NewTimer(until.Sub(now))
+		R.chWindow = R.windowTimer.C
+		return until
+	}
+
+	R.stopWindow()
+	R.sent = append(R.sent, now)
+	if err := R.send(R.compose(now)); err != nil {
+		atomic.AddUint64(&R.dropped, uint64(len(R.pending)))
+		R.reportError(fmt.Errorf("smtp: %d messages are dropped: %s",
+			len(R.pending)+R.suppressed, err.Error()))
+	}
+	R.pending = nil
+	R.suppressed = 0
+	return time.Time{}
+}
+
+// compose returns the mail with headers, lines are separated with CRLF.
+func (R *smtpRecorder) compose(now time.Time) []byte {
+	R.RLock()
+	defer R.RUnlock()
+	hostname, _ := os.Hostname()
+
+	var body bytes.Buffer
+	if len(R.pending) > 0 {
+		fmt.Fprintf(&body, "%d messages from %s between %s and %s:\n",
+			len(R.pending), hostname, R.pending[0].time.Format(time.RFC3339),
+			R.pending[len(R.pending)-1].time.Format(time.RFC3339))
+	}
+	for i := range R.pending {
+		text := R.pending[i].content
+		if R.format != nil { // FormatFunc(nil) is allowed
+			text = R.format(&R.pending[i])
+		}
+		body.WriteString("\n" + text + "\n")
+	}
+	if R.suppressed > 0 {
+		fmt.Fprintf(&body, "\n-- \nsuppressed %d messages\n", R.suppressed)
+	}
+
+	subject := R.subject
+	if len(R.pending) > 0 {
+		first := strings.SplitN(R.pending[0].content, "\n", 2)[0]
+		subject += ": " + first
+		if len(R.pending) > 1 {
+			subject += fmt.Sprintf(" (+%d more)", len(R.pending)-1)
+		}
+	} else {
+		subject += fmt.Sprintf(": suppressed %d messages", R.suppressed)
+	}
+
+	var mail bytes.Buffer
+	fmt.Fprintf(&mail, "From: %s\n", R.from)
+	fmt.Fprintf(&mail, "To: %s\n", strings.Join(R.to, ", "))
+	fmt.Fprintf(&mail, "Subject: %s\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&mail, "Date: %s\n", now.Format(time.RFC1123Z))
+	mail.WriteString("MIME-Version: 1.0\n")
+	mail.WriteString("Content-Type: text/plain; charset=utf-8\n")
+	mail.WriteString("Content-Transfer-Encoding: 8bit\n\n")
+	mail.Write(body.Bytes())
+	return bytes.Replace(mail.Bytes(), []byte("\n"), []byte("\r\n"), -1)
+}
+
+// send delivers the mail in the new SMTP session.
+func (R *smtpRecorder) send(mail []byte) error {
+	R.RLock()
+	addr, from, to, auth := R.addr, R.from, R.to, R.auth
+	policy, config, timeout := R.tlsPolicy, R.tlsConfig, R.timeout
+	R.RUnlock()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if hostname, err := os.Hostname(); err == nil {
+		if err := c.Hello(hostname); err != nil {
+			return err
+		}
+	}
+	if policy != SMTPTLSDisabled {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if config == nil {
+				config = &tls.Config{ServerName: host}
+			}
+			if err := c.StartTLS(config); err != nil {
+				return err
+			}
+		} else if policy == SMTPTLSRequired {
+			return errSMTPNoStartTLS
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(auth); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(mail); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (R *smtpRecorder) stopWindow() {
+	if R.windowTimer != nil {
+		R.windowTimer.Stop()
+		R.windowTimer = nil
+	}
+	R.chWindow = nil
+}
+
+func (R *smtpRecorder) _log(format string, args ...interface{}) { // MAY PANIC
+	if R.chDbg != nil {
+		msg := DbgMsg(R.id, format, args...)
+		msg.rtype = "smtpRecorder"
+		R.chDbg <- msg
+	}
+}
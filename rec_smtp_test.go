@@ -0,0 +1,213 @@
+package xlog
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpMail is the mail received by the SMTP server.
+type smtpMail struct {
+	from string
+	to   []string
+	auth string // decoded PLAIN credentials
+	tls  bool
+	data string
+}
+
+// smtpServer is a test double for the mail server, it supports STARTTLS
+// (if the TLS config is set) and AUTH PLAIN.
+type smtpServer struct {
+	ln    net.Listener
+	tls   *tls.Config
+	mails chan smtpMail
+}
+
+func newSMTPServer(t *testing.T, config *tls.Config) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error\n%s", err.Error())
+	}
+	s := &smtpServer{ln: ln, tls: config, mails: make(chan smtpMail, 16)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	var mail smtpMail
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		arg := strings.TrimSpace(strings.TrimPrefix(line, strings.SplitN(line, " ", 2)[0]))
+		switch cmd {
+		case "EHLO":
+			tp.PrintfLine("250-localhost")
+			if s.tls != nil && !mail.tls {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 AUTH PLAIN")
+		case "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, tp, mail.tls = tlsConn, textproto.NewConn(tlsConn), true
+		case "AUTH":
+			creds, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(arg, "PLAIN "))
+			mail.auth = strings.Replace(string(creds), "\x00", ":", -1)
+			tp.PrintfLine("235 authenticated")
+		case "MAIL":
+			mail.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			tp.PrintfLine("250 ok")
+		case "RCPT":
+			mail.to = append(mail.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			mail.data = string(data) // CRLF is converted to LF
+			s.mails <- mail
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+func (s *smtpServer) recv(t *testing.T) smtpMail {
+	select {
+	case mail := <-s.mails:
+		return mail
+	case <-time.After(time.Second * 5):
+		t.Fatalf("mail is not received")
+		return smtpMail{}
+	}
+}
+
+func TestSMTPRecorder(t *testing.T) {
+	// borrow the test certificate from httptest
+	https := httptest.NewTLSServer(http.NotFoundHandler())
+	defer https.Close()
+	s := newSMTPServer(t, https.TLS)
+	defer s.ln.Close()
+
+	config := https.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	config.ServerName = "127.0.0.1"
+	r := SpawnSMTPRecorder(s.ln.Addr().String(), "app@example.com", "ops@example.com", "dev@example.com").
+		StartTLS(SMTPTLSRequired, config).Auth(smtp.PlainAuth("", "user", "secret", "127.0.0.1")).
+		Subject("billing").Digest(time.Millisecond*100, 2)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	chErr := make(chan error, 16)
+	r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Critical).Setf("database is down"))
+	_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Error).Setf("ignored"))
+	_ = l.Named("queue").WriteMsg(nil, NewLogMsg().SetFlags(Alert).Setf("queue is full").Int("size", 100))
+	_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Emerg).Setf("suppressed"))
+
+	mail := s.recv(t)
+	if !mail.tls || mail.auth != ":user:secret" || mail.from != "app@example.com" ||
+		strings.Join(mail.to, ",") != "ops@example.com,dev@example.com" {
+		t.Errorf("wrong session: %+v", mail)
+	}
+	for _, expected := range []string{
+		"From: app@example.com\n",
+		"To: ops@example.com, dev@example.com\n",
+		"Subject: billing: database is down (+1 more)\n",
+		"\n\n2 messages from ",
+		"CRIT database is down\n",
+		"ALERT [queue] queue is full size=100\n",
+		"\n-- \nsuppressed 1 messages\n",
+	} {
+		if !strings.Contains(mail.data, expected) {
+			t.Errorf("%q is not found in\n%s", expected, mail.data)
+		}
+	}
+	if strings.Contains(mail.data, "ignored") {
+		t.Errorf("message with wrong severity is sent:\n%s", mail.data)
+	}
+	if n := r.DroppedMessages(); n != 1 {
+		t.Errorf("wrong number of dropped messages: %d", n)
+	}
+
+	flushLogger(t, l)
+	select {
+	case err := <-chErr:
+		t.Errorf(emsgUnexpectedError, err)
+	default:
+	}
+}
+
+func TestSMTPRecorderThrottle(t *testing.T) {
+	s := newSMTPServer(t, nil)
+	defer s.ln.Close()
+
+	r := SpawnSMTPRecorder(s.ln.Addr().String(), "app@example.com", "ops@example.com").
+		Severities(Error).Digest(time.Millisecond*50, 0).Throttle(1, time.Millisecond*300)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Error).Setf("first"))
+	flushLogger(t, l) // doesn't send the digest before the window ends
+	if err := l.Reopen(context.Background()); err != nil {
+		t.Fatalf(emsgUnexpectedError, err)
+	}
+	select {
+	case mail := <-s.mails:
+		t.Fatalf("digest is sent before the window ends:\n%s", mail.data)
+	default:
+	}
+	start := time.Now()
+	if mail := s.recv(t); !strings.Contains(mail.data, "Subject: xlog alerts: first\n") ||
+		mail.tls || mail.auth != "" {
+		t.Errorf("wrong mail:\n%s", mail.data)
+	}
+
+	_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Error).Setf("second"))
+	flushLogger(t, l)
+	// the digest is delayed until the throttling period is over
+	mail := s.recv(t)
+	if time.Since(start) < time.Millisecond*250 || !strings.Contains(mail.data, "ERROR second\n") {
+		t.Errorf("wrong throttled mail (%s):\n%s", time.Since(start), mail.data)
+	}
+}
+
+func TestSMTPRecorderNoFormat(t *testing.T) {
+	r := NewSMTPRecorder("127.0.0.1:25", "app@example.com", "ops@example.com").FormatFunc(nil)
+	r.pending = append(r.pending, *NewLogMsg().SetFlags(Error).Setf("disk is full"))
+	if mail := string(r.compose(time.Now())); !strings.Contains(mail, "\r\ndisk is full\r\n") {
+		t.Errorf("message content is not found in\n%s", mail)
+	}
+}
@@ -0,0 +1,637 @@
+package xlog
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+var _ LogRecorder = &sqlRecorder{}
+
+// SQLColumns describes names of the table columns. An empty name means the
+// default name, the "-" name omits the value from the table.
+type SQLColumns struct {
+	Time       string // "time", time.Time
+	Severity   string // "severity", e.g. "ERROR"
+	Attributes string // "attributes", e.g. "STACKTRACE,CALLER"
+	Logger     string // "logger"
+	Caller     string // "caller", "file:line"
+	Content    string // "content"
+	Fields     string // "fields", JSON object or NULL
+	StackTrace string // "stack", NULL if empty
+	Data       string // "data", JSON or NULL
+}
+
+var defaultSQLColumns = SQLColumns{
+	Time:       "time",
+	Severity:   "severity",
+	Attributes: "attributes",
+	Logger:     "logger",
+	Caller:     "caller",
+	Content:    "content",
+	Fields:     "fields",
+	StackTrace: "stack",
+	Data:       "data",
+}
+
+// SQLPlaceholder determines the bind parameter syntax of the driver.
+type SQLPlaceholder uint8
+
+const (
+	QuestionMark SQLPlaceholder = iota // ?, MySQL and SQLite
+	DollarNumber                       // $1, PostgreSQL
+)
+
+const (
+	defaultSQLBatchSize   = 100
+	defaultSQLInterval    = time.Second
+	defaultSQLTimeout     = time.Second * 10
+	defaultSQLMaxAttempts = 5
+	defaultSQLMinBackoff  = time.Millisecond * 100
+	defaultSQLMaxBackoff  = time.Second * 30
+	defaultSQLQueueSize   = 16 // batches
+)
+
+// sqlBatch is the batch of messages inserted in the single transaction.
+type sqlBatch struct {
+	msgs     []LogMsg
+	attempts int
+}
+
+// sqlColumn binds the column name to the message's value.
+type sqlColumn struct {
+	name  string
+	ctype string // used by Schema
+	value func(msg *LogMsg) interface{}
+}
+
+type sqlRecorder struct {
+	chCtl chan controlSignal
+	chMsg chan LogMsg
+	chErr chan<- error        // optional
+	chDbg chan<- debugMessage // optional
+
+	id          xid.ID
+	isListening bool_s // internal mutex
+	refCounter  int
+
+	pending    []LogMsg    // messages of the current batch
+	queue      []*sqlBatch // batches waiting for inserting
+	batchTimer *time.Timer
+	chBatch    <-chan time.Time
+	retryTimer *time.Timer
+	chRetry    <-chan time.Time
+	backoff    time.Duration
+	dropped    uint64 // atomic
+
+	sync.RWMutex
+	db          *sql.DB
+	table       string
+	columns     SQLColumns
+	placeholder SQLPlaceholder
+	utc         bool
+	batchSize   int
+	interval    time.Duration
+	timeout     time.Duration
+	maxAttempts int
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	queueSize   int
+}
+
+// NewSQLRecorder allocates and returns a new recorder which inserts
+// messages to the table via database/sql. The table name and column names
+// are written to queries as is, they must be trusted.
+//
+// Messages are inserted in batches, each batch in the single transaction.
+// Failed transactions are retried with exponential backoff, the batch is
+// dropped (and reported to the error channel) when the number of attempts
+// is exhausted.
+func NewSQLRecorder(db *sql.DB, table string) *sqlRecorder {
+	r := new(sqlRecorder)
+	r.id = xid.NewWithTime(time.Now())
+	r.chCtl = make(chan controlSignal, 32)
+	r.chMsg = make(chan LogMsg, 64)
+	r.db = db
+	r.table = table
+	r.columns = defaultSQLColumns
+	r.batchSize = defaultSQLBatchSize
+	r.interval = defaultSQLInterval
+	r.timeout = defaultSQLTimeout
+	r.maxAttempts = defaultSQLMaxAttempts
+	r.minBackoff = defaultSQLMinBackoff
+	r.maxBackoff = defaultSQLMaxBackoff
+	r.queueSize = defaultSQLQueueSize
+	return r
+}
+
+// SpawnSQLRecorder creates recorder and starts a listener.
+func SpawnSQLRecorder(db *sql.DB, table string) *sqlRecorder {
+	r := NewSQLRecorder(db, table)
+	go r.Listen()
+	return r
+}
+
+// Intrf returns recorder's interface channels.
+func (R *sqlRecorder) Intrf() RecorderInterface {
+	return RecorderInterface{R.chCtl, R.chMsg, R.id}
+}
+
+// GetID returns recorder's xid.
+func (R *sqlRecorder) GetID() xid.ID {
+	return R.id
+}
+
+// Columns changes names of the table columns (empty names stay default).
+func (R *sqlRecorder) Columns(columns SQLColumns) *sqlRecorder {
+	set := func(dst *string, name string) {
+		if name != "" {
+			*dst = name
+		}
+	}
+	R.Lock()
+	set(&R.columns.Time, columns.Time)
+	set(&R.columns.Severity, columns.Severity)
+	set(&R.columns.Attributes, columns.Attributes)
+	set(&R.columns.Logger, columns.Logger)
+	set(&R.columns.Caller, columns.Caller)
+	set(&R.columns.Content, columns.Content)
+	set(&R.columns.Fields, columns.Fields)
+	set(&R.columns.StackTrace, columns.StackTrace)
+	set(&R.columns.Data, columns.Data)
+	R.Unlock()
+	return R
+}
+
+// Placeholder sets the bind parameter syntax (QuestionMark by default).
+func (R *sqlRecorder) Placeholder(p SQLPlaceholder) *sqlRecorder {
+	R.Lock()
+	R.placeholder = p
+	R.Unlock()
+	return R
+}
+
+// UTC enables conversion of the message time to UTC.
+func (R *sqlRecorder) UTC(enable bool) *sqlRecorder {
+	R.Lock()
+	R.utc = enable
+	R.Unlock()
+	return R
+}
+
+// Batch sets the max number of messages in the transaction (100 by
+// default) and the max time the message waits for the batch to fill.
+func (R *sqlRecorder) Batch(size int, interval time.Duration) *sqlRecorder {
+	R.Lock()
+	R.batchSize = size
+	R.interval = interval
+	R.Unlock()
+	return R
+}
+
+// Timeout sets the transaction timeout (10s by default).
+func (R *sqlRecorder) Timeout(timeout time.Duration) *sqlRecorder {
+	R.Lock()
+	R.timeout = timeout
+	R.Unlock()
+	return R
+}
+
+// Retry sets the max number of attempts to insert the batch (5 by default)
+// and the backoff delays (100ms and 30s by default).
+func (R *sqlRecorder) Retry(attempts int, min, max time.Duration) *sqlRecorder {
+	R.Lock()
+	R.maxAttempts = attempts
+	R.minBackoff = min
+	R.maxBackoff = max
+	R.Unlock()
+	return R
+}
+
+// QueueSize sets the max number of batches waiting for inserting (16 by
+// default). When the queue is full, the oldest batch is dropped.
+func (R *sqlRecorder) QueueSize(size int) *sqlRecorder {
+	R.Lock()
+	R.queueSize = size
+	R.Unlock()
+	return R
+}
+
+// DroppedMessages returns the number of messages which have been dropped
+// (the recorder gave up inserting their batches).
+func (R *sqlRecorder) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&R.dropped)
+}
+
+// Schema returns the CREATE TABLE statement for the configured table and
+// columns. Column types are portable, adjust them for the particular
+// database if needed (e.g. TIMESTAMPTZ and JSONB in PostgreSQL).
+func (R *sqlRecorder) Schema() string {
+	R.RLock()
+	defer R.RUnlock()
+	var defs []string
+	for _, c := range R.sqlColumns() {
+		defs = append(defs, c.name+" "+c.ctype)
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n)",
+		R.table, strings.Join(defs, ",\n\t"))
+}
+
+// CreateTable executes the Schema statement.
+func (R *sqlRecorder) CreateTable(ctx context.Context) error {
+	_, err := R.db.ExecContext(ctx, R.Schema())
+	return err
+}
+
+// -----------------------------------------------------------------------------
+
+func (R *sqlRecorder) Listen() {
+	if R.isListening.Get() {
+		return
+	} else {
+		R.isListening.Set(true)
+		R._log("start listener...")
+	}
+
+	for {
+		select {
+		case sig := <-R.chCtl: // recv control signal
+			switch sig.stype {
+			case SigInit:
+				R._log("RECV INIT SIGNAL")
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R._log("  chan: %v", respErrChan)
+				e := R.initialise()
+				R._log("  send response..")
+				respErrChan <- e
+				R._log("  done")
+			case SigClose:
+				R._log("RECV CLOSE SIGNAL")
+				R.close()
+			case SigFlush, SigReopen: // nothing to reopen
+				R._log("RECV %s SIGNAL", sig.stype)
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				R.seal()
+				if R.chRetry == nil {
+					R.insertQueue()
+				}
+				if n := len(R.queue); n > 0 {
+					respErrChan <- fmt.Errorf("sql: %d batches are waiting for retry", n)
+				} else {
+					respErrChan <- nil
+				}
+			case SigStop:
+				R._log("RECV STOP SIGNAL")
+				R.isListening.Set(false)
+				R._log("stop listener...")
+				return
+
+			case SigSetErrChan:
+				R._log("RECV SET_ERR_CHAN SIGNAL")
+				R.chErr = sig.data.(chan<- error) // MAY PANIC
+			case SigSetDbgChan:
+				R._log("RECV SET_DBG_CHAN SIGNAL")
+				R.chDbg = sig.data.(chan<- debugMessage) // MAY PANIC
+			case SigDropErrChan:
+				R._log("RECV DROP_ERR_CHAN SIGNAL")
+				R.chErr = nil
+			case SigDropDbgChan:
+				R._log("RECV DROP_DBG_CHAN SIGNAL")
+				R.chDbg = nil
+
+			default:
+				R._log("ERROR: received unknown signal (%s)", sig.stype)
+				// DO NOTHING
+			}
+
+		case msg := <-R.chMsg: // write log message
+			R._log("RECV MSG SIGNAL <--\n  msg=%v", msg)
+			R.handle(msg)
+
+		case <-R.chBatch: // batch interval is passed
+			R.chBatch = nil
+			R.seal()
+			if R.chRetry == nil {
+				R.insertQueue()
+			}
+
+		case <-R.chRetry: // retry attempt
+			R.chRetry = nil
+			R.insertQueue()
+		}
+	}
+}
+
+// handle writes the message and reports an error if it occurs.
+func (R *sqlRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		R.reportError(err)
+	}
+}
+
+func (R *sqlRecorder) reportError(err error) {
+	if R.chErr != nil {
+		R.chErr <- err // MAY PANIC
+	}
+}
+
+// drain writes all messages which have been queued before the call.
+func (R *sqlRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
+func (R *sqlRecorder) IsListening() bool {
+	return R.isListening.Get() // rc safe
+}
+
+// ----------------------------------------
+
+func (R *sqlRecorder) initialise() error {
+	if R.refCounter == 0 {
+		R.RLock()
+		timeout := R.timeout
+		R.RUnlock()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := R.db.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	R.refCounter++
+	return nil
+}
+
+func (R *sqlRecorder) close() {
+	if R.refCounter == 0 {
+		return
+	}
+	if R.refCounter == 1 {
+		R.seal()
+		R.stopRetry()
+		R.backoff = 0
+		// the last attempt, without delays; after the first failure the
+		// rest is dropped, so close doesn't wait a timeout for each batch
+		for i, b := range R.queue {
+			if err := R.insert(b); err != nil {
+				b.attempts++
+				for _, b := range R.queue[i:] {
+					R.giveUp(b, err)
+				}
+				break
+			}
+		}
+		R.queue = nil
+	}
+	R.refCounter--
+}
+
+// ----------------------------------------
+
+func (R *sqlRecorder) write(msg LogMsg) error {
+	if R.refCounter == 0 {
+		return ErrNotInitialised
+	}
+	R.RLock()
+	size, interval := R.batchSize, R.interval
+	R.RUnlock()
+
+	R.pending = append(R.pending, msg)
+	if len(R.pending) == 1 && interval > 0 {
+		R.batchTimer = time.NewTimer(interval)
+		R.chBatch = R.batchTimer.C
+	}
+	if len(R.pending) >= size {
+		R.seal()
+		if R.chRetry == nil {
+			R.insertQueue()
+		}
+	}
+	return nil
+}
+
+// seal puts the current batch to the queue.
+func (R *sqlRecorder) seal() {
+	if R.batchTimer != nil {
+		R.batchTimer.Stop()
+		R.batchTimer = nil
+	}
+	R.chBatch = nil
+	if len(R.pending) == 0 {
+		return
+	}
+
+	R.RLock()
+	queueSize := R.queueSize
+	R.RUnlock()
+
+	R.queue = append(R.queue, &sqlBatch{msgs: R.pending})
+	R.pending = nil
+	for queueSize > 0 && len(R.queue) > queueSize {
+		b := R.queue[0]
+		R.queue = R.queue[1:]
+		R.giveUp(b, fmt.Errorf("queue is full"))
+	}
+}
+
+// insertQueue inserts queued batches until the first failure, then it
+// schedules the retry.
+func (R *sqlRecorder) insertQueue() {
+	R.RLock()
+	maxAttempts := R.maxAttempts
+	R.RUnlock()
+
+	for len(R.queue) > 0 {
+		b := R.queue[0]
+		err := R.insert(b)
+		if err == nil {
+			R.queue = R.queue[1:]
+			R.backoff = 0
+			continue
+		}
+		b.attempts++
+		R._log("insert error (attempt %d): %s", b.attempts, err.Error())
+		if b.attempts >= maxAttempts {
+			R.queue = R.queue[1:]
+			R.giveUp(b, err)
+			continue
+		}
+		R.scheduleRetry()
+		return
+	}
+	R.queue = nil
+}
+
+// insert executes the prepared INSERT statement for each message of the
+// batch in the single transaction.
+func (R *sqlRecorder) insert(b *sqlBatch) error {
+	R.RLock()
+	columns := R.sqlColumns()
+	query := R.insertQuery(columns)
+	timeout := R.timeout
+	R.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	tx, err := R.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	args := make([]interface{}, len(columns))
+	for i := range b.msgs {
+		for j, c := range columns {
+			args[j] = c.value(&b.msgs[i])
+		}
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	return tx.Commit()
+}
+
+// insertQuery returns the INSERT statement. It must be called under the
+// read lock.
+func (R *sqlRecorder) insertQuery(columns []sqlColumn) string {
+	names := make([]string, len(columns))
+	params := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+		if R.placeholder == DollarNumber {
+			params[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			params[i] = "?"
+		}
+	}
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		R.table, strings.Join(names, ", "), strings.Join(params, ", "))
+}
+
+// sqlColumns returns the enabled columns in the table order. It must be
+// called under the read lock.
+func (R *sqlRecorder) sqlColumns() []sqlColumn {
+	utc := R.utc
+	all := []sqlColumn{
+		{R.columns.Time, "TIMESTAMP NOT NULL", func(msg *LogMsg) interface{} {
+			if utc {
+				return msg.time.UTC()
+			}
+			return msg.time
+		}},
+		{R.columns.Severity, "VARCHAR(16) NOT NULL", func(msg *LogMsg) interface{} {
+			return (msg.flags &^ SeverityShadowMask).String()
+		}},
+		{R.columns.Attributes, "VARCHAR(64)", func(msg *LogMsg) interface{} {
+			return nullString(strings.Join(attributeNames(msg.flags), ","))
+		}},
+		{R.columns.Logger, "VARCHAR(255)", func(msg *LogMsg) interface{} {
+			return nullString(msg.logger)
+		}},
+		{R.columns.Caller, "TEXT", func(msg *LogMsg) interface{} {
+			if !msg.caller.IsSet() {
+				return nil
+			}
+			return msg.caller.String()
+		}},
+		{R.columns.Content, "TEXT NOT NULL", func(msg *LogMsg) interface{} {
+			return msg.text()
+		}},
+		{R.columns.Fields, "TEXT", func(msg *LogMsg) interface{} {
+			if len(msg.fields) == 0 {
+				return nil
+			}
+			var buf bytes.Buffer
+			w := jsonObjectWriter{buf: &buf}
+			buf.WriteByte('{')
+			for _, f := range msg.fields {
+				w.value(f.Key, jsonFieldValue(f))
+			}
+			buf.WriteByte('}')
+			return buf.String()
+		}},
+		{R.columns.StackTrace, "TEXT", func(msg *LogMsg) interface{} {
+			return nullString(msg.stack)
+		}},
+		{R.columns.Data, "TEXT", func(msg *LogMsg) interface{} {
+			if msg.Data == nil {
+				return nil
+			}
+			var buf bytes.Buffer
+			writeJSON(&buf, msg.Data)
+			return buf.String()
+		}},
+	}
+	columns := all[:0]
+	for _, c := range all {
+		if c.name != "-" {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// nullString returns nil (NULL) for the empty string.
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// giveUp drops the batch and reports it.
+func (R *sqlRecorder) giveUp(b *sqlBatch, err error) {
+	atomic.AddUint64(&R.dropped, uint64(len(b.msgs)))
+	R.reportError(fmt.Errorf("sql: %d messages are dropped after %d attempts: %s",
+		len(b.msgs), b.attempts, err.Error()))
+}
+
+func (R *sqlRecorder) scheduleRetry() {
+	R.RLock()
+	min, max := R.minBackoff, R.maxBackoff
+	R.RUnlock()
+
+	R.backoff *= 2
+	if R.backoff < min {
+		R.backoff = min
+	}
+	if R.backoff > max {
+		R.backoff = max
+	}
+	R.stopRetry()
+	R.retryTimer = time.NewTimer(R.backoff)
+	R.chRetry = R.retryTimer.C
+}
+
+func (R *sqlRecorder) stopRetry() {
+	if R.retryTimer != nil {
+		R.retryTimer.Stop()
+		R.retryTimer = nil
+	}
+	R.chRetry = nil
+}
+
+func (R *sqlRecorder) _log(format string, args ...interface{}) { // MAY PANIC
+	if R.chDbg != nil {
+		msg := DbgMsg(R.id, format, args...)
+		msg.rtype = "sqlRecorder"
+		R.chDbg <- msg
+	}
+}
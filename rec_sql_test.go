@@ -0,0 +1,259 @@
+package xlog
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSQLDriver is a test double for the database driver, it keeps
+// committed rows in memory.
+type fakeSQLDriver struct {
+	sync.Mutex
+	dbs map[string]*fakeSQLDB
+}
+
+type fakeSQLDB struct {
+	queries   []string
+	rows      [][]driver.Value // committed
+	failExecs int              // number of failed inserts
+}
+
+var fakeSQL = &fakeSQLDriver{dbs: make(map[string]*fakeSQLDB)}
+
+func init() {
+	sql.Register("xlogtest", fakeSQL)
+}
+
+// openFakeSQL opens the new empty database.
+func openFakeSQL(t *testing.T, failExecs int) (*sql.DB, *fakeSQLDB) {
+	fakeSQL.Lock()
+	defer fakeSQL.Unlock()
+	fdb := &fakeSQLDB{failExecs: failExecs}
+	fakeSQL.dbs[t.Name()] = fdb
+	db, err := sql.Open("xlogtest", t.Name())
+	if err != nil {
+		t.Fatalf(emsgUnexpectedError, err)
+	}
+	return db, fdb
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	d.Lock()
+	defer d.Unlock()
+	return &fakeSQLConn{db: d.dbs[name]}, nil
+}
+
+func (d *fakeSQLDriver) committed(db *fakeSQLDB) [][]driver.Value {
+	d.Lock()
+	defer d.Unlock()
+	return append([][]driver.Value(nil), db.rows...)
+}
+
+type fakeSQLConn struct {
+	db *fakeSQLDB
+	tx *fakeSQLTx
+}
+
+type fakeSQLTx struct {
+	conn *fakeSQLConn
+	rows [][]driver.Value
+}
+
+type fakeSQLStmt struct {
+	conn  *fakeSQLConn
+	query string
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	fakeSQL.Lock()
+	c.db.queries = append(c.db.queries, query)
+	fakeSQL.Unlock()
+	return &fakeSQLStmt{c, query}, nil
+}
+
+func (c *fakeSQLConn) Close() error { return nil }
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	c.tx = &fakeSQLTx{conn: c}
+	return c.tx, nil
+}
+
+func (tx *fakeSQLTx) Commit() error {
+	fakeSQL.Lock()
+	tx.conn.db.rows = append(tx.conn.db.rows, tx.rows...)
+	fakeSQL.Unlock()
+	tx.conn.tx = nil
+	return nil
+}
+
+func (tx *fakeSQLTx) Rollback() error {
+	tx.conn.tx = nil
+	return nil
+}
+
+func (s *fakeSQLStmt) Close() error  { return nil }
+func (s *fakeSQLStmt) NumInput() int { return -1 }
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.conn.tx == nil { // DDL
+		return driver.RowsAffected(0), nil
+	}
+	fakeSQL.Lock()
+	fail := s.conn.db.failExecs > 0
+	if fail {
+		s.conn.db.failExecs--
+	}
+	fakeSQL.Unlock()
+	if fail {
+		return nil, errors.New("database is locked")
+	}
+	s.conn.tx.rows = append(s.conn.tx.rows, append([]driver.Value(nil), args...))
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+// -----------------------------------------------------------------------------
+
+func TestSQLRecorder(t *testing.T) {
+	db, fdb := openFakeSQL(t, 1) // the first transaction fails
+	defer db.Close()
+
+	r := SpawnSQLRecorder(db, "audit").Columns(SQLColumns{Content: "message", Caller: "-"}).
+		Placeholder(DollarNumber).UTC(true).Batch(2, time.Hour).Retry(3, time.Millisecond, time.Millisecond)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	chErr := make(chan error, 16)
+	r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+	if err := r.CreateTable(context.Background()); err != nil {
+		t.Fatalf(emsgUnexpectedError, err)
+	}
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 6, time.FixedZone("X", 3600))
+	msg := NewLogMsg().SetFlags(Warning|Caller).Setf("user is deleted").Str("user", "bob").Int("id", 7)
+	msg.Data = map[string]interface{}{"by": "admin"}
+	msg.time = stamp
+	_ = l.Named("audit").WriteMsg(nil, msg)
+	_ = l.WriteMsg(nil, NewLogMsg().SetFlags(Error).Setf("second"))
+	for deadline := time.Now().Add(time.Second * 5); len(fakeSQL.committed(fdb)) < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch is not retried")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_ = l.WriteMsg(nil, NewLogMsg().Setf("pending"))
+	flushLogger(t, l)
+
+	rows := fakeSQL.committed(fdb)
+	if len(rows) != 3 {
+		t.Fatalf("wrong number of rows: %d", len(rows))
+	}
+	expected := []driver.Value{stamp.UTC(), "WARNING", "CALLER", "audit", "user is deleted",
+		`{"user":"bob","id":7}`, nil, `{"by":"admin"}`}
+	if len(rows[0]) != len(expected) {
+		t.Fatalf("wrong row: %v", rows[0])
+	}
+	for i, value := range expected {
+		if ts, ok := value.(time.Time); ok {
+			if !ts.Equal(rows[0][i].(time.Time)) || rows[0][i].(time.Time).Location() != time.UTC {
+				t.Errorf("wrong time: %v", rows[0][i])
+			}
+		} else if rows[0][i] != value {
+			t.Errorf("wrong value #%d: %v, expected %v", i, rows[0][i], value)
+		}
+	}
+	if rows[1][1] != "ERROR" || rows[1][3] != nil || rows[1][4] != "second" || rows[2][4] != "pending" {
+		t.Errorf("wrong rows: %v", rows[1:])
+	}
+
+	fakeSQL.Lock()
+	queries := append([]string(nil), fdb.queries...)
+	fakeSQL.Unlock()
+	if !strings.HasPrefix(queries[0], "CREATE TABLE IF NOT EXISTS audit (") ||
+		!strings.Contains(queries[0], "message TEXT NOT NULL") || strings.Contains(queries[0], "caller") {
+		t.Errorf("wrong schema:\n%s", queries[0])
+	}
+	if insert := "INSERT INTO audit (time, severity, attributes, logger, message, fields, stack, data) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"; queries[len(queries)-1] != insert {
+		t.Errorf("wrong query:\n%s", queries[len(queries)-1])
+	}
+
+	select {
+	case err := <-chErr:
+		t.Errorf(emsgUnexpectedError, err)
+	default:
+	}
+}
+
+func TestSQLRecorderGiveUp(t *testing.T) {
+	db, fdb := openFakeSQL(t, 100)
+	defer db.Close()
+
+	r := SpawnSQLRecorder(db, "logs").Batch(1, 0).Retry(2, time.Millisecond, time.Millisecond)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	chErr := make(chan error, 16)
+	r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	_ = l.WriteMsg(nil, NewLogMsg().Setf("lost"))
+	select {
+	case err := <-chErr:
+		if err == nil || err.Error() != "sql: 1 messages are dropped after 2 attempts: database is locked" {
+			t.Errorf("wrong error: %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("error is not reported")
+	}
+	if n := r.DroppedMessages(); n != 1 || len(fakeSQL.committed(fdb)) != 0 {
+		t.Errorf("wrong number of dropped messages: %d", n)
+	}
+}
+
+func TestSQLRecorderCloseGiveUp(t *testing.T) {
+	db, fdb := openFakeSQL(t, 100)
+	defer db.Close()
+
+	r := SpawnSQLRecorder(db, "logs").Batch(1, 0).Retry(5, time.Hour, time.Hour)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	chErr := make(chan error, 16)
+	r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+	l := newTestLogger(t, r.Intrf())
+
+	// the first insert fails, the next batches wait for the retry
+	for i := 0; i < 3; i++ {
+		_ = l.WriteMsg(nil, NewLogMsg().Setf("lost %d", i))
+	}
+	if e := l.Flush(context.Background()); e == nil {
+		t.Errorf("batches are not queued")
+	}
+	l.Close()
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-chErr:
+			if err == nil || !strings.HasPrefix(err.Error(), "sql: 1 messages are dropped") {
+				t.Errorf("wrong error: %v", err)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("error is not reported")
+		}
+	}
+	fakeSQL.Lock()
+	attempts := 100 - fdb.failExecs
+	fakeSQL.Unlock()
+	if attempts != 2 {
+		t.Errorf("close tries the queue after the failure (%d attempts)", attempts)
+	}
+	if n := r.DroppedMessages(); n != 3 {
+		t.Errorf("wrong number of dropped messages: %d", n)
+	}
+}
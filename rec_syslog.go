@@ -2,8 +2,10 @@ package xlog
 
 import (
 	"errors"
+	"fmt"
 	"log/syslog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/xid"
@@ -23,24 +25,54 @@ type syslogRecorder struct {
 	id          xid.ID
 	isListening bool_s // internal mutex
 	refCounter  int
-	prefix      string // can't be changeable
-	logger      *syslog.Writer
+	prefix      string // changes by the listener only (see ChangeTagOnFly)
+
+	// connection per facility, all of them use the same tag
+	writers map[syslog.Priority]*syslog.Writer
+
+	// reconnection state (see rec_syslog_retry.go)
+	pending    []syslogEntry // messages buffered while disconnected
+	dropped    uint64        // total number of dropped messages (atomic)
+	unreported uint64        // dropped since the last report
+	backoff    time.Duration // current reconnection delay
+	retryTimer *time.Timer
+	chRetry    <-chan time.Time
 
 	sync.RWMutex
-	format FormatFunc
+	format     FormatFunc
+	facility   syslog.Priority
+	network    string // syslog daemon address (local by default)
+	raddr      string
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	bufferSize int
 
 	// says which function to use for each severity
 	sevBindings map[MsgFlagT]syslog.Priority
+	// facility overrides for severities
+	facBindings map[MsgFlagT]syslog.Priority
 }
 
-// NewSyslogRecorder allocates and returns a new syslog recorder.
-func NewSyslogRecorder(prefix string) *syslogRecorder {
+// internal signal, it changes the syslog tag (see ChangeTagOnFly)
+const sigSetTag signalType = "SIG_SET_TAG"
+
+// NewSyslogRecorder allocates and returns a new syslog recorder. The prefix
+// is used as the syslog tag. The facility is LOG_USER by default.
+func NewSyslogRecorder(prefix string, facility ...syslog.Priority) *syslogRecorder {
 	r := new(syslogRecorder)
 	r.id = xid.NewWithTime(time.Now())
 	r.chCtl = make(chan controlSignal, 32)
 	r.chMsg = make(chan LogMsg, 64)
 	r.prefix = prefix
+	r.facility = syslog.LOG_USER
+	if len(facility) > 0 {
+		r.facility = facility[0] &^ 0x07 // drop severity bits
+	}
+	r.minBackoff = defaultSyslogMinBackoff
+	r.maxBackoff = defaultSyslogMaxBackoff
+	r.bufferSize = defaultSyslogBufferSize
 	r.sevBindings = make(map[MsgFlagT]syslog.Priority)
+	r.facBindings = make(map[MsgFlagT]syslog.Priority)
 
 	// default bindings
 	r.sevBindings[Emerg] = syslog.LOG_EMERG
@@ -59,8 +91,8 @@ func NewSyslogRecorder(prefix string) *syslogRecorder {
 }
 
 // SpawnSyslogRecorder creates recorder and starts a listener.
-func SpawnSyslogRecorder(prefix string) *syslogRecorder {
-	r := NewSyslogRecorder(prefix)
+func SpawnSyslogRecorder(prefix string, facility ...syslog.Priority) *syslogRecorder {
+	r := NewSyslogRecorder(prefix, facility...)
 	go r.Listen()
 	return r
 }
@@ -86,15 +118,7 @@ func (R *syslogRecorder) BindSeverityFlag(severity MsgFlagT, priority syslog.Pri
 		return ErrWrongFlagValue
 	}
 
-	if // syslog.Priority can contains facility codes
-	priority != syslog.LOG_EMERG &&
-		priority != syslog.LOG_ALERT &&
-		priority != syslog.LOG_CRIT &&
-		priority != syslog.LOG_ERR &&
-		priority != syslog.LOG_WARNING &&
-		priority != syslog.LOG_NOTICE &&
-		priority != syslog.LOG_INFO &&
-		priority != syslog.LOG_DEBUG {
+	if !isSyslogSeverity(priority) {
 		return errWrongPriority
 	}
 
@@ -102,6 +126,44 @@ func (R *syslogRecorder) BindSeverityFlag(severity MsgFlagT, priority syslog.Pri
 	return nil
 }
 
+// BindSeverityFacility sets the facility for messages with the given
+// severity instead of the recorder's one. The change takes effect after
+// the next initialisation (or tag change) if the recorder is initialised.
+func (R *syslogRecorder) BindSeverityFacility(severity MsgFlagT, facility syslog.Priority) error {
+	severity = severity &^ SeverityShadowMask
+
+	R.Lock()
+	defer R.Unlock()
+
+	if _, exist := R.sevBindings[severity]; !exist {
+		return ErrWrongFlagValue
+	}
+	if facility&0x07 != 0 || facility < 0 || facility > syslog.LOG_LOCAL7 {
+		return errWrongPriority
+	}
+
+	R.facBindings[severity] = facility
+	return nil
+}
+
+// ChangeTagOnFly changes the syslog tag. The recorder reconnects with the
+// new tag inside the listener: queued messages are written with the old
+// tag, messages written after the call returns get the new one. It waits
+// until the listener applies the change (so it should be listening).
+func (R *syslogRecorder) ChangeTagOnFly(tag string) error {
+	if !R.IsListening() {
+		return ErrNotListening
+	}
+	chErr := make(chan error, 1)
+	R.chCtl <- controlSignal{sigSetTag, tagChange{tag, chErr}}
+	return <-chErr
+}
+
+type tagChange struct {
+	tag   string
+	chErr chan error
+}
+
 // FormatFunc sets custom formatter function for this recorder.
 func (R *syslogRecorder) FormatFunc(f FormatFunc) *syslogRecorder {
 	R.Lock()
@@ -110,6 +172,40 @@ func (R *syslogRecorder) FormatFunc(f FormatFunc) *syslogRecorder {
 	return R
 }
 
+// Dial sets the address of the syslog daemon (see syslog.Dial). By default
+// the recorder connects to the local daemon.
+func (R *syslogRecorder) Dial(network, raddr string) *syslogRecorder {
+	R.Lock()
+	defer R.Unlock()
+	R.network, R.raddr = network, raddr
+	return R
+}
+
+// Backoff sets the minimum and maximum delays between reconnection
+// attempts (100ms and 30s by default). The delay doubles after each
+// failed attempt.
+func (R *syslogRecorder) Backoff(min, max time.Duration) *syslogRecorder {
+	R.Lock()
+	defer R.Unlock()
+	R.minBackoff, R.maxBackoff = min, max
+	return R
+}
+
+// BufferSize sets how many messages are kept while the recorder is
+// disconnected (256 by default), the oldest ones are dropped first.
+func (R *syslogRecorder) BufferSize(n int) *syslogRecorder {
+	R.Lock()
+	defer R.Unlock()
+	R.bufferSize = n
+	return R
+}
+
+// DroppedMessages returns the number of messages which have been dropped
+// because the buffer was full while the recorder was disconnected.
+func (R *syslogRecorder) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&R.dropped)
+}
+
 // -----------------------------------------------------------------------------
 
 func (R *syslogRecorder) Listen() {
@@ -135,6 +231,15 @@ func (R *syslogRecorder) Listen() {
 			case SigClose:
 				R._log("RECV CLOSE SIGNAL")
 				R.close() // rc safe
+			case SigFlush, SigReopen: // nothing to reopen
+				R._log("RECV %s SIGNAL", sig.stype)
+				respErrChan := sig.data.(chan error) // MAY PANIC
+				R.drain()
+				if n := len(R.pending); n > 0 {
+					respErrChan <- fmt.Errorf("syslog: %d messages are buffered while disconnected", n)
+				} else {
+					respErrChan <- nil
+				}
 			case SigStop:
 				R._log("RECV STOP SIGNAL")
 				R.isListening.Set(false)
@@ -155,6 +260,11 @@ func (R *syslogRecorder) Listen() {
 				R._log("RECV DROP_DBG_CHAN SIGNAL")
 				//close(R.chDbg)
 				R.chDbg = nil
+			case sigSetTag:
+				R._log("RECV SET_TAG SIGNAL")
+				change := sig.data.(tagChange) // MAY PANIC
+				R.drain()
+				change.chErr <- R.setTag(change.tag)
 
 			default:
 				R._log("ERROR: received unknown signal (%s)", sig.stype)
@@ -164,17 +274,37 @@ func (R *syslogRecorder) Listen() {
 
 		case msg := <-R.chMsg: // write log message
 			R._log("RECV MSG SIGNAL <--\n  msg: %v", msg)
-			err := R.write(msg)
-			if err != nil {
-				R._log("write error: %s", err.Error())
-				if R.chErr != nil {
-					R.chErr <- err // MAY PANIC
-				}
-			}
+			R.handle(msg)
+
+		case <-R.chRetry: // reconnection attempt
+			R._log("reconnect")
+			R.retry()
 		}
 	}
 }
 
+// handle writes the message and reports an error if it occurs.
+func (R *syslogRecorder) handle(msg LogMsg) {
+	err := R.write(msg)
+	if err != nil {
+		R._log("write error: %s", err.Error())
+		R.reportError(err)
+	}
+}
+
+func (R *syslogRecorder) reportError(err error) {
+	if R.chErr != nil {
+		R.chErr <- err // MAY PANIC
+	}
+}
+
+// drain writes all messages which have been queued before the call.
+func (R *syslogRecorder) drain() {
+	for n := len(R.chMsg); n > 0; n-- {
+		R.handle(<-R.chMsg)
+	}
+}
+
 func (R *syslogRecorder) IsListening() bool {
 	return R.isListening.Get() // rc safe
 }
@@ -184,11 +314,11 @@ func (R *syslogRecorder) IsListening() bool {
 func (R *syslogRecorder) initialise() error {
 	//if R.refCounter < 0 { R.refCounter = 0 }
 	if R.refCounter == 0 {
-		var err error
-		R.logger, err = syslog.New(syslog.LOG_INFO|syslog.LOG_USER, R.prefix)
+		writers, err := R.connect(R.prefix)
 		if err != nil {
 			return err
 		}
+		R.writers = writers
 	}
 	R.refCounter++
 	return nil
@@ -199,52 +329,165 @@ func (R *syslogRecorder) close() {
 		return
 	}
 	if R.refCounter == 1 {
-		R.logger.Close()
+		if len(R.pending) > 0 { // the last chance to deliver them
+			R.stopRetry()
+			R.retry()
+		}
+		R.stopRetry()
+		R.backoff = 0
+		if n := len(R.pending); n > 0 {
+			R.drop(n)
+			R.pending = nil
+			R.reportError(fmt.Errorf("syslog: %d buffered messages are lost on close", n))
+		}
+		closeSyslogWriters(R.writers)
+		R.writers = nil
 	}
 	R.refCounter--
 }
 
+// connect opens a connection for each facility in use.
+func (R *syslogRecorder) connect(tag string) (map[syslog.Priority]*syslog.Writer, error) {
+	R.RLock()
+	network, raddr := R.network, R.raddr
+	facilities := []syslog.Priority{R.facility}
+	for _, f := range R.facBindings {
+		facilities = append(facilities, f)
+	}
+	R.RUnlock()
+
+	writers := make(map[syslog.Priority]*syslog.Writer)
+	for _, f := range facilities {
+		if _, exist := writers[f]; exist {
+			continue
+		}
+		w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|f, tag)
+		if err != nil {
+			closeSyslogWriters(writers)
+			return nil, err
+		}
+		writers[f] = w
+	}
+	return writers, nil
+}
+
+// setTag reconnects with the new tag. If the recorder is not initialised,
+// the tag is used by the next initialisation.
+func (R *syslogRecorder) setTag(tag string) error {
+	if R.refCounter > 0 {
+		writers, err := R.connect(tag)
+		if err != nil {
+			return fmt.Errorf("tag change fail: %s", err.Error())
+		}
+		closeSyslogWriters(R.writers)
+		R.writers = writers
+		R.prefix = tag
+		if len(R.pending) > 0 { // the recorder was disconnected
+			R.stopRetry()
+			R.backoff = 0
+			R.replay()
+		}
+		return nil
+	}
+	R.prefix = tag
+	return nil
+}
+
+func closeSyslogWriters(writers map[syslog.Priority]*syslog.Writer) {
+	for _, w := range writers {
+		w.Close()
+	}
+}
+
 // ----------------------------------------
 
 func (R *syslogRecorder) write(msg LogMsg) error {
 	if R.refCounter == 0 {
 		return ErrNotInitialised
 	}
-	msgData := msg.content
+	entry, err := R.entry(&msg)
+	if err != nil {
+		return err
+	}
+	if R.writers == nil { // disconnected, the retry timer is running
+		R.buffer(entry)
+		return nil
+	}
+	if err := R.send(entry); err != nil {
+		R.disconnect()
+		R.buffer(entry)
+		return fmt.Errorf("syslog write fail: %s", err.Error())
+	}
+	return nil
+}
+
+// syslogEntry is the formatted message ready for sending.
+type syslogEntry struct {
+	priority syslog.Priority // severity only
+	facility syslog.Priority
+	data     string
+}
+
+func (R *syslogRecorder) entry(msg *LogMsg) (syslogEntry, error) {
+	msgData := msg.text()
 
 	R.RLock()
 	defer R.RUnlock()
 
 	if R.format != nil {
-		msgData = R.format(&msg)
+		msgData = R.format(msg)
+	} else {
+		if msg.caller.IsSet() {
+			msgData = msg.caller.String() + ": " + msgData
+		}
+		if msg.logger != "" {
+			msgData = "[" + msg.logger + "] " + msgData
+		}
+		if len(msg.fields) > 0 {
+			msgData += " " + FormatFields(msg.fields)
+		}
+		msgData = withStackTrace(msgData, msg)
 	}
 	sev := msg.flags &^ SeverityShadowMask
-	if priority, exist := R.sevBindings[sev]; exist {
-		switch priority { // WRITE
-		case syslog.LOG_EMERG:
-			R.logger.Emerg(msgData)
-		case syslog.LOG_ALERT:
-			R.logger.Alert(msgData)
-		case syslog.LOG_CRIT:
-			R.logger.Crit(msgData)
-		case syslog.LOG_ERR:
-			R.logger.Err(msgData)
-		case syslog.LOG_WARNING:
-			R.logger.Warning(msgData)
-		case syslog.LOG_NOTICE:
-			R.logger.Notice(msgData)
-		case syslog.LOG_INFO:
-			R.logger.Info(msgData)
-		case syslog.LOG_DEBUG:
-			R.logger.Debug(msgData)
-		default:
-			return internalError("unexpected priority value (unreachable)")
-		}
-	} else {
-		return ErrWrongFlagValue
+	priority, exist := R.sevBindings[sev]
+	if !exist {
+		return syslogEntry{}, ErrWrongFlagValue
 	}
+	facility, exist := R.facBindings[sev]
+	if !exist {
+		facility = R.facility
+	}
+	return syslogEntry{priority, facility, msgData}, nil
+}
 
-	return nil
+// send writes the entry by the writer of its facility.
+func (R *syslogRecorder) send(entry syslogEntry) error {
+	logger, exist := R.writers[entry.facility]
+	if !exist { // the binding was set after the initialisation
+		R.RLock()
+		logger = R.writers[R.facility]
+		R.RUnlock()
+	}
+	switch entry.priority { // WRITE
+	case syslog.LOG_EMERG:
+		return logger.Emerg(entry.data)
+	case syslog.LOG_ALERT:
+		return logger.Alert(entry.data)
+	case syslog.LOG_CRIT:
+		return logger.Crit(entry.data)
+	case syslog.LOG_ERR:
+		return logger.Err(entry.data)
+	case syslog.LOG_WARNING:
+		return logger.Warning(entry.data)
+	case syslog.LOG_NOTICE:
+		return logger.Notice(entry.data)
+	case syslog.LOG_INFO:
+		return logger.Info(entry.data)
+	case syslog.LOG_DEBUG:
+		return logger.Debug(entry.data)
+	default:
+		return internalError("unexpected priority value (unreachable)")
+	}
 }
 
 func (R *syslogRecorder) _log(format string, args ...interface{}) {
@@ -0,0 +1,114 @@
+package xlog
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// When the syslog daemon is not available (e.g. it's restarting), the
+// recorder closes its writers and re-dials them with exponential backoff.
+// Meanwhile messages are kept in the buffer and sent in order after the
+// reconnection. If the buffer is full, the oldest messages are dropped,
+// the number of dropped messages is reported by a synthetic message.
+
+const defaultSyslogBufferSize = 256
+
+// disconnect closes the writers and schedules the reconnection.
+func (R *syslogRecorder) disconnect() {
+	closeSyslogWriters(R.writers)
+	R.writers = nil
+	R.scheduleRetry()
+}
+
+// buffer keeps the entry until the reconnection.
+func (R *syslogRecorder) buffer(entry syslogEntry) {
+	R.RLock()
+	size := R.bufferSize
+	R.RUnlock()
+
+	if size <= 0 {
+		R.drop(1)
+		return
+	}
+	if len(R.pending) >= size {
+		n := len(R.pending) - size + 1
+		R.pending = R.pending[n:]
+		R.drop(n)
+	}
+	R.pending = append(R.pending, entry)
+}
+
+func (R *syslogRecorder) drop(n int) {
+	atomic.AddUint64(&R.dropped, uint64(n))
+	R.unreported += uint64(n)
+}
+
+func (R *syslogRecorder) scheduleRetry() {
+	R.RLock()
+	min, max := R.minBackoff, R.maxBackoff
+	R.RUnlock()
+
+	R.backoff *= 2
+	if R.backoff < min {
+		R.backoff = min
+	}
+	if R.backoff > max {
+		R.backoff = max
+	}
+	R.stopRetry()
+	R.retryTimer = time.NewTimer(R.backoff)
+	R.chRetry = R.retryTimer.C
+}
+
+func (R *syslogRecorder) stopRetry() {
+	if R.retryTimer != nil {
+		R.retryTimer.Stop()
+		R.retryTimer = nil
+	}
+	R.chRetry = nil
+}
+
+// retry re-dials the writers and sends buffered messages.
+func (R *syslogRecorder) retry() {
+	R.chRetry = nil
+	if R.refCounter == 0 || R.writers != nil {
+		return
+	}
+	writers, err := R.connect(R.prefix)
+	if err != nil {
+		R.scheduleRetry()
+		R.reportError(fmt.Errorf("syslog reconnect fail: %s", err.Error()))
+		return
+	}
+	R._log("reconnected, %d messages are buffered", len(R.pending))
+	R.writers = writers
+	R.backoff = 0
+	R.replay()
+}
+
+// replay sends the drop report and buffered messages in order.
+func (R *syslogRecorder) replay() {
+	if R.unreported > 0 {
+		msg := NewLogMsg().SetFlags(Warning).
+			Setf("xlog: %d messages dropped while disconnected", R.unreported)
+		msg.Uint("dropped", R.unreported)
+		if entry, err := R.entry(msg); err == nil {
+			if err := R.send(entry); err != nil {
+				R.disconnect()
+				R.reportError(fmt.Errorf("syslog write fail: %s", err.Error()))
+				return
+			}
+		}
+		R.unreported = 0
+	}
+	for len(R.pending) > 0 {
+		if err := R.send(R.pending[0]); err != nil {
+			R.disconnect()
+			R.reportError(fmt.Errorf("syslog write fail: %s", err.Error()))
+			return
+		}
+		R.pending = R.pending[1:]
+	}
+	R.pending = nil
+}
@@ -0,0 +1,167 @@
+package xlog
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syslogDaemon is a test double for the local syslog socket.
+type syslogDaemon struct {
+	path string
+	conn net.PacketConn
+	msgs chan string
+}
+
+func newSyslogDaemon(t *testing.T) *syslogDaemon {
+	dir, err := ioutil.TempDir("", "xlog-test")
+	if err != nil {
+		t.Fatalf("TempDir() error\n%s", err.Error())
+	}
+	d := &syslogDaemon{path: filepath.Join(dir, "log"), msgs: make(chan string, 64)}
+	d.start(t)
+	return d
+}
+
+func (d *syslogDaemon) start(t *testing.T) {
+	conn, err := net.ListenPacket("unixgram", d.path)
+	if err != nil {
+		t.Fatalf("ListenPacket() error\n%s", err.Error())
+	}
+	d.conn = conn
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			d.msgs <- string(buf[:n])
+		}
+	}()
+}
+
+// restart emulates the daemon restart: the socket is removed until the
+// returned function is called.
+func (d *syslogDaemon) restart(t *testing.T) func() {
+	d.conn.Close()
+	os.Remove(d.path)
+	return func() { d.start(t) }
+}
+
+func (d *syslogDaemon) stop() {
+	d.conn.Close()
+	os.RemoveAll(filepath.Dir(d.path))
+}
+
+func (d *syslogDaemon) recv(t *testing.T) string {
+	select {
+	case msg := <-d.msgs:
+		return msg
+	case <-time.After(time.Second * 5):
+		t.Fatalf("message is not received")
+		return ""
+	}
+}
+
+func TestSyslogRecorder(t *testing.T) {
+	d := newSyslogDaemon(t)
+	defer d.stop()
+
+	r := NewSyslogRecorder("first-tag", syslog.LOG_LOCAL1).Dial("unixgram", d.path)
+	if err := r.BindSeverityFacility(Critical, syslog.LOG_AUTH); err != nil {
+		t.Fatalf(emsgUnexpectedError, err)
+	}
+	if err := r.BindSeverityFacility(Critical, syslog.LOG_AUTH|syslog.LOG_ERR); err != errWrongPriority {
+		t.Errorf(emsgUnexpectedError, err)
+	}
+	go r.Listen()
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	// <PRI> = facility | severity
+	_ = l.Write(Info, "info")
+	if msg := d.recv(t); !strings.HasPrefix(msg, "<142>") || !strings.Contains(msg, " first-tag[") {
+		t.Errorf("wrong message\n%s", msg)
+	}
+	_ = l.Write(Critical, "critical")
+	if msg := d.recv(t); !strings.HasPrefix(msg, "<34>") {
+		t.Errorf("facility override is not applied\n%s", msg)
+	}
+
+	// queued messages are written with the old tag
+	for i := 0; i < 3; i++ {
+		_ = l.Write(Info, "queued")
+	}
+	if err := r.ChangeTagOnFly("second-tag"); err != nil {
+		t.Fatalf(emsgUnexpectedError, err)
+	}
+	_ = l.Write(Info, "after")
+	flushLogger(t, l)
+	for i := 0; i < 3; i++ {
+		if msg := d.recv(t); !strings.Contains(msg, " first-tag[") || !strings.HasSuffix(msg, "queued\n") {
+			t.Errorf("wrong message before the tag change\n%s", msg)
+		}
+	}
+	if msg := d.recv(t); !strings.Contains(msg, " second-tag[") || !strings.HasSuffix(msg, "after\n") {
+		t.Errorf("wrong message after the tag change\n%s", msg)
+	}
+}
+
+func TestSyslogRecorderReconnect(t *testing.T) {
+	d := newSyslogDaemon(t)
+	defer d.stop()
+
+	r := SpawnSyslogRecorder("tag").Dial("unixgram", d.path).
+		Backoff(time.Millisecond, time.Millisecond*10).BufferSize(3)
+	defer func() { r.Intrf().ChCtl <- SignalStop() }()
+	chErr := make(chan error, 1024) // reconnection errors as well
+	r.Intrf().ChCtl <- SignalSetErrChan(chErr)
+	l := newTestLogger(t, r.Intrf())
+	defer l.Close()
+
+	_ = l.Write(Info, "before")
+	if msg := d.recv(t); !strings.HasSuffix(msg, "before\n") {
+		t.Fatalf("wrong message\n%s", msg)
+	}
+
+	start := d.restart(t)
+	for i := 0; i < 5; i++ {
+		_ = l.Write(Info, "buffered %d", i)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := l.Flush(ctx); err == nil {
+		t.Errorf("buffered messages are not reported by Flush()")
+	}
+	select {
+	case err := <-chErr:
+		if !strings.HasPrefix(err.Error(), "syslog write fail") {
+			t.Errorf(emsgUnexpectedError, err)
+		}
+	default:
+		t.Errorf("write error is not reported")
+	}
+	if n := r.DroppedMessages(); n != 2 {
+		t.Errorf("wrong number of dropped messages (%d/2)", n)
+	}
+
+	start()
+	if msg := d.recv(t); !strings.Contains(msg, "xlog: 2 messages dropped while disconnected dropped=2") {
+		t.Errorf("dropped messages are not reported\n%s", msg)
+	}
+	for i := 2; i < 5; i++ {
+		if msg := d.recv(t); !strings.HasSuffix(msg, fmt.Sprintf("buffered %d\n", i)) {
+			t.Errorf("wrong order of buffered messages\n%s", msg)
+		}
+	}
+	flushLogger(t, l)
+}
@@ -2,11 +2,18 @@ package xlog
 
 import (
 	"container/list"
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/rs/xid"
@@ -45,6 +52,7 @@ const ( // severity flags (log level)
 
 const ( // attribute flags
 	StackTrace      MsgFlagT = 0x100 // 0000 0001 0000 0000
+	Caller          MsgFlagT = 0x200 // 0000 0010 0000 0000
 	StackTraceShort MsgFlagT = 0x800 // 0000 1000 0000 0000
 
 	CustomB3 MsgFlagT = 0x4000 // 0100 0000 0000 0000
@@ -175,6 +183,10 @@ type LogMsg struct {
 	time    time.Time
 	flags   MsgFlagT
 	content string
+	fields  []Field     // ordered key/value fields
+	logger  string      // name of the logger (sets by child loggers)
+	caller  CallerInfo  // sets only if Caller flag specified
+	stack   string      // sets only if StackTrace* flag specified
 	Data    interface{} // extra data
 }
 
@@ -227,6 +239,69 @@ func (LM *LogMsg) GetTime() time.Time { return LM.time }
 func (LM *LogMsg) GetFlags() MsgFlagT { return LM.flags }
 func (LM *LogMsg) GetContent() string { return LM.content }
 
+// GetLoggerName returns dotted name of the logger which wrote the message.
+func (LM *LogMsg) GetLoggerName() string { return LM.logger }
+
+// GetCaller returns information about the code which wrote the message.
+// It's available only if the message has been written with Caller flag.
+func (LM *LogMsg) GetCaller() CallerInfo { return LM.caller }
+
+// GetStackTrace returns the stack trace captured for the message written
+// with StackTrace or StackTraceShort flag, otherwise an empty string.
+func (LM *LogMsg) GetStackTrace() string { return LM.stack }
+
+// withStackTrace appends the message's stack trace (if any) to the string
+// in the classic text form. It's used by the default formatters.
+func withStackTrace(str string, msg *LogMsg) string {
+	if msg.stack == "" {
+		return str
+	}
+	return str + stackTraceBlock(msg.stack)
+}
+
+func stackTraceBlock(stack string) string {
+	return "\n---------- stack trace ----------   " + stack +
+		"---------------------------------"
+}
+
+// text returns the content without the stack trace appended by the logger.
+// It's used by formatters which render the stack trace separately.
+func (LM *LogMsg) text() string {
+	if LM.stack == "" {
+		return LM.content
+	}
+	return strings.TrimSuffix(LM.content, stackTraceBlock(LM.stack))
+}
+
+// CallerInfo describes the place in the code where the message was written.
+type CallerInfo struct {
+	File string // full file path
+	Line int
+	Func string // full function name (with package path)
+}
+
+// IsSet returns true if the caller info has been captured.
+func (c CallerInfo) IsSet() bool { return c.Line != 0 }
+
+// String returns the caller in the short form: "file.go:123".
+func (c CallerInfo) String() string {
+	if !c.IsSet() {
+		return ""
+	}
+	return filepath.Base(c.File) + ":" + strconv.Itoa(c.Line)
+}
+
+// captureCaller returns the caller info. The argument is the number of
+// stack frames to skip, with 0 identifying the caller of captureCaller.
+func captureCaller(skip int) CallerInfo {
+	var pc [1]uintptr
+	if runtime.Callers(skip+2, pc[:]) == 0 {
+		return CallerInfo{}
+	}
+	frame, _ := runtime.CallersFrames(pc[:]).Next()
+	return CallerInfo{File: frame.File, Line: frame.Line, Func: frame.Function}
+}
+
 // -----------------------------------------------------------------------------
 
 type signalType string
@@ -237,9 +312,11 @@ type controlSignal struct {
 }
 
 const (
-	SigInit  signalType = "SIG_INIT"
-	SigClose signalType = "SIG_CLOSE"
-	SigStop  signalType = "SIG_STOP"
+	SigInit   signalType = "SIG_INIT"
+	SigClose  signalType = "SIG_CLOSE"
+	SigStop   signalType = "SIG_STOP"
+	SigFlush  signalType = "SIG_FLUSH"
+	SigReopen signalType = "SIG_REOPEN"
 
 	SigSetErrChan  signalType = "SIG_SET_ERR"
 	SigSetDbgChan  signalType = "SIG_SET_DBG"
@@ -250,6 +327,8 @@ const (
 func SignalInit(chErr chan error) controlSignal         { return controlSignal{SigInit, chErr} }
 func SignalClose() controlSignal                        { return controlSignal{SigClose, nil} }
 func SignalStop() controlSignal                         { return controlSignal{SigStop, nil} }
+func SignalFlush(chErr chan error) controlSignal        { return controlSignal{SigFlush, chErr} }
+func SignalReopen(chErr chan error) controlSignal       { return controlSignal{SigReopen, chErr} }
 func SignalSetErrChan(chErr chan<- error) controlSignal { return controlSignal{SigSetErrChan, chErr} }
 func SignalSetDbgChan(chDbg chan<- debugMessage) controlSignal {
 	return controlSignal{SigSetDbgChan, chDbg}
@@ -302,6 +381,18 @@ type Logger struct {
 	// determines the severity order for each recorder
 	severityOrder map[RecorderID]*list.List
 
+	// logger's queues for recorders with non-blocking overflow policies
+	pumps map[RecorderID]*recorderPump
+
+	// Child loggers share all the fields above with the parent. The
+	// child's severityMasks contains overrides only, other maps are nil.
+	parent *Logger
+	name   string  // dotted logger name
+	fields []Field // bound fields, stamped on every message
+
+	// number of additional stack frames to skip for Caller flag
+	callerSkip int
+
 	// it used for tests, shouldn't be exported or documented
 	_falseInit _recList
 }
@@ -332,7 +423,60 @@ func NewLogger() *Logger {
 	return l
 }
 
+// Child creates a new logger which shares recorders, defaults, severity masks
+// and severity orders with this logger. Every message written through the
+// child logger will be stamped with the given fields (and the fields bound
+// to this logger). Severity masks can be overridden for the child logger by
+// SetSeverityMask, changes of the parent's masks are propagated otherwise.
+func (L *Logger) Child(fields ...Field) *Logger {
+	c := new(Logger)
+	c.parent = L
+	c.name = L.name
+	c.callerSkip = L.callerSkip
+	c.fields = make([]Field, 0, len(L.fields)+len(fields))
+	c.fields = append(c.fields, L.fields...)
+	c.fields = append(c.fields, fields...)
+	c.severityMasks = make(map[RecorderID]MsgFlagT)
+	return c
+}
+
+// Named creates a child logger with the given name. The name is joined to
+// the name of this logger using a dot (e.g. "app" -> "app.db").
+func (L *Logger) Named(name string) *Logger {
+	c := L.Child()
+	if L.name != "" && name != "" {
+		c.name = L.name + "." + name
+	} else if name != "" {
+		c.name = name
+	}
+	return c
+}
+
+// WithCallerSkip creates a child logger which skips additional stack frames
+// when it captures the caller (see Caller flag). It's used by wrapper helpers
+// to report the place where the helper has been called.
+func (L *Logger) WithCallerSkip(skip int) *Logger {
+	c := L.Child()
+	c.callerSkip += skip
+	return c
+}
+
+// Name returns dotted name of the logger ("" for the root logger).
+func (L *Logger) Name() string { return L.name }
+
+// root returns the logger which owns recorders.
+func (L *Logger) root() *Logger {
+	for L.parent != nil {
+		L = L.parent
+	}
+	return L
+}
+
 func (L *Logger) NumberOfRecorders() int {
+	if L.parent != nil {
+		return L.root().NumberOfRecorders()
+	}
+
 	L.RLock()
 	defer L.RUnlock()
 	return len(L.recorders)
@@ -347,16 +491,34 @@ func (L *Logger) RegisterRecorder(
 	intrf RecorderInterface,
 	asDefault ...bool,
 ) error {
+	return L.RegisterRecorderWithPolicy(id, intrf, OverflowPolicy{}, asDefault...)
+}
+
+// RegisterRecorderWithPolicy does the same as RegisterRecorder, but also sets
+// the overflow policy which determines what to do when the recorder's queue
+// is full. RegisterRecorder uses OverflowBlock policy.
+func (L *Logger) RegisterRecorderWithPolicy(
+	id RecorderID,
+	intrf RecorderInterface,
+	policy OverflowPolicy,
+	asDefault ...bool,
+) error {
 
 	if CfgGlobalDisable.Get() {
 		return nil
 	}
+	if L.parent != nil {
+		return L.root().RegisterRecorderWithPolicy(id, intrf, policy, asDefault...)
+	}
 	if id == RecorderID("") {
 		return ErrWrongParameter
 	}
 	if intrf.ChCtl == nil || intrf.ChMsg == nil {
 		return ErrWrongParameter
 	}
+	if !policy.valid() {
+		return ErrWrongParameter
+	}
 
 	if len(asDefault) == 0 {
 		asDefault = append(asDefault, true)
@@ -413,6 +575,15 @@ func (L *Logger) RegisterRecorder(
 	}
 	L.severityOrder[id] = defaultSeverityOrder()
 
+	// start the logger's queue for non-blocking policies
+	if policy.Mode != OverflowBlock {
+		if L.pumps == nil {
+			L.pumps = make(map[RecorderID]*recorderPump)
+		}
+		// the pump is started at the recorder initialisation
+		L.pumps[id] = newRecorderPump(intrf.ChMsg, policy)
+	}
+
 	L.initialised = false
 	return nil
 }
@@ -423,6 +594,9 @@ func (L *Logger) UnregisterRecorder(id RecorderID) error {
 	if CfgGlobalDisable.Get() {
 		return nil
 	}
+	if L.parent != nil {
+		return L.root().UnregisterRecorder(id)
+	}
 	if id == RecorderID("") {
 		return ErrWrongParameter
 	}
@@ -480,6 +654,10 @@ func (L *Logger) UnregisterRecorder(id RecorderID) error {
 	delete(L.recordersInit, id)
 	delete(L.severityMasks, id)
 	delete(L.severityOrder, id)
+	if pump, exist := L.pumps[id]; exist {
+		pump.stop() // releases blocked writers
+		delete(L.pumps, id)
+	}
 
 	L.Unlock()
 	return nil
@@ -490,6 +668,9 @@ func (L *Logger) Initialise(objects ...ListOfRecorders) error {
 	if CfgGlobalDisable.Get() {
 		return nil
 	}
+	if L.parent != nil {
+		return L.root().Initialise(objects...)
+	}
 
 	L.Lock()
 	defer L.Unlock()
@@ -540,6 +721,9 @@ main_cycle:
 					br.Fail(id, _ErrFalseInit)
 				} else { // REGULAR
 					L.recordersInit[id] = true
+					if pump, exist := L.pumps[id]; exist {
+						pump.start()
+					}
 					br.OK(id)
 				}
 			}
@@ -563,22 +747,248 @@ main_cycle:
 
 // Close disconnects (sends a close signal) all registered recorders
 // and sets the 'uninitialised' state for the logger. Meanwhile, it
-// does not unregister (remove from the logger) recorders.
+// does not unregister (remove from the logger) recorders. The logger's
+// queues (see OverflowPolicy) are drained before the close signal.
 func (L *Logger) Close() {
+	if L.parent != nil {
+		L.root().Close()
+		return
+	}
+	L.close(context.Background())
+}
+
+// close drains and stops the logger's queues of the initialised recorders
+// and sends them the close signal. It returns BatchResult with recorders
+// which queues are not drained until the context expires.
+func (L *Logger) close(ctx context.Context) BatchResult {
 	L.Lock()
 	defer L.Unlock()
 
+	br := BatchResult{}
 	if !L.initialised {
-		return
+		return br
 	}
 	if len(L.recorders) == 0 {
-		return
+		return br
 	}
-	for _, rec := range L.recorders {
-		rec.ChCtl <- SignalClose()
+	for id, rec := range L.recorders {
+		if L.recordersInit[id] {
+			if pump, exist := L.pumps[id]; exist {
+				if err := pump.wait(ctx); err != nil {
+					br.Fail(id, err)
+				}
+				pump.stop()
+				// the next Initialise call starts it again
+				L.pumps[id] = pump.renew()
+			}
+			rec.ChCtl <- SignalClose()
+			// the next Initialise call should initialise it again
+			L.recordersInit[id] = false
+		}
 	}
 
 	L.initialised = false
+	return br
+}
+
+// Flush sends a flush signal to each initialised recorder and waits until
+// the recorders write all messages queued before the signal. If the context
+// expires first, it returns BatchResult with the recorders which did not
+// finish writing (with the context error).
+func (L *Logger) Flush(ctx context.Context) error {
+	if CfgGlobalDisable.Get() {
+		return nil
+	}
+	if L.parent != nil {
+		return L.root().Flush(ctx)
+	}
+
+	recorders, pumps, err := L.initialisedRecorders()
+	if err != nil {
+		return err
+	}
+	br := signalRecorders(ctx, recorders, pumps, SignalFlush)
+	br.SetMsg("some of the recorders are not drained")
+	if br.GetErrors() != nil {
+		return br
+	}
+	return nil
+}
+
+// Reopen asks all initialised recorders to reopen their files (e.g. after
+// external rotation by logrotate). Messages which have been written before
+// the call go to the old file. Recorders without own files just respond OK.
+// It returns BatchResult for recorders which failed to reopen the file or
+// didn't respond until the context expires.
+func (L *Logger) Reopen(ctx context.Context) error {
+	if CfgGlobalDisable.Get() {
+		return nil
+	}
+	if L.parent != nil {
+		return L.root().Reopen(ctx)
+	}
+
+	recorders, pumps, err := L.initialisedRecorders()
+	if err != nil {
+		return err
+	}
+	br := signalRecorders(ctx, recorders, pumps, SignalReopen)
+	br.SetMsg("some of the recorders are not reopened")
+	if br.GetErrors() != nil {
+		return br
+	}
+	return nil
+}
+
+// how long the signal handler waits for recorders to reopen their files
+const reopenTimeout = time.Second * 10
+
+// ReopenOnSignal calls Reopen when the process receives one of the given
+// OS signals (SIGHUP and SIGUSR1 by default). Errors are sent to the chErr
+// channel if it's not nil. The returned function stops the handler.
+func (L *Logger) ReopenOnSignal(chErr chan<- error, sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP, syscall.SIGUSR1}
+	}
+	chSig := make(chan os.Signal, 1)
+	signal.Notify(chSig, sigs...)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-chSig:
+				ctx, cancel := context.WithTimeout(context.Background(), reopenTimeout)
+				err := L.Reopen(ctx)
+				cancel()
+				if err != nil && chErr != nil {
+					chErr <- err
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(chSig)
+			close(done)
+		})
+	}
+}
+
+// Shutdown flushes all initialised recorders, closes the logger and waits
+// until the recorders process the close signal. Messages written between
+// the flush and the close are drained from the logger's queues as well
+// (until the context expires). It returns the same errors as Flush does.
+func (L *Logger) Shutdown(ctx context.Context) error {
+	if CfgGlobalDisable.Get() {
+		return nil
+	}
+	if L.parent != nil {
+		return L.root().Shutdown(ctx)
+	}
+
+	recorders, pumps, err := L.initialisedRecorders()
+	if err != nil {
+		return err
+	}
+	br := signalRecorders(ctx, recorders, pumps, SignalFlush)
+	// messages queued after the flush are drained by close
+	for recID, err := range L.close(ctx).GetErrors() {
+		if _, failed := br.GetErrors()[recID]; !failed {
+			br.Fail(recID, err)
+		}
+	}
+	// signals are processed in order, so the second barrier
+	// guarantees that the close signal has been handled
+	closed := signalRecorders(ctx, recorders, nil, SignalFlush)
+	for recID, err := range closed.GetErrors() {
+		if _, failed := br.GetErrors()[recID]; !failed {
+			br.Fail(recID, err)
+		}
+	}
+	br.SetMsg("some of the recorders are not drained")
+	if br.GetErrors() != nil {
+		return br
+	}
+	return nil
+}
+
+// initialisedRecorders returns a copy of initialised recorders list
+// and the logger's queues of these recorders.
+func (L *Logger) initialisedRecorders() (
+	map[RecorderID]RecorderInterface, map[RecorderID]*recorderPump, error,
+) {
+	L.RLock()
+	defer L.RUnlock()
+
+	if len(L.recorders) == 0 {
+		return nil, nil, ErrNoRecorders
+	}
+	recorders := make(map[RecorderID]RecorderInterface)
+	pumps := make(map[RecorderID]*recorderPump)
+	for id, rec := range L.recorders {
+		if L.recordersInit[id] {
+			recorders[id] = rec
+			if pump, exist := L.pumps[id]; exist {
+				pumps[id] = pump
+			}
+		}
+	}
+	if len(recorders) == 0 {
+		return nil, nil, ErrNotInitialised
+	}
+	return recorders, pumps, nil
+}
+
+// signalRecorders sends the signal with a response channel (flush or reopen)
+// to the given recorders (after their queues are passed) and waits for the
+// responses until the context expires.
+func signalRecorders(
+	ctx context.Context,
+	recorders map[RecorderID]RecorderInterface,
+	pumps map[RecorderID]*recorderPump,
+	newSignal func(chan error) controlSignal,
+) BatchResult {
+
+	br := BatchResult{}
+	responses := make(map[RecorderID]chan error)
+	for id, rec := range recorders {
+		if pump, exist := pumps[id]; exist {
+			if err := pump.wait(ctx); err != nil {
+				br.Fail(id, err)
+				continue
+			}
+		}
+		chErr := make(chan error, 1) // late response shouldn't lock recorder
+		select {
+		case rec.ChCtl <- newSignal(chErr):
+			responses[id] = chErr
+		case <-ctx.Done():
+			br.Fail(id, ctx.Err())
+		}
+	}
+	for id, chErr := range responses {
+		var err error
+		select {
+		case err = <-chErr:
+		case <-ctx.Done():
+			select { // the response may be ready as well
+			case err = <-chErr:
+			default:
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			br.Fail(id, err)
+		} else {
+			br.OK(id)
+		}
+	}
+	return br
 }
 
 // DefaultsSet sets given recorders as default for this logger.
@@ -586,6 +996,9 @@ func (L *Logger) DefaultsSet(recorders []RecorderID) error {
 	if CfgGlobalDisable.Get() {
 		return nil
 	}
+	if L.parent != nil {
+		return L.root().DefaultsSet(recorders)
+	}
 
 	L.Lock()
 	defer L.Unlock()
@@ -622,6 +1035,9 @@ func (L *Logger) DefaultsAdd(recorders []RecorderID) error {
 	if CfgGlobalDisable.Get() {
 		return nil
 	}
+	if L.parent != nil {
+		return L.root().DefaultsAdd(recorders)
+	}
 
 	L.Lock()
 	defer L.Unlock()
@@ -667,6 +1083,9 @@ func (L *Logger) DefaultsRemove(recorders []RecorderID) error {
 	if CfgGlobalDisable.Get() {
 		return nil
 	}
+	if L.parent != nil {
+		return L.root().DefaultsRemove(recorders)
+	}
 
 	L.Lock()
 	defer L.Unlock()
@@ -717,6 +1136,9 @@ func (L *Logger) ChangeSeverityOrder(
 	if CfgGlobalDisable.Get() {
 		return nil
 	}
+	if L.parent != nil {
+		return L.root().ChangeSeverityOrder(recorder, srcFlag, dir, trgFlag)
+	}
 	if recorder == RecorderID("") {
 		return ErrWrongParameter
 	}
@@ -807,6 +1229,7 @@ func (L *Logger) ChangeSeverityOrder(
 }
 
 // SetSeverityMask sets which severities allowed for the given recorder in this logger.
+// For the child logger it sets an override which takes precedence over the parent's mask.
 func (L *Logger) SetSeverityMask(recorder RecorderID, flags MsgFlagT) error {
 	if CfgGlobalDisable.Get() {
 		return nil
@@ -814,6 +1237,15 @@ func (L *Logger) SetSeverityMask(recorder RecorderID, flags MsgFlagT) error {
 	if recorder == RecorderID("") {
 		return ErrWrongParameter
 	}
+	if L.parent != nil {
+		if err := L.root().checkRecorder(recorder); err != nil {
+			return err
+		}
+		L.Lock()
+		L.severityMasks[recorder] = flags &^ SeverityShadowMask
+		L.Unlock()
+		return nil
+	}
 
 	L.Lock()
 	defer L.Unlock()
@@ -837,11 +1269,69 @@ func (L *Logger) SetSeverityMask(recorder RecorderID, flags MsgFlagT) error {
 	} else {
 		// zero is allowed (recorder blocked) //
 		L.severityMasks[recorder] = flags &^ SeverityShadowMask
+		if pump, exist := L.pumps[recorder]; exist {
+			pump.setMask(flags &^ SeverityShadowMask)
+		}
 	}
 
 	return nil
 }
 
+// DroppedMessages returns the total number of messages dropped
+// by the overflow policy of the given recorder.
+func (L *Logger) DroppedMessages(recorder RecorderID) (uint64, error) {
+	if L.parent != nil {
+		return L.root().DroppedMessages(recorder)
+	}
+
+	L.RLock()
+	defer L.RUnlock()
+
+	if _, exist := L.recorders[recorder]; !exist {
+		return 0, ErrWrongRecorderID
+	}
+	if pump, exist := L.pumps[recorder]; exist {
+		return atomic.LoadUint64(&pump.dropped), nil
+	}
+	return 0, nil
+}
+
+// ResetSeverityMask drops the child's severity mask override for the given
+// recorder, so the mask will be inherited from the parent again. The root
+// logger has no overrides, it returns ErrRootLogger and keeps the mask
+// (use SetSeverityMask to change it).
+func (L *Logger) ResetSeverityMask(recorder RecorderID) error {
+	if CfgGlobalDisable.Get() {
+		return nil
+	}
+	if recorder == RecorderID("") {
+		return ErrWrongParameter
+	}
+	if L.parent == nil {
+		return ErrRootLogger
+	}
+	if err := L.root().checkRecorder(recorder); err != nil {
+		return err
+	}
+	L.Lock()
+	delete(L.severityMasks, recorder)
+	L.Unlock()
+	return nil
+}
+
+// checkRecorder returns an error if the recorder is not registered.
+func (L *Logger) checkRecorder(recorder RecorderID) error {
+	L.RLock()
+	defer L.RUnlock()
+	if len(L.recorders) == 0 {
+		return ErrNoRecorders
+	}
+	if _, exist := L.recorders[recorder]; !exist {
+		return ErrWrongRecorderID
+	}
+	return nil
+}
+
 // Write builds the message with format line and specified message flags, then calls
 // WriteMsg. It allows avoiding calling fmt.Sprintf() function and LogMsg's functions
 // directly, it wraps all of it.
@@ -853,7 +1343,7 @@ func (L *Logger) Write(flags MsgFlagT, msgFmt string, msgArgs ...interface{}) er
 	}
 	msg := NewLogMsg().SetFlags(flags)
 	msg.Setf(msgFmt, msgArgs...)
-	return L.WriteMsg(nil, msg)
+	return L.writeMsg(nil, msg)
 }
 
 // WriteMsg send write signal with given message to the specified recorders.
@@ -866,30 +1356,85 @@ func (L *Logger) WriteMsg(recorders []RecorderID, msg *LogMsg) error {
 	if CfgGlobalDisable.Get() {
 		return nil
 	}
+	return L.writeMsg(recorders, msg)
+}
+
+// writeMsg should be called directly from Write and WriteMsg functions
+// only, because it relies on the stack depth to capture the caller.
+func (L *Logger) writeMsg(recorders []RecorderID, msg *LogMsg) error {
 	if msg == nil {
 		return ErrWrongParameter
 	}
+	if msg.flags&Caller > 0 {
+		// skip writeMsg and Write/WriteMsg frames
+		msg.caller = captureCaller(2 + L.callerSkip)
+	}
+	if L.parent != nil {
+		return L.writeChild(recorders, msg)
+	}
+	return L.dispatch(recorders, msg, nil)
+}
+
+// writeChild stamps the message with the child's name and bound fields and
+// passes it to the root logger with collected severity mask overrides.
+func (L *Logger) writeChild(recorders []RecorderID, msg *LogMsg) error {
+	var overrides map[RecorderID]MsgFlagT
+	for c := L; c.parent != nil; c = c.parent {
+		c.RLock()
+		for recID, mask := range c.severityMasks {
+			if overrides == nil {
+				overrides = make(map[RecorderID]MsgFlagT)
+			}
+			if _, exist := overrides[recID]; !exist { // nearest wins
+				overrides[recID] = mask
+			}
+		}
+		c.RUnlock()
+	}
+
+	m := *msg // the user's message stays untouched
+	m.logger = L.name
+	if len(L.fields) > 0 {
+		m.fields = make([]Field, 0, len(L.fields)+len(msg.fields))
+		m.fields = append(m.fields, L.fields...)
+		m.fields = append(m.fields, msg.fields...)
+	}
+	return L.root().dispatch(recorders, &m, overrides)
+}
+
+// dispatch sends the message to the recorders, it should be called on the
+// root logger only. Masks from 'overrides' take precedence over own masks.
+func (L *Logger) dispatch(
+	recorders []RecorderID, msg *LogMsg, overrides map[RecorderID]MsgFlagT,
+) error {
 
 	L.RLock()
-	defer L.RUnlock()
 
 	if !L.initialised {
+		L.RUnlock()
 		return ErrNotInitialised
 	}
 	if len(L.recorders) == 0 {
+		L.RUnlock()
 		return ErrNoRecorders
 	}
 	if L.severityMasks == nil || L.severityOrder == nil {
+		L.RUnlock()
 		return internalError(errMsgBumpedToNil)
 	}
 	if len(L.defaults) == 0 && len(recorders) == 0 {
 		// CAREFULLY! DON'T DELETE THAT
 		// This check is valid, that's not L.recorders.
+		L.RUnlock()
 		return ErrNotWhereToWrite
 	}
 
 	br := BatchResult{}
 	br.SetMsg("an error occurred in some of the given recorders")
+	var dropped bool
+	// messages which wait for free space in the logger's queues,
+	// the logger's lock is released before waiting
+	var blocked []blockedPush
 
 	// set target recorders to write
 	if len(recorders) > 0 {
@@ -908,42 +1453,45 @@ func (L *Logger) WriteMsg(recorders []RecorderID, msg *LogMsg) error {
 		recorders = L.defaults
 	}
 
-	// add stack trace info if the flags specified
+	// add stack trace info if the flags specified, it's also kept
+	// separately for formatters which render it in their own way
 	if (*msg).flags&StackTraceShort > 0 {
 		// TODO: more flexible way
-		st := debug.Stack()
-		str := "---------- stack trace ----------"
-		lines := strings.Split(string(st), "\n")
+		lines := strings.Split(string(debug.Stack()), "\n")
 		// select strings
 		var accumulator []string
 		for i := 1; i < len(lines)-1; i += 2 {
 			accumulator = append(accumulator, lines[i])
 		}
 		// make a result
-		str += "   " + lines[0] + "\n"
+		str := lines[0] + "\n"
 		for i := 1; i < len(accumulator); i++ {
 			str += accumulator[i] + "\n"
 		}
-		str += "---------------------------------"
-		(*msg).content += "\n" + str
+		(*msg).stack = str
 	} else if (*msg).flags&StackTrace > 0 {
-		str := "---------- stack trace ----------"
-		str += "   " + string(debug.Stack())
-		str += "---------------------------------"
-		(*msg).content += "\n" + str
+		(*msg).stack = string(debug.Stack())
 	}
+	(*msg).content = withStackTrace((*msg).content, msg)
 
 	// check that severity flag specified
 	if (*msg).flags&^SeverityShadowMask == 0 {
 		(*msg).flags |= defaultSeverity
 	}
 
+	// recorders receive a copy of the message, so the field list capacity
+	// is clipped to make sure further appends will not affect sent messages
+	(*msg).fields = (*msg).fields[:len((*msg).fields):len((*msg).fields)]
+
 	for _, recID := range recorders {
 		if err := L.severityProtector(L.severityOrder[recID], &((*msg).flags)); err != nil {
 			br.Fail(recID, err)
 			continue
 		}
 		if sevMask, exist := L.severityMasks[recID]; exist {
+			if override, ok := overrides[recID]; ok {
+				sevMask = override
+			}
 			/* already checked
 			if (*msg).flags &^ SeverityShadowMask == 0 {
 				br.Fail(recID, internalError(ieUnreachable, "severity is 0"))
@@ -952,19 +1500,52 @@ func (L *Logger) WriteMsg(recorders []RecorderID, msg *LogMsg) error {
 			if ((*msg).flags&^SeverityShadowMask)&sevMask > 0 { // severity filter
 				rec := L.recorders[recID] // recorder id is valid, already checked
 
-				rec.ChMsg <- *msg
+				if pump, exist := L.pumps[recID]; exist {
+					minor := pump.policy.Mode == OverflowDropBelow &&
+						severityBelow(L.severityOrder[recID], (*msg).flags, pump.policy.Severity)
+					n, ok := pump.push(*msg, minor)
+					if !ok {
+						// flags are adjusted for the recorder, so it's a copy
+						blocked = append(blocked, blockedPush{recID, pump, *msg})
+						continue
+					}
+					if n > 0 {
+						br.Fail(recID, ErrQueueOverflow)
+						br.Drop(recID, n)
+						dropped = true
+						continue
+					}
+				} else {
+					rec.ChMsg <- *msg
+				}
 				br.OK(recID)
 				// NO ERROR CHECK
 			}
 		} else {
 			// UNREACHABLE //
 			//br.Fail(recID, internalError(".severityMasks -> missing valid id (unreachable)"))
+			L.RUnlock()
 			return internalCritical("xlog: missing valid id (.severityMasks)") // PANIC
 		}
 	}
 
-	// write errors ain't possible currently
-	//if br.GetErrors() != nil { return br }
+	L.RUnlock()
+
+	// the pump is stopped if the recorder is unregistered meanwhile
+	for _, b := range blocked {
+		if n := b.pump.pushWait(b.msg); n > 0 {
+			br.Fail(b.id, ErrQueueOverflow)
+			br.Drop(b.id, n)
+			dropped = true
+			continue
+		}
+		br.OK(b.id)
+	}
+
+	// write errors ain't possible currently, only dropped messages
+	if dropped {
+		return br
+	}
 	return nil
 }
 